@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The raw page archive keeps every page each feed sent, one directory
+// per run, one directory per feed within the run, and for each page the
+// body exactly as received plus a sidecar with the request URL and the
+// response headers:
+//
+//	<archive>/20261018T181853.042Z/manifest.json
+//	<archive>/20261018T181853.042Z/00-NA/page-00001.json
+//	<archive>/20261018T181853.042Z/00-NA/page-00001.headers.json
+//	<archive>/20261018T181853.042Z/01-CA/page-00001.json
+//
+// The manifest records the feeds of the run, so the merge stage can
+// replay a run with the regions and feed order it was fetched with.
+
+const ARCHIVE_MANIFEST = "manifest.json"
+const ARCHIVE_RUN_FORMAT = "20060102T150405.000Z"
+
+// archiveManifest describes one archived run
+type archiveManifest struct {
+	Run      string        `json:"run"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished,omitzero"`
+	Feeds    []archiveFeed `json:"feeds"`
+}
+
+// archiveFeed describes one feed of an archived run
+type archiveFeed struct {
+	Feed     int    `json:"feed"`
+	Region   string `json:"region"`
+	Priority int    `json:"priority,omitempty"`
+	Base     string `json:"baseUrl"`
+	Dir      string `json:"dir"`
+	Pages    int    `json:"pages"`
+	Errors   int    `json:"errors"`
+	LastPage int    `json:"lastPage"`
+}
+
+// archivePageInfo is the sidecar of an archived page
+type archivePageInfo struct {
+	Url     string      `json:"url"`
+	Fetched time.Time   `json:"fetched"`
+	Header  http.Header `json:"header"`
+}
+
+// pageArchive is an archive run being written. It is used from the
+// single sink goroutine, so it needs no locking.
+type pageArchive struct {
+	dir      string
+	manifest archiveManifest
+}
+
+// newPageArchive starts a new run under root for the given feeds
+func newPageArchive(root string, endpoints []endPoint) (pa *pageArchive, err error) {
+	now := time.Now().UTC()
+	pa = &pageArchive{manifest: archiveManifest{
+		Run:     now.Format(ARCHIVE_RUN_FORMAT),
+		Started: now,
+		Feeds:   make([]archiveFeed, len(endpoints)),
+	}}
+	pa.dir = filepath.Join(root, pa.manifest.Run)
+	err = os.MkdirAll(root, 0777)
+	if nil != err {
+		return nil, err
+	}
+	// Mkdir fails if the run exists, so two runs are never mixed
+	err = os.Mkdir(pa.dir, 0777)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("archive run %s already exists", pa.dir)
+	}
+	if nil != err {
+		return nil, err
+	}
+	for ix := range endpoints {
+		pa.manifest.Feeds[ix] = archiveFeed{
+			Feed:     ix,
+			Region:   endpoints[ix].Region,
+			Priority: endpoints[ix].Priority,
+			Base:     endpoints[ix].Base,
+			Dir:      feedDirName(ix, endpoints[ix].Region),
+		}
+		err = os.MkdirAll(filepath.Join(pa.dir, pa.manifest.Feeds[ix].Dir), 0777)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return pa, pa.writeManifest()
+}
+
+// save archives one page and its sidecar
+func (pa *pageArchive) save(page feedPage) error {
+	if page.feed < 0 || page.feed >= len(pa.manifest.Feeds) {
+		return fmt.Errorf("page of unknown feed %d", page.feed)
+	}
+	feed := &pa.manifest.Feeds[page.feed]
+	feedDir := filepath.Join(pa.dir, feed.Dir)
+
+	err := os.WriteFile(filepath.Join(feedDir, pageFileName(page.page)), page.body, 0666)
+	if nil != err {
+		feed.Errors++
+		return err
+	}
+	// URLs and Link headers are kept readable (no \u0026 for &)
+	var info bytes.Buffer
+	enc := json.NewEncoder(&info)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(archivePageInfo{Url: page.url, Fetched: page.fetched, Header: page.header})
+	if nil == err {
+		err = os.WriteFile(filepath.Join(feedDir, pageInfoFileName(page.page)), info.Bytes(), 0666)
+	}
+	if nil != err {
+		feed.Errors++
+		return err
+	}
+	feed.Pages++
+	feed.LastPage = max(feed.LastPage, page.page)
+	// keep the manifest current, so an interrupted run can still be merged
+	return pa.writeManifest()
+}
+
+// close records the end of the run in the manifest
+func (pa *pageArchive) close() error {
+	pa.manifest.Finished = time.Now().UTC()
+	return pa.writeManifest()
+}
+
+func (pa *pageArchive) writeManifest() error {
+	txt, err := json.MarshalIndent(pa.manifest, "", "  ")
+	if nil != err {
+		return err
+	}
+	return os.WriteFile(filepath.Join(pa.dir, ARCHIVE_MANIFEST), txt, 0666)
+}
+
+// feedDirName is the directory holding the pages of a feed
+func feedDirName(feed int, region string) string {
+	region = strings.Map(func(r rune) rune {
+		if '/' == r || '\\' == r {
+			return '_'
+		}
+		return r
+	}, region)
+	return fmt.Sprintf("%02d-%s", feed, region)
+}
+
+// pageFileName is the file holding one page of a feed
+func pageFileName(page int) string {
+	return fmt.Sprintf("page-%05d.json", page)
+}
+
+// pageInfoFileName is the sidecar of one page of a feed
+func pageInfoFileName(page int) string {
+	return fmt.Sprintf("page-%05d.headers.json", page)
+}
+
+// archivePages saves every page received to the archive. Failures are
+// logged and also sent to the error output. When forward is set, each
+// page is passed on after it is saved, so the archive can sit in
+// front of the filter stage.
+func archivePages(pa *pageArchive, in <-chan feedPage, forward chan<- feedPage, outError chan<- []byte, allDone func()) {
+	var pageCount int
+	defer allDone()
+
+	for page := range in {
+		err := pa.save(page)
+		if nil != err {
+			xLog.Printf("error archiving page %d of feed %d: %s", page.page, page.feed, err.Error())
+			outError <- []byte(err.Error() + "\n")
+		} else {
+			pageCount++
+		}
+		if nil != forward {
+			forward <- page
+		}
+	}
+	err := pa.close()
+	if nil != err {
+		xLog.Printf("error writing archive manifest: %s", err.Error())
+		outError <- []byte(err.Error() + "\n")
+	}
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("archived %d pages to %s", pageCount, pa.dir)
+	}
+}
+
+// findArchiveRun resolves the run to merge: a run directory, a run ID
+// within the archive root, or (when run is empty) the latest run.
+func findArchiveRun(root string, run string) (dir string, err error) {
+	if "" != run {
+		for _, dir = range []string{run, filepath.Join(root, run)} {
+			if _, err = os.Stat(filepath.Join(dir, ARCHIVE_MANIFEST)); nil == err {
+				return dir, nil
+			}
+		}
+		return "", fmt.Errorf("no archive run %s (in %s or as a directory)", run, root)
+	}
+	if "" == root {
+		return "", fmt.Errorf("no archive directory (use --archive, or --run with a run directory)")
+	}
+	entries, err := os.ReadDir(root)
+	if nil != err {
+		return "", err
+	}
+	var runs []string
+	for _, entry := range entries {
+		if _, err = os.Stat(filepath.Join(root, entry.Name(), ARCHIVE_MANIFEST)); entry.IsDir() && nil == err {
+			runs = append(runs, entry.Name())
+		}
+	}
+	if len(runs) <= 0 {
+		return "", fmt.Errorf("no archive runs in %s", root)
+	}
+	sort.Strings(runs)
+	return filepath.Join(root, runs[len(runs)-1]), nil
+}
+
+// loadArchive sends every page of the archived run in dir to out, in
+// feed order and page order within each feed, then calls allDone.
+func loadArchive(dir string, out chan<- feedPage, allDone func()) (err error) {
+	defer allDone()
+
+	txt, err := os.ReadFile(filepath.Join(dir, ARCHIVE_MANIFEST))
+	if nil != err {
+		return fmt.Errorf("loadArchive(): %s", err.Error())
+	}
+	var manifest archiveManifest
+	err = json.Unmarshal(txt, &manifest)
+	if nil != err {
+		return fmt.Errorf("loadArchive(): manifest %s: %s", dir, err.Error())
+	}
+	if manifest.Finished.IsZero() {
+		xLog.Printf("warning: archive run %s did not finish; merging the pages it has", manifest.Run)
+	}
+
+	for _, feed := range manifest.Feeds {
+		pageCount := 0
+		for page := 1; page <= feed.LastPage; page++ {
+			fn := filepath.Join(dir, feed.Dir, pageFileName(page))
+			body, err := os.ReadFile(fn)
+			if os.IsNotExist(err) {
+				// the fetch failed for this page; it went to error.log
+				continue
+			}
+			if nil != err {
+				return fmt.Errorf("loadArchive(): %s", err.Error())
+			}
+			fp := feedPage{region: feed.Region, priority: feed.Priority, feed: feed.Feed, page: page, body: body}
+			info, err := os.ReadFile(filepath.Join(dir, feed.Dir, pageInfoFileName(page)))
+			if nil == err {
+				var pi archivePageInfo
+				if nil == json.Unmarshal(info, &pi) {
+					fp.url, fp.fetched, fp.header = pi.Url, pi.Fetched, pi.Header
+				}
+			}
+			out <- fp
+			pageCount++
+		}
+		if FlagDebug {
+			xLog.Printf("loaded %d pages of feed %d (region %s) from archive run %s",
+				pageCount, feed.Feed, feed.Region, manifest.Run)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFeedDirName(t *testing.T) {
+	tests := []struct {
+		feed   int
+		region string
+		want   string
+	}{
+		{0, "NA", "00-NA"},
+		{12, "CA", "12-CA"},
+		{3, "a/b\\c", "03-a_b_c"},
+		{1, "127.0.0.1", "01-127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := feedDirName(tt.feed, tt.region); got != tt.want {
+			t.Errorf("feedDirName(%d, %q) = %q, want %q", tt.feed, tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	endpoints := []endPoint{{Region: "NA", Base: "https://na.example/"}, {Region: "CA", Base: "https://ca.example/"}}
+	pa, err := newPageArchive(root, endpoints)
+	if nil != err {
+		t.Fatal(err)
+	}
+	pages := []feedPage{
+		{region: "NA", feed: 0, page: 1, url: "https://na.example/l?a=1&b=2", body: []byte(`{"data":[1]}`),
+			header: http.Header{"X-Total-Count": {"3"}}, fetched: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{region: "NA", feed: 0, page: 3, body: []byte(`{"data":[3]}`)}, // page 2 failed
+		{region: "CA", feed: 1, page: 1, body: []byte(`{"data":[]}`)},
+	}
+	for _, page := range pages {
+		if err = pa.save(page); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err = pa.save(feedPage{feed: 5, page: 1}); nil == err {
+		t.Errorf("saved a page of an unknown feed")
+	}
+	if err = pa.close(); nil != err {
+		t.Fatal(err)
+	}
+
+	for _, run := range []string{"", pa.manifest.Run, pa.dir} {
+		dir, err := findArchiveRun(root, run)
+		if nil != err || dir != pa.dir {
+			t.Errorf("findArchiveRun(%q) = %q, %v, want %q", run, dir, err, pa.dir)
+		}
+	}
+	if _, err = findArchiveRun(root, "19990101T000000.000Z"); nil == err {
+		t.Errorf("found a run that does not exist")
+	}
+	// archiving is off unless asked for; a run directory still merges
+	if def := archiveFlags().Lookup("archive").DefValue; "" != def {
+		t.Errorf("--archive defaults to %q, want no archive", def)
+	}
+	if dir, err := findArchiveRun("", pa.dir); nil != err || dir != pa.dir {
+		t.Errorf("findArchiveRun without an archive, of %q = %q, %v", pa.dir, dir, err)
+	}
+	if _, err = findArchiveRun("", ""); nil == err {
+		t.Errorf("found the latest run without an archive")
+	}
+
+	out := make(chan feedPage, 8)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	err = loadArchive(pa.dir, out, wg.Done)
+	wg.Wait()
+	close(out)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var loaded []feedPage
+	for page := range out {
+		loaded = append(loaded, page)
+	}
+	if len(loaded) != len(pages) {
+		t.Fatalf("loaded %d pages, want %d", len(loaded), len(pages))
+	}
+	for ix := range pages {
+		want, got := pages[ix], loaded[ix]
+		if want.feed != got.feed || want.page != got.page || want.region != got.region ||
+			string(want.body) != string(got.body) || want.url != got.url {
+			t.Errorf("page %d: loaded %+v, want %+v", ix, got, want)
+		}
+	}
+	if "3" != loaded[0].header.Get("X-Total-Count") || !loaded[0].fetched.Equal(pages[0].fetched) {
+		t.Errorf("sidecar not loaded: %+v", loaded[0])
+	}
+}
+
+func TestNewPageArchiveRuns(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "archive")
+	tests := []struct {
+		name      string
+		endpoints []endPoint
+	}{
+		{"no feeds", nil},
+		{"one feed", []endPoint{{Region: "NA", Base: "https://na.example/"}}},
+	}
+	runs := make(map[string]bool, len(tests))
+	for _, tt := range tests {
+		pa, err := newPageArchive(root, tt.endpoints)
+		if nil != err {
+			// a run started in the same millisecond is refused, never mixed
+			time.Sleep(2 * time.Millisecond)
+			pa, err = newPageArchive(root, tt.endpoints)
+		}
+		if nil != err {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(pa.dir, ARCHIVE_MANIFEST)); nil != err {
+			t.Errorf("%s: no manifest: %s", tt.name, err)
+		}
+		if runs[pa.manifest.Run] {
+			t.Errorf("%s: run %s reused", tt.name, pa.manifest.Run)
+		}
+		runs[pa.manifest.Run] = true
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+// command is one subcommand of the program. Each command has its own
+// flag set, made up of the flag groups it needs, and a run function
+// that is given the positional arguments and returns the exit code.
+// A command whose report goes to stdout keeps the log off it.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	flags   *pflag.FlagSet
+	run     func(args []string) int
+	report  bool
+}
+
+// commandList holds every command; the first is the default,
+// used when no command is named (the original single run).
+var commandList []*command
+
+// theCommand is the command selected by the program arguments
+var theCommand *command
+
+// initCommands builds the command list. The flag groups are built once
+// and shared, so a flag means the same thing in every command.
+func initCommands() {
+	std := standardFlags()
+	feed := feedFlags()
+	output := outputFlags()
+	archive := archiveFlags()
+	identity := identityFlags()
+	dedupe := dedupeFlags()
+	selection := selectionFlags()
+	schema := schemaFlags()
+	normalize := normalizeFlags()
+	quality := qualityFlags()
+
+	health := newFlagSet("healthcheck")
+	health.StringVarP(&FlagHealthFormat, "format", "", HEALTH_FORMAT_TABLE,
+		"Report format: table or json")
+
+	merge := newFlagSet("merge")
+	merge.StringVarP(&FlagArchiveRun, "run", "", "",
+		"Archive run to merge: a run ID in the archive or a run directory (default: the latest run)")
+
+	serve := newFlagSet("serve")
+	serve.StringVarP(&FlagServeAddr, "addr", "", "localhost:8080",
+		"Address to listen on")
+
+	diff := newFlagSet("diff")
+	diff.BoolVarP(&FlagDiffList, "list", "", false,
+		"List the key of each added, removed and changed station")
+
+	commandList = []*command{
+		{name: "run", usage: "[flags]",
+			summary: "fetch every feed, remove duplicates and write stations.json (default command)",
+			run:     runCommand, flags: withFlags("run", std, feed, output, identity, normalize, dedupe, selection, schema, quality, archive)},
+		{name: "fetch", usage: "[flags]",
+			summary: "fetch every feed, saving the raw pages to a new run in the archive",
+			run:     fetchCommand, flags: withFlags("fetch", std, feed, archive)},
+		{name: "merge", usage: "[flags]",
+			summary: "remove duplicates from an archived run and write stations.json",
+			run:     mergeCommand, flags: withFlags("merge", std, output, identity, normalize, dedupe, selection, schema, quality, archive, merge)},
+		{name: "healthcheck", usage: "[flags]",
+			summary: "check that every endpoint is reachable and answering",
+			run:     healthCheckCommand, flags: withFlags("healthcheck", std, feed, health), report: true},
+		{name: "validate", usage: "[flags] [stations.json ...]",
+			summary: "check the endpoints file and that each stations file is well-formed",
+			run:     validateCommand, flags: withFlags("validate", std, feed, schema)},
+		{name: "diff", usage: "[flags] old.json new.json",
+			summary: "compare two stations files",
+			run:     diffCommand, flags: withFlags("diff", std, identity, diff), report: true},
+		{name: "stats", usage: "[flags] [stations.json]",
+			summary: "summarize a stations file by region, country and connector",
+			run:     statsCommand, flags: withFlags("stats", std), report: true},
+		{name: "serve", usage: "[flags] [stations.json]",
+			summary: "serve a stations file over HTTP",
+			run:     serveCommand, flags: withFlags("serve", std, identity, serve)},
+	}
+}
+
+// withFlags makes a command flag set from flag groups
+func withFlags(name string, groups ...*pflag.FlagSet) (fs *pflag.FlagSet) {
+	fs = newFlagSet(name)
+	for _, group := range groups {
+		fs.AddFlagSet(group)
+	}
+	return fs
+}
+
+// findCommand returns the named command, or nil if there is none
+func findCommand(name string) *command {
+	for _, cmd := range commandList {
+		if strings.EqualFold(cmd.name, name) {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// commandUsages lists the commands with a one-line summary of each
+func commandUsages() string {
+	var sb strings.Builder
+	sb.WriteString("Commands (use <command> --help for the flags of each):\n")
+	for _, cmd := range commandList {
+		sb.WriteString(fmt.Sprintf("\t%-12s %s\n", cmd.name, cmd.summary))
+	}
+	return sb.String()
+}
+
+// runCommand is the original behavior: fetch, remove duplicates, write.
+// With --archive, every page is also archived.
+func runCommand(_ []string) int {
+	endpoints := loadEndpoints(FlagAuthTokenFile)
+	sink := filterJsonPage
+	if "" != FlagArchiveDir {
+		pa, err := newPageArchive(FlagArchiveDir, endpoints)
+		if nil != err {
+			xLog.Printf("cannot archive: %s", err.Error())
+			return -1
+		}
+		sink = func(in <-chan feedPage, outError chan<- []byte, allDone func()) {
+			var wg sync.WaitGroup
+			archived := make(chan feedPage, 16)
+			wg.Add(1)
+			go filterJsonPage(archived, outError, wg.Done)
+			archivePages(pa, in, archived, outError, func() {
+				close(archived)
+				wg.Wait()
+				allDone()
+			})
+		}
+	}
+	return runPipeline(
+		func(out chan<- feedPage, outError chan<- []byte, allDone func()) error {
+			return mergeFeeds(endpoints, out, outError, allDone)
+		},
+		sink)
+}
+
+// fetchCommand downloads every feed to a new run in the archive
+func fetchCommand(_ []string) int {
+	if "" == FlagArchiveDir {
+		xLog.Printf("cannot fetch: no archive directory (use --archive)")
+		return -1
+	}
+	endpoints := loadEndpoints(FlagAuthTokenFile)
+	pa, err := newPageArchive(FlagArchiveDir, endpoints)
+	if nil != err {
+		xLog.Printf("cannot fetch: %s", err.Error())
+		return -1
+	}
+	rc := runPipeline(
+		func(out chan<- feedPage, outError chan<- []byte, allDone func()) error {
+			return mergeFeeds(endpoints, out, outError, allDone)
+		},
+		func(in <-chan feedPage, outError chan<- []byte, allDone func()) {
+			archivePages(pa, in, nil, outError, allDone)
+		})
+	xLog.Printf("fetched archive run %s", pa.manifest.Run)
+	return rc
+}
+
+// mergeCommand removes duplicates from an archived run
+func mergeCommand(_ []string) int {
+	dir, err := findArchiveRun(FlagArchiveDir, FlagArchiveRun)
+	if nil != err {
+		xLog.Printf("cannot merge: %s", err.Error())
+		return -1
+	}
+	xLog.Printf("merging archive run %s", dir)
+	return runPipeline(
+		func(out chan<- feedPage, outError chan<- []byte, allDone func()) error {
+			return loadArchive(dir, out, allDone)
+		},
+		filterJsonPage)
+}
+
+// healthCheckCommand checks every endpoint
+func healthCheckCommand(_ []string) int {
+	return healthCheck(loadEndpoints(FlagAuthTokenFile), FlagHealthFormat)
+}
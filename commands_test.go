@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestFindCommand(t *testing.T) {
+	initCommands()
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"run", "run"},
+		{"RUN", "run"},
+		{"HealthCheck", "healthcheck"},
+		{"merge", "merge"},
+		{"fetch", "fetch"},
+		{"nope", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if cmd := findCommand(tt.name); nil != cmd {
+			got = cmd.name
+		}
+		if got != tt.want {
+			t.Errorf("findCommand(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if "run" != commandList[0].name {
+		t.Errorf("default command is %s, want run", commandList[0].name)
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	initCommands()
+	tests := []struct {
+		command string
+		flag    string
+		want    bool
+	}{
+		{"run", "debug", true},
+		{"run", "tokens", true},
+		{"run", "archive", true},
+		{"run", "format", false},
+		{"run", "run", false},
+		{"fetch", "outputformat", false},
+		{"merge", "tokens", false},
+		{"merge", "run", true},
+		{"healthcheck", "format", true},
+		{"healthcheck", "outputformat", false},
+		{"stats", "quiet", true},
+		{"serve", "addr", true},
+		{"diff", "list", true},
+	}
+	for _, tt := range tests {
+		cmd := findCommand(tt.command)
+		if got := nil != cmd.flags.Lookup(tt.flag); got != tt.want {
+			t.Errorf("%s --%s: has flag %v, want %v", tt.command, tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestCommandFlagsParse(t *testing.T) {
+	initCommands()
+	cmd := findCommand("merge")
+	err := cmd.flags.Parse([]string{"--run", "20261018T181853.042Z", "--Debug=false"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "20261018T181853.042Z" != FlagArchiveRun || FlagDebug {
+		t.Errorf("parsed --run %q --debug %v", FlagArchiveRun, FlagDebug)
+	}
+	if err = findCommand("healthcheck").flags.Parse([]string{"--run", "x"}); nil == err {
+		t.Errorf("healthcheck accepted --run")
+	}
+}
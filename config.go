@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"slices"
 	"strings"
 
 	misc "github.com/nathanverrilli/nlvMisc"
@@ -13,10 +15,16 @@ import (
 )
 
 const jsonDataExample string = "\n{ \"endpoints\": [" +
-	"\n\t{\t\"baseUrl\": \"https://ocpi.chargepoint.com/\"," +
+	"\n\t{\t\"region\": \"NA\"," +
+	"\n\t\t\"baseUrl\": \"https://ocpi.chargepoint.com/\"," +
 	"\n\t\t\"token\": \"ORG ==NA==PROD==DEN==\"\n\t}," +
-	"\n\t{\t\"baseUrl\": \"https://ocpi-ca.chargepoint.com/\"," +
-	"\n\t\t\"token\": \"ORG ==CA==PROD==DEN==\"\n\t}" +
+	"\n\t{\t\"region\": \"CA\"," +
+	"\n\t\t\"baseUrl\": \"https://ocpi-ca.chargepoint.com/\"," +
+	"\n\t\t\"token\": \"ORG ==CA==PROD==DEN==\"," +
+	"\n\t\t\"modules\": { \"locations\": \"den/cpo/1.0/locations/\" }," +
+	"\n\t\t\"pageSize\": 1000," +
+	"\n\t\t\"query\": { \"date_from\": \"2024-01-01T00:00:00Z\" }," +
+	"\n\t\t\"headers\": { \"OCPI-to-country-code\": \"CA\" }\n\t}" +
 	"\n] }\n"
 
 // wordSepNormalizeFunc all options are lowercase, so
@@ -25,6 +33,22 @@ func wordSepNormalizeFunc(_ *pflag.FlagSet, name string) pflag.NormalizedName {
 	return pflag.NormalizedName(strings.ToLower(name))
 }
 
+// whereExpr is the parsed --where expression, nil if there is none
+var whereExpr whereNode
+
+// theGeofence is the loaded --geofence, nil if there is none
+var theGeofence *geofence
+
+// theTransform is the loaded --transform, nil if there is none
+var theTransform *transform
+
+// qualityLimits are the parsed --qualitymax limits, percent by check
+var qualityLimits map[string]float64
+
+// theNormalizer applies the --normalize normalizers, nil if there are none
+var theNormalizer *normalizer
+
+// nFlags holds the flags of the selected command
 var nFlags *pflag.FlagSet
 
 /* secret flags */
@@ -43,64 +67,373 @@ var FlagDebug bool
 /* program flags  */
 
 var FlagAuthTokenFile string
+var FlagRegionFiles bool
+var FlagTransformFile string
+var FlagOutputFormat []string
+var FlagGzip bool
+var FlagGeojsonProps []string
+var FlagGeojsonEvses bool
+var FlagCsvRows string
+var FlagCsvColumns []string
+var FlagKmlFolders string
+var FlagSort bool
+var FlagSortKey []string
+var FlagSchema string
+var FlagDedupeKey []string
+var FlagConflict string
+var FlagDeepMerge bool
+var FlagDupReport bool
+var FlagWorkers int
+var FlagIndex string
+var FlagIndexDir string
+var FlagMemLimit int
+var FlagNearbyRadius float64
+var FlagNearbyConfidence float64
+var FlagNearbyMerge bool
+var FlagEvseConflict string
+var FlagWhere string
+var FlagExplain bool
+var FlagGeofence string
+var FlagGeofenceTag bool
+var FlagNormalize []string
+var FlagQuality bool
+var FlagQualityStale int
+var FlagQualityMin float64
+var FlagQualityMax []string
+var FlagHealthFormat string
+var FlagArchiveDir string
+var FlagArchiveRun string
+var FlagServeAddr string
+var FlagDiffList bool
+
+// newFlagSet makes an empty, lowercase-normalized flag set
+func newFlagSet(name string) (fs *pflag.FlagSet) {
+	fs = pflag.NewFlagSet(name, pflag.ContinueOnError)
+	fs.SetNormalizeFunc(wordSepNormalizeFunc)
+	return fs
+}
 
-// initFlags initializes the command line flags for the program.
-// It sets up the flag set, defines the flags, and parses the command line arguments.
-// Some flags are hidden from the user as they are meant only for testing
-func initFlags() {
-	var err error
+// standardFlags are the flags common to every command
+func standardFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("standard")
 
-	hideFlags := make(map[string]struct{}, 4)
+	fs.BoolVarP(&FlagDebug, "debug", "d",
+		true, "Enable additional informational and operational logging output for debug purposes")
 
-	nFlags = pflag.NewFlagSet("default", pflag.ContinueOnError)
-	nFlags.SetNormalizeFunc(wordSepNormalizeFunc)
+	fs.BoolVarP(&FlagVerbose, "verbose", "v",
+		true, "Supply additional run messages; use --debug for more information")
+
+	fs.BoolVarP(&FlagHelp, "help", "h",
+		false, "Display help message and usage information")
+
+	fs.BoolVarP(&FlagQuiet, "quiet", "q",
+		false, "Suppress log output to stdout and stderr (output still goes to logfile)")
+	return fs
+}
+
+// feedFlags are the flags of commands that talk to the feeds.
+// Some flags are hidden from the user as they are meant only for testing
+func feedFlags() (fs *pflag.FlagSet) {
+	hideFlags := make(map[string]struct{}, 4)
+	fs = newFlagSet("feed")
 
 	// secret flags
 
-	nFlags.BoolVarP(&FlagDebugger, "debugger", "", false,
+	fs.BoolVarP(&FlagDebugger, "debugger", "", false,
 		"enable http mutex for debugging (only one http call at a time)")
 	hideFlags["debugger"] = struct{}{}
 
-	nFlags.BoolVarP(&FlagSlow, "slow", "", false,
+	fs.BoolVarP(&FlagSlow, "slow", "", false,
 		"Add some time between http calls (do not hammer server)")
 	hideFlags["slow"] = struct{}{}
 
-	nFlags.BoolVarP(&FlagDestInsecure, "insecure", "", false,
+	fs.BoolVarP(&FlagDestInsecure, "insecure", "", false,
 		"do not verify server cert (dangerous)")
 	hideFlags["insecure"] = struct{}{}
 
-	nFlags.IntVarP(&FlagMaxCalls, "maxcalls", "", 0,
+	fs.IntVarP(&FlagMaxCalls, "maxcalls", "", 0,
 		"Make only a few calls to any feed to speed up testing (0 == no limit)")
 	hideFlags["maxcalls"] = struct{}{}
 
 	// program flags
 
-	nFlags.StringVarP(&FlagAuthTokenFile, "tokens", "", "endpoints.json",
-		"JSON file containing base URL and authorization token for each feed\nIn this format:\n"+jsonDataExample)
-
-	nFlags.BoolVarP(&FlagDebug, "debug", "d",
-		true, "Enable additional informational and operational logging output for debug purposes")
-
-	nFlags.BoolVarP(&FlagVerbose, "verbose", "v",
-		true, "Supply additional run messages; use --debug for more information")
-
-	nFlags.BoolVarP(&FlagHelp, "help", "h",
-		false, "Display help message and usage information")
-
-	nFlags.BoolVarP(&FlagQuiet, "quiet", "q",
-		false, "Suppress log output to stdout and stderr (output still goes to logfile)")
+	fs.StringVarP(&FlagAuthTokenFile, "tokens", "", "endpoints.json",
+		"JSON file containing region, base URL and authorization token for each feed,\n"+
+			"optionally with module paths, page size, extra query parameters and headers\nIn this format:\n"+jsonDataExample)
 
 	for flagName := range hideFlags {
-		err = nFlags.MarkHidden(flagName)
+		err := fs.MarkHidden(flagName)
 		if nil != err {
 			xLog.Printf("could not mark flag %s hidden because %s\n",
 				flagName, err.Error())
 			myFatal()
 		}
 	}
+	return fs
+}
+
+// outputFlags are the flags of commands that write stations.json
+func outputFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("output")
+
+	fs.BoolVarP(&FlagRegionFiles, "regionfiles", "", false,
+		"Also write a stations-<region>.json file for each region, in addition to stations.json")
+
+	fs.StringSliceVarP(&FlagOutputFormat, "outputformat", "", []string{FORMAT_JSON},
+		"Formats of the stations files, each written to its own file:\n"+
+			"  json    - stations.json, one {\"data\": [ ... ] } document\n"+
+			"  ndjson  - stations.ndjson, one station per line (JSON Lines)\n"+
+			"  geojson - stations.geojson, a GeoJSON FeatureCollection of a Point\n"+
+			"            per station with coordinates, or per EVSE with --geojsonevses\n"+
+			"  csv     - stations.csv, a row per location, EVSE or connector (--csvrows)\n"+
+			"  kml     - stations.kml, a placemark per station with coordinates, in\n"+
+			"            folders by --kmlfolders, styled by connector standard\n"+
+			"(a list, e.g. json,csv; the exports, geojson, csv and kml, are made without\n"+
+			"--transform, and cannot be written with it)")
+
+	fs.BoolVarP(&FlagGzip, "gzip", "", false,
+		"Compress the stations files with gzip, adding .gz to their names")
+
+	fs.StringSliceVarP(&FlagGeojsonProps, "geojsonprops", "",
+		[]string{GEO_PROP_NAME, GEO_PROP_OPERATOR, GEO_PROP_CONNECTOR_TYPES, GEO_PROP_MAX_POWER, GEO_PROP_EVSE_COUNT, GEO_PROP_FEED},
+		"Properties of each GeoJSON feature, from: id, name, operator, address, city,\n"+
+			"country, connector_types, max_power (W), evse_count, feed, region, last_updated")
+
+	fs.BoolVarP(&FlagGeojsonEvses, "geojsonevses", "", false,
+		"Write a GeoJSON feature per EVSE, at its own coordinates if it has them,\n"+
+			"with its evse_uid, evse_id and status")
+
+	fs.StringVarP(&FlagCsvRows, "csvrows", "", CSV_ROWS_LOCATION,
+		"Rows of the CSV export: a row per location, evse or connector")
+
+	fs.StringSliceVarP(&FlagCsvColumns, "csvcolumns", "", nil,
+		"Columns of the CSV export (default: a set for each --csvrows). For any rows:\n"+
+			"  key, id, country_code, party_id, name, address, city, postal_code, country,\n"+
+			"  latitude, longitude, operator, time_zone, directions, region, feed,\n"+
+			"  last_updated, evse_count, connector_types, max_power (W)\n"+
+			"for rows per evse or connector:\n"+
+			"  evse_uid, evse_id, evse_status, evse_latitude, evse_longitude,\n"+
+			"  capabilities, connector_count\n"+
+			"for rows per connector:\n"+
+			"  connector_id, standard, format, power_type, voltage, amperage, power (W),\n"+
+			"  tariff_id")
+
+	fs.StringVarP(&FlagKmlFolders, "kmlfolders", "", KML_FOLDERS_OPERATOR,
+		"Folders of the KML export: a folder per operator or region, or none")
+
+	fs.StringVarP(&FlagTransformFile, "transform", "", "",
+		"JSON file of transforms applied to each station written to stations.json\n"+
+			"(or stations.ndjson; not allowed with the geojson, csv or kml formats):\n"+
+			"fields to include, exclude, redact and rename, by JSON path, and constant\n"+
+			"fields to add. In this format:\n"+transformExample)
+
+	fs.BoolVarP(&FlagSort, "sort", "", false,
+		"Write stations sorted by --sortkey, ties broken by their JSON, with the\n"+
+			"fields of each object in sorted order, so that the same stations always\n"+
+			"make the same file -- given a --conflict other than first, the same feeds\n"+
+			"too (holds every station; spills to disk past half of --memlimit)")
+
+	fs.StringSliceVarP(&FlagSortKey, "sortkey", "", []string{"country_code", "party_id", "id"},
+		"Fields stations are sorted by with --sort, from the --dedupekey fields")
+	return fs
+}
+
+// dedupeFlags are the flags of commands that remove duplicates
+func dedupeFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("dedupe")
+
+	fs.StringVarP(&FlagConflict, "conflict", "", CONFLICT_NEWEST,
+		"Which copy of a duplicated station to keep:\n"+
+			"  newest   - the newest last_updated, ties by feed priority\n"+
+			"  priority - the copy from the highest priority feed\n"+
+			"  merge    - the newest, with empty fields filled from the other copies\n"+
+			"  first    - the first to arrive, streamed as it arrives; uses the least\n"+
+			"             memory, but depends on network timing, so runs may differ\n"+
+			"All but first hold every station until the feeds are read")
+
+	fs.BoolVarP(&FlagDeepMerge, "deepmerge", "", false,
+		"Merge every copy of a duplicated station: union EVSEs, connectors, images,\n"+
+			"facilities and opening times, recording the feed of each piece in\n"+
+			"\"provenance\"; scalar conflicts go to the copy --conflict prefers\n"+
+			"(not with --conflict first)")
+
+	fs.IntVarP(&FlagWorkers, "workers", "", runtime.NumCPU(),
+		"Number of workers decoding and deduplicating pages in parallel")
+
+	fs.StringVarP(&FlagIndex, "index", "", INDEX_MEMORY,
+		"Dedupe index: memory, or disk for merges too large for memory -- stations\n"+
+			"are spilled to sorted runs on disk and merged once the feeds are read,\n"+
+			"then written in key order")
+
+	fs.StringVarP(&FlagIndexDir, "indexdir", "", "",
+		"Directory for the sorted runs of the disk index, --sort and the KML export\n"+
+			"(default: system temporary directory)")
+
+	fs.IntVarP(&FlagMemLimit, "memlimit", "", 512,
+		"Memory ceiling in MiB with --index disk: half buffers stations before\n"+
+			"spilling a run, and the whole is the Go runtime's soft memory limit.\n"+
+			"--sort also buffers half before spilling, and each KML file a quarter")
+
+	fs.BoolVarP(&FlagDupReport, "dupreport", "", false,
+		"Write duplicates.json and duplicates.txt, showing where each duplicated\n"+
+			"station was found and how its copies differ")
+
+	fs.Float64VarP(&FlagNearbyRadius, "nearby", "", 0,
+		"Find near duplicates: stations from different feeds within this many meters\n"+
+			"with similar names and addresses, reported in nearduplicates.json\n"+
+			"(0 == off; holds every station until the feeds are read)")
+
+	fs.Float64VarP(&FlagNearbyConfidence, "nearbyconfidence", "", 0.7,
+		"Least confidence (0 to 1) of a near duplicate, from distance, name and address")
+
+	fs.BoolVarP(&FlagNearbyMerge, "nearbymerge", "", false,
+		"Merge near duplicates into the copy --conflict prefers, listing the keys\n"+
+			"merged in \"near_duplicates\"; stations are merged only in groups in\n"+
+			"which every two of them are near duplicates")
+
+	fs.StringVarP(&FlagEvseConflict, "evseconflict", "", "",
+		"Find EVSEs whose evse_id is under more than one location, reported in\n"+
+			"evseconflicts.json, and settle them:\n"+
+			"  newest - keep the EVSE in the location with the newest last_updated\n"+
+			"  drop   - drop the EVSE from every location\n"+
+			"  both   - keep it in each, listing it in the location's \"evse_conflicts\"\n"+
+			"(empty == off; holds every station until the feeds are read)")
+	return fs
+}
+
+// identityFlags are the flags of commands that identify stations
+func identityFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("identity")
+
+	fs.StringSliceVarP(&FlagDedupeKey, "dedupekey", "", []string{"country_code", "party_id", "id"},
+		"Fields identifying a station for duplicate detection, from: id, country_code,\n"+
+			"party_id, region, country, name, address, city, postal_code")
+	return fs
+}
+
+// selectionFlags are the flags of commands that select the stations written
+func selectionFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("selection")
+
+	fs.StringVarP(&FlagWhere, "where", "", "",
+		"Write only the stations matching an expression, e.g.\n"+
+			"  country in (\"USA\",\"CAN\") and evses.connectors.max_electric_power >= 50000\n"+
+			"  and parking_type != \"ON_DRIVEWAY\"\n"+
+			"Fields are JSON names, dots for nested fields; and, or, not, parentheses,\n"+
+			"= != < <= > >= and in (...) are supported. A missing field equals nothing:\n"+
+			"!= and not in hold for it, and every other comparison is false (so the\n"+
+			"example keeps stations without a parking_type), except that a missing\n"+
+			"field is false to = true and = false")
+
+	fs.BoolVarP(&FlagExplain, "explain", "", false,
+		"Log how many stations each top-level clause of --where removed")
+
+	fs.StringVarP(&FlagGeofence, "geofence", "", "",
+		"Write only the stations inside a bounding box, minLon,minLat,maxLon,maxLat,\n"+
+			"or inside the Polygon and MultiPolygon features of a GeoJSON file (holes excluded)")
+
+	fs.BoolVarP(&FlagGeofenceTag, "geofencetag", "", false,
+		"Tag each station with the \"name\" property (else the id) of the geofence\n"+
+			"feature containing it, in \"geofence\"")
+	return fs
+}
+
+// schemaFlags are the flags of commands that validate stations against the OCPI schema
+func schemaFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("schema")
+
+	fs.StringVarP(&FlagSchema, "schema", "", "",
+		"Validate each station against the OCPI Location, EVSE and Connector schema\n"+
+			"of this version (2.1.1 or 2.2.1): required fields, enumerations, string\n"+
+			"lengths and coordinate formats. Invalid stations are written with their\n"+
+			"violations to quarantine.json instead of stations.json (empty == off)")
+	return fs
+}
+
+// normalizeFlags are the flags of commands that normalize stations
+func normalizeFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("normalize")
+
+	fs.StringSliceVarP(&FlagNormalize, "normalize", "", nil,
+		"Normalize each station as it is decoded, before duplicates are found,\n"+
+			"with these normalizers (or all):\n"+
+			"  coordinates - 6 decimal places\n"+
+			"  address     - collapse spacing; title-case all upper or lower case\n"+
+			"                addresses and cities\n"+
+			"  postalcode  - upper case, in the national format (USA, CAN, GBR, IRL, NLD)\n"+
+			"  country     - country as ISO alpha-3, country_code as ISO alpha-2\n"+
+			"  power       - max_electric_power in W, where given in kW\n"+
+			"  timezone    - IANA names for legacy names and abbreviations\n"+
+			"(empty == off)")
+	return fs
+}
+
+// qualityFlags are the flags of commands that check data quality
+func qualityFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("quality")
+
+	fs.BoolVarP(&FlagQuality, "quality", "", false,
+		"Check each station written for data quality issues and write a scorecard\n"+
+			"per feed to quality.json; a feed's score is the percent of its stations\n"+
+			"without issues. The checks:\n"+
+			"  bad_coordinates  - unreadable or out of range\n"+
+			"  zero_coordinates - at 0,0\n"+
+			"  outside_country  - outside the declared country (common countries only)\n"+
+			"  no_evses         - no EVSEs\n"+
+			"  zero_power       - a connector without power\n"+
+			"  stale            - last_updated missing or older than --qualitystale\n"+
+			"  no_time_zone     - no time_zone\n"+
+			"  empty_address    - no address or city")
+
+	fs.IntVarP(&FlagQualityStale, "qualitystale", "", 365,
+		"Days after which a station's last_updated is stale")
+
+	fs.Float64VarP(&FlagQualityMin, "qualitymin", "", 0,
+		"Fail the run (exit 1) if any feed scores below this percent (0 == never)")
+
+	fs.StringSliceVarP(&FlagQualityMax, "qualitymax", "", nil,
+		"Fail the run (exit 1) if in any feed more than a percent of stations have\n"+
+			"an issue, as check=percent, e.g. zero_coordinates=0,no_evses=5")
+	return fs
+}
+
+// archiveFlags are the flags of commands that write or read the raw page archive
+func archiveFlags() (fs *pflag.FlagSet) {
+	fs = newFlagSet("archive")
+
+	fs.StringVarP(&FlagArchiveDir, "archive", "", "",
+		"Raw page archive, one directory per run, e.g. "+filepath.Join(DEFAULT_OUTPUT_DIR, "archive")+"\n"+
+			"(off by default: run archives the pages it fetches only when this is set;\n"+
+			"fetch needs it, and so does merge unless --run names a run directory)")
+	return fs
+}
+
+// initFlags selects the command named by the first program argument
+// (run, if there is none) and parses that command's flags from the
+// remaining arguments.
+func initFlags() {
+	var err error
+
+	initCommands()
+
+	args := os.Args[1:]
+	theCommand = commandList[0]
+	explicitCommand := false
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd := findCommand(args[0])
+		if nil == cmd {
+			_, _ = fmt.Fprintf(os.Stderr, "\n%s\n", commandUsages())
+			xLog.Fatalf("\nunknown command %s\n  Program arguments are:\n\t%v\n",
+				args[0], os.Args)
+		}
+		theCommand = cmd
+		explicitCommand = true
+		args = args[1:]
+	}
+	nFlags = theCommand.flags
 
 	// Fetch and load the program flags
-	err = nFlags.Parse(os.Args[1:])
+	err = nFlags.Parse(args)
 	if nil != err {
 		_, _ = fmt.Fprintf(os.Stderr, "\n%s\n", nFlags.FlagUsagesWrapped(75))
 		xLog.Fatalf("\nerror parsing flags because: %s\n%s %s\n%s\n\t%v\n",
@@ -114,25 +447,138 @@ func initFlags() {
 	// do quietness setup first
 	// only write to logfile not stderr
 	// for debug and verbose messages
+	if theCommand.report {
+		// the report is on stdout, so the log goes to stderr
+		setLogConsole(os.Stderr)
+	}
 	if FlagQuiet {
 		xLog.SetOutput(xLogBuffWriter)
 		// messages only to logfile, not stderr
 	}
 
 	if FlagDebug && FlagVerbose {
-		xLog.Println("\t\t/*** start program flags ***/\n")
+		xLog.Printf("\t\t/*** start program flags (command %s) ***/\n\n", theCommand.name)
 		nFlags.VisitAll(logFlag)
 		xLog.Println("\t\t/***   end program flags ***/")
 	}
 
+	err = checkDedupeKey(FlagDedupeKey)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --dedupekey: %s\n", err.Error())
+	}
+
+	err = checkConflictStrategy(FlagConflict)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --conflict: %s\n", err.Error())
+	}
+	if FlagDeepMerge && CONFLICT_FIRST == FlagConflict {
+		xLog.Fatalf("\nerror in flag --deepmerge: needs a --conflict strategy other than %s\n", CONFLICT_FIRST)
+	}
+
+	err = checkNearby()
+	if nil != err {
+		xLog.Fatalf("\nerror in near duplicate flags: %s\n", err.Error())
+	}
+
+	err = checkEvsePolicy(FlagEvseConflict)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --evseconflict: %s\n", err.Error())
+	}
+
+	if "" != strings.TrimSpace(FlagWhere) {
+		whereExpr, err = parseWhere(FlagWhere)
+		if nil != err {
+			xLog.Fatalf("\nerror in flag --where: %s\n", err.Error())
+		}
+	} else if FlagExplain {
+		xLog.Fatalf("\nerror in flag --explain: needs a --where expression\n")
+	}
+
+	if "" != FlagGeofence {
+		theGeofence, err = loadGeofence(FlagGeofence)
+		if nil != err {
+			xLog.Fatalf("\nerror in flag --geofence: %s\n", err.Error())
+		}
+	} else if FlagGeofenceTag {
+		xLog.Fatalf("\nerror in flag --geofencetag: needs a --geofence\n")
+	}
+
+	theNormalizer, err = newNormalizer(FlagNormalize)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --normalize: %s\n", err.Error())
+	}
+
+	qualityLimits, err = checkQuality()
+	if nil != err {
+		xLog.Fatalf("\nerror in quality flags: %s\n", err.Error())
+	}
+
+	err = checkSchemaVersion(FlagSchema)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --schema: %s\n", err.Error())
+	}
+
+	if "" != FlagTransformFile {
+		theTransform, err = loadTransform(FlagTransformFile)
+		if nil != err {
+			xLog.Fatalf("\nerror in flag --transform: %s\n", err.Error())
+		}
+	}
+
+	err = checkOutputFormats(FlagOutputFormat)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --outputformat: %s\n", err.Error())
+	}
+	if "" != FlagTransformFile {
+		err = checkTransformFormats(FlagOutputFormat)
+		if nil != err {
+			xLog.Fatalf("\nerror in flag --transform: %s\n", err.Error())
+		}
+	}
+
+	err = checkGeoProperties(FlagGeojsonProps)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --geojsonprops: %s\n", err.Error())
+	}
+
+	err = checkCsvFlags()
+	if nil != err {
+		xLog.Fatalf("\nerror in CSV flags: %s\n", err.Error())
+	}
+
+	err = checkKmlFolders(FlagKmlFolders)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --kmlfolders: %s\n", err.Error())
+	}
+
+	err = checkSortKey(FlagSortKey)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --sortkey: %s\n", err.Error())
+	}
+
+	err = checkIndexKind(FlagIndex)
+	if nil != err {
+		xLog.Fatalf("\nerror in flag --index: %s\n", err.Error())
+	}
+	if (INDEX_DISK == FlagIndex || FlagSort || slices.Contains(FlagOutputFormat, FORMAT_KML)) && FlagMemLimit <= 0 {
+		xLog.Fatalf("\nerror in flag --memlimit: must be positive, not %d\n", FlagMemLimit)
+	}
+	if INDEX_DISK == FlagIndex {
+		debug.SetMemoryLimit(int64(FlagMemLimit) << 20)
+	}
+
 	if FlagHelp {
-		var err1, err2 error
+		var err1, err2, err3 error
 		_, thisCmd := filepath.Split(os.Args[0])
-		_, err1 = fmt.Fprint(os.Stdout, "\n", "usage for ", thisCmd, ":\n")
+		_, err1 = fmt.Fprint(os.Stdout, "\n", "usage for ", thisCmd, " ",
+			theCommand.name, " ", theCommand.usage, ":\n\t", theCommand.summary, "\n\n")
 		_, err2 = fmt.Fprintf(os.Stdout, "%s\n", nFlags.FlagUsagesWrapped(75))
-		if nil != err1 || nil != err2 {
+		if !explicitCommand {
+			_, err3 = fmt.Fprintf(os.Stdout, "%s\n", commandUsages())
+		}
+		if nil != err1 || nil != err2 || nil != err3 {
 			xLog.Printf("huh? can't write to os.stdout because\n%s",
-				misc.ConcatenateErrors(err1, err2).Error())
+				misc.ConcatenateErrors(err1, err2, err3).Error())
 		}
 		UsageMessage()
 		_, _ = fmt.Fprintf(os.Stdout, "\t please see USAGE.MD for ")
@@ -191,7 +637,8 @@ func UsageMessage() {
 	sb.WriteString("\n\t -3: Internal function failed (see log)")
 	sb.WriteString("\n\t -2: Program interrupt from external signal (see log)")
 	sb.WriteString("\n\t -1: External function failed (see log)")
-	sb.WriteString("\n\t  0: success\n")
+	sb.WriteString("\n\t  0: success")
+	sb.WriteString("\n\t  1: command found a problem (unhealthy endpoint, invalid file, differences)\n")
 	sb.WriteString("/*******************************************/\n")
 	sb.WriteString("Useful Program Information Here\n")
 	xLog.Println(sb.String())
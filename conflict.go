@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Conflict strategies decide which copy of a duplicated station
+// survives. CONFLICT_NEWEST, the default, and the others are
+// deterministic, because stations are held until every page is in
+// and ties are broken by feed rank (see recordSource.before).
+// CONFLICT_FIRST keeps whichever copy arrived first, which depends on
+// network timing; it is only used when asked for, to stream stations
+// without holding them.
+const (
+	CONFLICT_FIRST    = "first"    // first copy to arrive wins, streamed as it arrives
+	CONFLICT_NEWEST   = "newest"   // newest last_updated wins
+	CONFLICT_PRIORITY = "priority" // copy from the highest priority feed wins
+	CONFLICT_MERGE    = "merge"    // newest wins, empty fields filled from the other copies
+)
+
+var conflictStrategies = []string{CONFLICT_FIRST, CONFLICT_NEWEST, CONFLICT_PRIORITY, CONFLICT_MERGE}
+
+// checkConflictStrategy makes sure the strategy is known
+func checkConflictStrategy(strategy string) error {
+	for _, known := range conflictStrategies {
+		if known == strategy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict strategy %s (use one of %s)",
+		strategy, strings.Join(conflictStrategies, ", "))
+}
+
+// recordSource locates a station in the input: the feed's priority
+// (lower wins) and index in the endpoints file, the page within the
+// feed and the position within the page.
+type recordSource struct {
+	priority int
+	feed     int
+	page     int
+	index    int
+}
+
+// before orders sources by feed rank -- priority, then position of
+// the feed in the endpoints file -- then by position within the feed.
+// No two records share a source, so this is a total order.
+func (rs recordSource) before(other recordSource) bool {
+	if rs.priority != other.priority {
+		return rs.priority < other.priority
+	}
+	if rs.feed != other.feed {
+		return rs.feed < other.feed
+	}
+	if rs.page != other.page {
+		return rs.page < other.page
+	}
+	return rs.index < other.index
+}
+
+// resolveConflict returns the station to keep of two copies with the
+// same key, according to the conflict strategy. The result does not
+// depend on which copy arrived first. Under CONFLICT_MERGE or a deep
+// merge both copies are kept, to be merged by mergeCopies once every
+// page is in.
+func resolveConflict(kept *stationRecord, dup *stationRecord) *stationRecord {
+	if FlagDeepMerge || CONFLICT_MERGE == FlagConflict {
+		kept.copies = append(kept.copies, dup)
+		return kept
+	}
+	return preferredStation(kept, dup)
+}
+
+// preferredStation returns whichever copy the conflict strategy
+// prefers: the higher ranked source under CONFLICT_PRIORITY,
+// otherwise the newer.
+func preferredStation(a *stationRecord, b *stationRecord) *stationRecord {
+	if CONFLICT_PRIORITY == FlagConflict {
+		if b.src.before(a.src) {
+			return b
+		}
+		return a
+	}
+	return newerStation(a, b)
+}
+
+// newerStation returns the copy with the later last_updated;
+// on a tie, the copy from the higher ranked source.
+func newerStation(a *stationRecord, b *stationRecord) *stationRecord {
+	if a.LastUpdated.After(b.LastUpdated) {
+		return a
+	}
+	if b.LastUpdated.After(a.LastUpdated) {
+		return b
+	}
+	if b.src.before(a.src) {
+		return b
+	}
+	return a
+}
+
+// mergeCopies merges every copy of a station held for CONFLICT_MERGE
+// or a deep merge. The copies are ordered by preference (newest first,
+// or by feed priority under CONFLICT_PRIORITY, ties by source rank) and
+// each empty field of the first is filled from the first copy that has
+// a value; a deep merge also unions the collections of every copy.
+// Merging pairwise as copies arrive would let arrival order decide
+// which copy fills a gap.
+func mergeCopies(rec *stationRecord) *stationRecord {
+	if len(rec.copies) <= 0 {
+		return rec
+	}
+	all := append([]*stationRecord{rec}, rec.copies...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i] != all[j] && preferredStation(all[i], all[j]) == all[i]
+	})
+	winner := all[0]
+	if FlagDeepMerge {
+		deepMergeCopies(all)
+	} else {
+		for _, other := range all[1:] {
+			mergeEmptyFields(winner, other)
+		}
+	}
+	winner.copies = nil
+	return winner
+}
+
+// mergeEmptyFields fills each empty top-level field of the winner
+// from the loser, including the fields of the embedded location,
+// returning the JSON names of the fields filled.
+func mergeEmptyFields(winner *stationRecord, loser *stationRecord) (filled []string) {
+	w := reflect.ValueOf(winner).Elem()
+	l := reflect.ValueOf(loser).Elem()
+	for ix := 0; ix < w.NumField(); ix++ {
+		if !w.Type().Field(ix).IsExported() {
+			continue
+		}
+		if w.Type().Field(ix).Anonymous {
+			filled = append(filled, mergeEmptyStructFields(w.Field(ix), l.Field(ix))...)
+			continue
+		}
+		if w.Field(ix).IsZero() && !l.Field(ix).IsZero() {
+			w.Field(ix).Set(l.Field(ix))
+			filled = append(filled, jsonFieldName(w.Type().Field(ix)))
+		}
+	}
+	return filled
+}
+
+// mergeEmptyStructFields fills each empty field of w from l,
+// returning the JSON names of the fields filled.
+func mergeEmptyStructFields(w reflect.Value, l reflect.Value) (filled []string) {
+	for ix := 0; ix < w.NumField(); ix++ {
+		if w.Field(ix).IsZero() && !l.Field(ix).IsZero() {
+			w.Field(ix).Set(l.Field(ix))
+			filled = append(filled, jsonFieldName(w.Type().Field(ix)))
+		}
+	}
+	return filled
+}
+
+// jsonFieldName is the name of a struct field in JSON
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if "" == name {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckConflictStrategy(t *testing.T) {
+	for _, strategy := range conflictStrategies {
+		if err := checkConflictStrategy(strategy); nil != err {
+			t.Errorf("checkConflictStrategy(%q): %s", strategy, err.Error())
+		}
+	}
+	if nil == checkConflictStrategy("last") {
+		t.Errorf("checkConflictStrategy(\"last\") accepted an unknown strategy")
+	}
+}
+
+func TestRecordSourceBefore(t *testing.T) {
+	tests := []struct {
+		a, b recordSource
+		want bool
+	}{
+		{recordSource{priority: 1, feed: 5}, recordSource{priority: 2, feed: 0}, true},
+		{recordSource{priority: 2, feed: 0}, recordSource{priority: 1, feed: 5}, false},
+		{recordSource{feed: 1, page: 9}, recordSource{feed: 2, page: 0}, true},
+		{recordSource{feed: 1, page: 1, index: 9}, recordSource{feed: 1, page: 2}, true},
+		{recordSource{feed: 1, page: 1, index: 3}, recordSource{feed: 1, page: 1, index: 4}, true},
+		{recordSource{feed: 1, page: 1, index: 4}, recordSource{feed: 1, page: 1, index: 4}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.before(tt.b); got != tt.want {
+			t.Errorf("%+v.before(%+v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// conflictCopy is a copy of station LOC1 from the given feed
+func conflictCopy(feed int, priority int, updated string, name string) *stationRecord {
+	rec := testStation("US", "CPT", "LOC1")
+	rec.src = recordSource{priority: priority, feed: feed}
+	rec.Name = name
+	if "" != updated {
+		rec.LastUpdated, _ = time.Parse(time.RFC3339, updated)
+	}
+	return rec
+}
+
+// TestResolveConflictOrder checks that every order of arrival keeps the same copy
+func TestResolveConflictOrder(t *testing.T) {
+	FlagDeepMerge = false
+	tests := []struct {
+		strategy string
+		copies   []*stationRecord
+		want     int // index in copies of the copy kept
+	}{
+		{CONFLICT_NEWEST, []*stationRecord{
+			conflictCopy(0, 0, "2024-01-01T00:00:00Z", "old"),
+			conflictCopy(1, 0, "2024-06-01T00:00:00Z", "new"),
+			conflictCopy(2, 0, "2024-03-01T00:00:00Z", "mid")}, 1},
+		{CONFLICT_NEWEST, []*stationRecord{
+			conflictCopy(2, 0, "2024-06-01T00:00:00Z", "feed 2"),
+			conflictCopy(1, 0, "2024-06-01T00:00:00Z", "feed 1"),
+			conflictCopy(3, 0, "2024-06-01T00:00:00Z", "feed 3")}, 1},
+		{CONFLICT_NEWEST, []*stationRecord{
+			conflictCopy(0, 5, "2024-06-01T00:00:00Z", "low priority"),
+			conflictCopy(1, 1, "2024-06-01T00:00:00Z", "high priority")}, 1},
+		{CONFLICT_PRIORITY, []*stationRecord{
+			conflictCopy(0, 2, "2024-06-01T00:00:00Z", "newer"),
+			conflictCopy(1, 1, "2024-01-01T00:00:00Z", "ranked")}, 1},
+		{CONFLICT_PRIORITY, []*stationRecord{
+			conflictCopy(1, 0, "", "feed 1"),
+			conflictCopy(0, 0, "", "feed 0")}, 1},
+	}
+	for tx, tt := range tests {
+		FlagConflict = tt.strategy
+		for _, order := range permutations(len(tt.copies)) {
+			kept := tt.copies[order[0]]
+			for _, ix := range order[1:] {
+				kept = resolveConflict(kept, tt.copies[ix])
+			}
+			if kept != tt.copies[tt.want] {
+				t.Errorf("test %d (%s) arriving in order %v kept %q, want %q",
+					tx, tt.strategy, order, kept.Name, tt.copies[tt.want].Name)
+			}
+		}
+	}
+	FlagConflict = CONFLICT_NEWEST
+}
+
+// TestMergeCopies checks that the gaps of the newest copy are filled
+// from the next preferred copy, whichever order the copies arrived in
+func TestMergeCopies(t *testing.T) {
+	FlagDeepMerge = false
+	FlagConflict = CONFLICT_MERGE
+	defer func() { FlagConflict = CONFLICT_NEWEST }()
+
+	for _, order := range permutations(3) {
+		copies := []*stationRecord{
+			conflictCopy(0, 0, "2024-06-01T00:00:00Z", "newest"),
+			conflictCopy(1, 0, "2024-03-01T00:00:00Z", ""),
+			conflictCopy(2, 0, "2024-01-01T00:00:00Z", ""),
+		}
+		copies[1].City, copies[1].Address = "Springfield", "1 Main St"
+		copies[2].City, copies[2].PostalCode = "Shelbyville", "12345"
+
+		kept := copies[order[0]]
+		for _, ix := range order[1:] {
+			kept = resolveConflict(kept, copies[ix])
+		}
+		got := mergeCopies(kept)
+		if got != copies[0] || "newest" != got.Name {
+			t.Errorf("order %v: kept %q, want the newest copy", order, got.Name)
+		}
+		if "Springfield" != got.City || "1 Main St" != got.Address || "12345" != got.PostalCode {
+			t.Errorf("order %v: merged city %q, address %q, postal code %q",
+				order, got.City, got.Address, got.PostalCode)
+		}
+		if len(got.copies) > 0 {
+			t.Errorf("order %v: %d copies left after merging", order, len(got.copies))
+		}
+	}
+}
+
+func TestMergeEmptyFields(t *testing.T) {
+	winner := testStation("US", "CPT", "LOC1")
+	winner.Name = "Winner"
+	loser := testStation("US", "CPT", "LOC1")
+	loser.Name, loser.City, loser.Region = "Loser", "Springfield", "us-west"
+
+	filled := mergeEmptyFields(winner, loser)
+	if "Winner" != winner.Name {
+		t.Errorf("name = %q, a set field was overwritten", winner.Name)
+	}
+	if "Springfield" != winner.City || "us-west" != winner.Region {
+		t.Errorf("city %q, region %q not filled from the loser", winner.City, winner.Region)
+	}
+	want := map[string]bool{"city": true, "region": true}
+	for _, field := range filled {
+		if !want[field] {
+			t.Errorf("filled %q, want only city and region", field)
+		}
+		delete(want, field)
+	}
+	for field := range want {
+		t.Errorf("%s filled but not listed", field)
+	}
+}
+
+// permutations lists every order of 0..n-1
+func permutations(n int) (orders [][]int) {
+	if n <= 1 {
+		return [][]int{make([]int, n)}
+	}
+	for _, rest := range permutations(n - 1) {
+		for at := 0; at <= len(rest); at++ {
+			order := make([]int, 0, n)
+			order = append(order, rest[:at]...)
+			order = append(order, n-1)
+			order = append(order, rest[at:]...)
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+// The csv output format writes stations.csv, the nested stations
+// flattened to rows at the --csvrows granularity: a row per location,
+// per EVSE or per connector, with the --csvcolumns columns under a
+// header row. A location without EVSEs (or an EVSE without
+// connectors) still makes one row, its finer columns empty. Fields are
+// quoted as RFC 4180 requires, so multi-line text stays in its cell.
+
+// FORMAT_CSV is the CSV output format
+const FORMAT_CSV = "csv"
+
+// CSV row granularities
+const (
+	CSV_ROWS_LOCATION  = "location"
+	CSV_ROWS_EVSE      = "evse"
+	CSV_ROWS_CONNECTOR = "connector"
+)
+
+// csvLevels ranks the granularities, coarsest first
+var csvLevels = map[string]int{CSV_ROWS_LOCATION: 0, CSV_ROWS_EVSE: 1, CSV_ROWS_CONNECTOR: 2}
+
+// CSV_LIST_SEPARATOR joins the values of a list in one cell
+const CSV_LIST_SEPARATOR = ";"
+
+// csvRow is what one row is made of; evse and conn are nil at the
+// coarser granularities, and where there is none
+type csvRow struct {
+	rec  *stationRecord
+	evse *denjson.Evses
+	conn *denjson.Connector
+}
+
+// evses are the EVSEs a row covers: the row's own, or the location's
+func (row *csvRow) evses() []denjson.Evses {
+	if nil != row.evse {
+		return []denjson.Evses{*row.evse}
+	}
+	return row.rec.Evses
+}
+
+// csvColumn is a named column, needing rows at least as fine as level
+type csvColumn struct {
+	name  string
+	level int
+	value func(row *csvRow) string
+}
+
+var csvColumns = []csvColumn{
+	{"key", 0, func(row *csvRow) string { return dedupeKey(row.rec) }},
+	{"id", 0, func(row *csvRow) string { return row.rec.ID }},
+	{"country_code", 0, func(row *csvRow) string { return row.rec.CountryCode }},
+	{"party_id", 0, func(row *csvRow) string { return row.rec.PartyID }},
+	{"name", 0, func(row *csvRow) string { return row.rec.Name }},
+	{"address", 0, func(row *csvRow) string { return row.rec.Address }},
+	{"city", 0, func(row *csvRow) string { return row.rec.City }},
+	{"postal_code", 0, func(row *csvRow) string { return row.rec.PostalCode }},
+	{"country", 0, func(row *csvRow) string { return row.rec.Country }},
+	{"latitude", 0, func(row *csvRow) string { return row.rec.Coordinates.Latitude }},
+	{"longitude", 0, func(row *csvRow) string { return row.rec.Coordinates.Longitude }},
+	{"operator", 0, func(row *csvRow) string { return row.rec.Operator.Name }},
+	{"time_zone", 0, func(row *csvRow) string { return row.rec.TimeZone }},
+	{"directions", 0, func(row *csvRow) string {
+		texts := make([]string, 0, len(row.rec.Directions))
+		for _, dt := range row.rec.Directions {
+			texts = append(texts, dt.Text)
+		}
+		return strings.Join(texts, "\n")
+	}},
+	{"region", 0, func(row *csvRow) string { return row.rec.Region }},
+	{"feed", 0, func(row *csvRow) string { return feedLabel(row.rec) }},
+	{"last_updated", 0, func(row *csvRow) string { return csvTime(row.rec.LastUpdated) }},
+	{"evse_count", 0, func(row *csvRow) string { return strconv.Itoa(len(row.evses())) }},
+	{"connector_types", 0, func(row *csvRow) string {
+		return strings.Join(connectorStandards(row.evses()), CSV_LIST_SEPARATOR)
+	}},
+	{"max_power", 0, func(row *csvRow) string { return csvPower(maxEvsePower(row.evses())) }},
+
+	{"evse_uid", 1, func(row *csvRow) string { return evseField(row, func(e *denjson.Evses) string { return e.UID }) }},
+	{"evse_id", 1, func(row *csvRow) string { return evseField(row, func(e *denjson.Evses) string { return e.EvseID }) }},
+	{"evse_status", 1, func(row *csvRow) string { return evseField(row, func(e *denjson.Evses) string { return e.Status }) }},
+	{"evse_latitude", 1, func(row *csvRow) string {
+		return evseField(row, func(e *denjson.Evses) string { return e.Coordinates.Latitude })
+	}},
+	{"evse_longitude", 1, func(row *csvRow) string {
+		return evseField(row, func(e *denjson.Evses) string { return e.Coordinates.Longitude })
+	}},
+	{"capabilities", 1, func(row *csvRow) string {
+		return evseField(row, func(e *denjson.Evses) string { return strings.Join(e.Capabilities, CSV_LIST_SEPARATOR) })
+	}},
+	{"connector_count", 1, func(row *csvRow) string {
+		return evseField(row, func(e *denjson.Evses) string { return strconv.Itoa(len(e.Connectors)) })
+	}},
+
+	{"connector_id", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return c.ID })
+	}},
+	{"standard", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return c.Standard })
+	}},
+	{"format", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return c.Format })
+	}},
+	{"power_type", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return c.PowerType })
+	}},
+	{"voltage", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return csvInt(c.Voltage) })
+	}},
+	{"amperage", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return csvInt(c.Amperage) })
+	}},
+	{"power", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return csvPower(connectorPower(c)) })
+	}},
+	{"tariff_id", 2, func(row *csvRow) string {
+		return connectorField(row, func(c *denjson.Connector) string { return c.TariffID })
+	}},
+}
+
+// csvDefaultColumns are the columns of each granularity if none are given
+var csvDefaultColumns = map[string][]string{
+	CSV_ROWS_LOCATION: {"key", "name", "address", "city", "postal_code", "country", "latitude", "longitude",
+		"operator", "evse_count", "connector_types", "max_power", "feed"},
+	CSV_ROWS_EVSE: {"key", "name", "address", "city", "postal_code", "country", "latitude", "longitude",
+		"operator", "evse_uid", "evse_id", "evse_status", "connector_types", "max_power", "feed"},
+	CSV_ROWS_CONNECTOR: {"key", "name", "address", "city", "postal_code", "country", "latitude", "longitude",
+		"operator", "evse_uid", "evse_id", "evse_status", "connector_id", "standard", "format", "power_type",
+		"power", "feed"},
+}
+
+func evseField(row *csvRow, field func(e *denjson.Evses) string) string {
+	if nil == row.evse {
+		return ""
+	}
+	return field(row.evse)
+}
+
+func connectorField(row *csvRow, field func(c *denjson.Connector) string) string {
+	if nil == row.conn {
+		return ""
+	}
+	return field(row.conn)
+}
+
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func csvInt(v int) string {
+	if 0 == v {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+func csvPower(w float64) string {
+	if w <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(w, 'f', -1, 64)
+}
+
+// theCsvColumns are the columns selected, set by checkCsvFlags
+var theCsvColumns []csvColumn
+
+// checkCsvFlags checks the granularity and selects the columns, each
+// of which must be available at the granularity
+func checkCsvFlags() error {
+	level, ok := csvLevels[FlagCsvRows]
+	if !ok {
+		return fmt.Errorf("unknown --csvrows %s (use %s, %s or %s)",
+			FlagCsvRows, CSV_ROWS_LOCATION, CSV_ROWS_EVSE, CSV_ROWS_CONNECTOR)
+	}
+	names := FlagCsvColumns
+	if len(names) <= 0 {
+		names = csvDefaultColumns[FlagCsvRows]
+	}
+	theCsvColumns = nil
+	for _, name := range names {
+		found := false
+		for _, column := range csvColumns {
+			if column.name != name {
+				continue
+			}
+			if column.level > level {
+				return fmt.Errorf("column %s needs finer rows than --csvrows %s", name, FlagCsvRows)
+			}
+			theCsvColumns = append(theCsvColumns, column)
+			found = true
+		}
+		if !found {
+			known := make([]string, 0, len(csvColumns))
+			for _, column := range csvColumns {
+				known = append(known, column.name)
+			}
+			return fmt.Errorf("unknown column %s (use %s)", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// csvWriter streams the rows of stations
+type csvWriter struct {
+	fn    string
+	out   chan []byte
+	count int
+	rows  int
+}
+
+func startCsvWriter(fn string, out chan []byte) *csvWriter {
+	cw := &csvWriter{fn: fn, out: out}
+	header := make([]string, 0, len(theCsvColumns))
+	for _, column := range theCsvColumns {
+		header = append(header, column.name)
+	}
+	cw.send([][]string{header})
+	return cw
+}
+
+// send writes records, encoded and quoted by encoding/csv
+func (cw *csvWriter) send(records [][]string) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err := w.WriteAll(records)
+	if nil != err {
+		xLog.Printf("error writing CSV: %s", err.Error())
+		return
+	}
+	cw.out <- buf.Bytes()
+}
+
+// write adds the rows of a station
+func (cw *csvWriter) write(rec *stationRecord, _ []byte) {
+	var rows []csvRow
+	switch FlagCsvRows {
+	case CSV_ROWS_LOCATION:
+		rows = append(rows, csvRow{rec: rec})
+	default:
+		for ix := range rec.Evses {
+			evse := &rec.Evses[ix]
+			if CSV_ROWS_CONNECTOR != FlagCsvRows || len(evse.Connectors) <= 0 {
+				rows = append(rows, csvRow{rec: rec, evse: evse})
+				continue
+			}
+			for jx := range evse.Connectors {
+				rows = append(rows, csvRow{rec: rec, evse: evse, conn: &evse.Connectors[jx]})
+			}
+		}
+		if len(rows) <= 0 {
+			rows = append(rows, csvRow{rec: rec})
+		}
+	}
+
+	records := make([][]string, 0, len(rows))
+	for ix := range rows {
+		record := make([]string, 0, len(theCsvColumns))
+		for _, column := range theCsvColumns {
+			record = append(record, column.value(&rows[ix]))
+		}
+		records = append(records, record)
+	}
+	cw.send(records)
+	cw.count++
+	cw.rows += len(records)
+}
+
+func (cw *csvWriter) close() {
+	close(cw.out)
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("%s: %d rows of %d stations", cw.fn, cw.rows, cw.count)
+	}
+}
+
+func (cw *csvWriter) written() int {
+	return cw.count
+}
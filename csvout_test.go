@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+	"github.com/shopspring/decimal"
+)
+
+func TestCheckCsvFlags(t *testing.T) {
+	defer func() { FlagCsvRows, FlagCsvColumns, theCsvColumns = CSV_ROWS_LOCATION, nil, nil }()
+	tests := []struct {
+		rows    string
+		columns []string
+		want    int    // columns selected
+		wantErr string // part of the error
+	}{
+		{CSV_ROWS_LOCATION, nil, len(csvDefaultColumns[CSV_ROWS_LOCATION]), ""},
+		{CSV_ROWS_CONNECTOR, nil, len(csvDefaultColumns[CSV_ROWS_CONNECTOR]), ""},
+		{CSV_ROWS_EVSE, []string{"key", "evse_uid"}, 2, ""},
+		{CSV_ROWS_LOCATION, []string{"key", "evse_uid"}, 0, "needs finer rows"},
+		{CSV_ROWS_EVSE, []string{"standard"}, 0, "needs finer rows"},
+		{CSV_ROWS_CONNECTOR, []string{"colour"}, 0, "unknown column colour"},
+		{"station", nil, 0, "unknown --csvrows"},
+	}
+	for _, tt := range tests {
+		FlagCsvRows, FlagCsvColumns = tt.rows, tt.columns
+		err := checkCsvFlags()
+		if "" != tt.wantErr {
+			if nil == err || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkCsvFlags(%s, %q): error %v, want %q", tt.rows, tt.columns, err, tt.wantErr)
+			}
+			continue
+		}
+		if nil != err || len(theCsvColumns) != tt.want {
+			t.Errorf("checkCsvFlags(%s, %q): %d columns, error %v", tt.rows, tt.columns, len(theCsvColumns), err)
+		}
+	}
+}
+
+func TestCsvWriterRows(t *testing.T) {
+	defer func() { FlagCsvRows, FlagCsvColumns, theCsvColumns = CSV_ROWS_LOCATION, nil, nil }()
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+
+	rec := testStation("US", "CPT", "LOC1")
+	rec.Name = "Depot, \"North\"\nentrance"
+	rec.Evses = []denjson.Evses{
+		{UID: "1", Connectors: []denjson.Connector{
+			{ID: "1", Standard: "IEC_62196_T1", Voltage: 240, Amperage: 32},
+			{ID: "2", Standard: "CHADEMO", MaxElectricPower: decimal.NewFromInt(50000)}}},
+		{UID: "2"},
+	}
+	bare := testStation("US", "CPT", "LOC2")
+
+	tests := []struct {
+		rows    string
+		columns []string
+		want    [][]string
+	}{
+		{CSV_ROWS_LOCATION, []string{"key", "name", "evse_count", "connector_types", "max_power"}, [][]string{
+			{"key", "name", "evse_count", "connector_types", "max_power"},
+			{"US/CPT/LOC1", rec.Name, "2", "CHADEMO;IEC_62196_T1", "50000"},
+			{"US/CPT/LOC2", "", "0", "", ""}}},
+		{CSV_ROWS_EVSE, []string{"id", "evse_uid", "connector_count", "max_power"}, [][]string{
+			{"id", "evse_uid", "connector_count", "max_power"},
+			{"LOC1", "1", "2", "50000"},
+			{"LOC1", "2", "0", ""},
+			{"LOC2", "", "", ""}}},
+		{CSV_ROWS_CONNECTOR, []string{"id", "evse_uid", "connector_id", "voltage", "power"}, [][]string{
+			{"id", "evse_uid", "connector_id", "voltage", "power"},
+			{"LOC1", "1", "1", "240", "7680"},
+			{"LOC1", "1", "2", "", "50000"},
+			{"LOC1", "2", "", "", ""},
+			{"LOC2", "", "", "", ""}}},
+	}
+	for _, tt := range tests {
+		FlagCsvRows, FlagCsvColumns = tt.rows, tt.columns
+		if err := checkCsvFlags(); nil != err {
+			t.Fatal(err)
+		}
+		var cw *csvWriter
+		txt := writeAll(func(out chan []byte) recordWriter {
+			cw = startCsvWriter("stations.csv", out)
+			return cw
+		}, rec, bare)
+
+		got, err := csv.NewReader(bytes.NewReader(txt)).ReadAll()
+		if nil != err {
+			t.Errorf("rows %s: %s in\n%s", tt.rows, err.Error(), txt)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rows %s: got %q\nwant %q", tt.rows, got, tt.want)
+		}
+		if 2 != cw.written() || len(tt.want)-1 != cw.rows {
+			t.Errorf("rows %s: %d stations in %d rows", tt.rows, cw.written(), cw.rows)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const DEDUPE_SHARDS = 64
+
+// Kinds of dedupe index
+const (
+	INDEX_MEMORY = "memory" // sharded maps
+	INDEX_DISK   = "disk"   // external sort, in bounded memory
+)
+
+// stationIndex is the set of stations seen so far, finding duplicate
+// keys and ID collisions. add is safe for concurrent use; the other
+// methods are meant for use once every station has been added, and
+// resolve must be called before them.
+type stationIndex interface {
+	// add adds a station, returning true if it is to be written now
+	add(loc *stationRecord) bool
+	// resolve settles which copy of each duplicated key is kept
+	resolve() error
+	// stations calls write with every station kept not yet written
+	stations(write func(rec *stationRecord)) error
+	// duplicateKeys is the set of keys seen more than once
+	duplicateKeys() map[string]struct{}
+	// duplicateCopies maps each duplicated key to its copies as they
+	// arrived, when FlagDupReport is set
+	duplicateCopies() map[string][]*stationRecord
+	// idCollisions maps each bare ID seen under more than one key to its keys
+	idCollisions() map[string]map[string]struct{}
+}
+
+// checkIndexKind makes sure the kind of index is known
+func checkIndexKind(kind string) error {
+	if INDEX_MEMORY != kind && INDEX_DISK != kind {
+		return fmt.Errorf("unknown dedupe index %s (use %s or %s)", kind, INDEX_MEMORY, INDEX_DISK)
+	}
+	return nil
+}
+
+// newStationIndex makes the index selected by FlagIndex
+func newStationIndex() (stationIndex, error) {
+	if INDEX_DISK == FlagIndex {
+		return newDiskIndex(FlagIndexDir, FlagMemLimit<<20/2)
+	}
+	return newMemoryIndex(DEDUPE_SHARDS), nil
+}
+
+// memoryIndex is a stationIndex held in memory, safe for concurrent
+// use. The key space is split into shards, each with its own lock, so
+// workers deduping different keys rarely wait on one another. Bare IDs
+// are sharded separately, to find ID collisions across keys.
+type memoryIndex struct {
+	shards   []*dedupeShard
+	idShards []*idShard
+}
+
+// dedupeShard holds the keys that hash to it
+type dedupeShard struct {
+	lock sync.Mutex
+	// stations maps each key to the station kept for it; under
+	// CONFLICT_FIRST the station has already been written and only
+	// the key matters, so no station is held (unless it is needed
+	// for the duplicates report).
+	stations map[string]*stationRecord
+	dups     map[string]struct{}
+	// dupCopies holds every copy of each duplicated key for the report
+	dupCopies map[string][]*stationRecord
+}
+
+// idShard holds the bare station IDs that hash to it. ids maps each
+// bare ID to the first key seen with it; collisions holds every key
+// of a bare ID seen under more than one key.
+type idShard struct {
+	lock       sync.Mutex
+	ids        map[string]string
+	collisions map[string]map[string]struct{}
+}
+
+// newMemoryIndex makes an empty index of n shards
+func newMemoryIndex(n int) (idx *memoryIndex) {
+	idx = &memoryIndex{
+		shards:   make([]*dedupeShard, n),
+		idShards: make([]*idShard, n),
+	}
+	for ix := 0; ix < n; ix++ {
+		idx.shards[ix] = &dedupeShard{
+			stations:  make(map[string]*stationRecord, 16384/n),
+			dups:      make(map[string]struct{}, 8),
+			dupCopies: make(map[string][]*stationRecord, 8),
+		}
+		idx.idShards[ix] = &idShard{
+			ids:        make(map[string]string, 16384/n),
+			collisions: make(map[string]map[string]struct{}, 8),
+		}
+	}
+	return idx
+}
+
+// shardOf picks the shard of a key
+func shardOf(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// add checks if a station is already present in the index, filtering
+// out duplicates. It adds new station keys to the index and records
+// repeated keys as duplicates, resolving which copy to keep by the
+// conflict strategy. A new key whose bare ID was already seen is kept,
+// but recorded as an ID collision. A new key is written at once under
+// CONFLICT_FIRST, returning true; otherwise it is held until resolved.
+func (idx *memoryIndex) add(loc *stationRecord) bool {
+	key := dedupeKey(loc)
+	shard := idx.shards[shardOf(key, len(idx.shards))]
+
+	shard.lock.Lock()
+	kept, ok := shard.stations[key]
+	if ok {
+		shard.dups[key] = struct{}{}
+		if FlagDupReport {
+			list, ok := shard.dupCopies[key]
+			if !ok {
+				list = []*stationRecord{kept}
+			}
+			shard.dupCopies[key] = append(list, loc)
+		}
+		if CONFLICT_FIRST != FlagConflict {
+			shard.stations[key] = resolveConflict(kept, loc)
+		}
+		shard.lock.Unlock()
+		return false
+	}
+	if CONFLICT_FIRST == FlagConflict && !FlagDupReport {
+		shard.stations[key] = nil
+	} else {
+		shard.stations[key] = loc
+	}
+	shard.lock.Unlock()
+
+	ids := idx.idShards[shardOf(loc.ID, len(idx.idShards))]
+	ids.lock.Lock()
+	firstKey, seen := ids.ids[loc.ID]
+	if !seen {
+		ids.ids[loc.ID] = key
+	} else {
+		keys, ok := ids.collisions[loc.ID]
+		if !ok {
+			keys = map[string]struct{}{firstKey: {}}
+			ids.collisions[loc.ID] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	ids.lock.Unlock()
+	return CONFLICT_FIRST == FlagConflict
+}
+
+// The methods below gather results across the shards.
+
+// resolve has nothing to do: conflicts are resolved as stations are
+// added, and copies held for merging are merged by sortedStations.
+func (idx *memoryIndex) resolve() error { return nil }
+
+// stations writes the stations held for conflict resolution, in
+// source order; under CONFLICT_FIRST every station is already written.
+func (idx *memoryIndex) stations(write func(rec *stationRecord)) error {
+	if CONFLICT_FIRST == FlagConflict {
+		return nil
+	}
+	for _, rec := range idx.sortedStations() {
+		write(rec)
+	}
+	return nil
+}
+
+// sortedStations lists the kept stations, with their copies merged,
+// in source order, so the output does not depend on the order pages
+// arrived in.
+func (idx *memoryIndex) sortedStations() []*stationRecord {
+	var list []*stationRecord
+	for _, shard := range idx.shards {
+		for _, rec := range shard.stations {
+			list = append(list, mergeCopies(rec))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].src.before(list[j].src) })
+	return list
+}
+
+func (idx *memoryIndex) duplicateKeys() map[string]struct{} {
+	keys := make(map[string]struct{}, 8)
+	for _, shard := range idx.shards {
+		for key := range shard.dups {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
+
+func (idx *memoryIndex) duplicateCopies() map[string][]*stationRecord {
+	copies := make(map[string][]*stationRecord, 8)
+	for _, shard := range idx.shards {
+		for key, list := range shard.dupCopies {
+			copies[key] = list
+		}
+	}
+	return copies
+}
+
+func (idx *memoryIndex) idCollisions() map[string]map[string]struct{} {
+	collisions := make(map[string]map[string]struct{}, 8)
+	for _, ids := range idx.idShards {
+		for id, keys := range ids.collisions {
+			collisions[id] = keys
+		}
+	}
+	return collisions
+}
+
+// printDuplicateStats logs the keys of duplicated stations, then the
+// IDs that collide: the same bare ID under different keys (e.g. two
+// parties), which are kept as distinct stations.
+func printDuplicateStats(idx stationIndex) {
+	dups := idx.duplicateKeys()
+	xLog.Printf("duplicate station count: %d (key %s)\n\tduplicates:",
+		len(dups), strings.Join(FlagDedupeKey, "/"))
+	printKeys(dups)
+
+	collisions := idx.idCollisions()
+	xLog.Printf("id collision count: %d\n\tcollisions:", len(collisions))
+	for id, keys := range collisions {
+		xLog.Printf(" %s:", id)
+		printKeys(keys)
+	}
+}
+
+// printKeys logs a set of keys five per line
+func printKeys(keys map[string]struct{}) {
+	var sb strings.Builder
+	ix := 0
+	for k := range keys {
+		ix++
+		if 0 == ix%5 {
+			xLog.Printf("%s", sb.String())
+			sb.Reset()
+			sb.WriteRune(' ')
+		}
+		sb.WriteString(k)
+		sb.WriteRune(' ')
+	}
+	xLog.Printf("%s", sb.String())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardOf(t *testing.T) {
+	counts := make([]int, DEDUPE_SHARDS)
+	for ix := 0; ix < 10000; ix++ {
+		key := fmt.Sprintf("US/CPT/LOC%d", ix)
+		shard := shardOf(key, DEDUPE_SHARDS)
+		if shard < 0 || shard >= DEDUPE_SHARDS {
+			t.Fatalf("shardOf(%q) = %d, out of range", key, shard)
+		}
+		if shard != shardOf(key, DEDUPE_SHARDS) {
+			t.Fatalf("shardOf(%q) is not stable", key)
+		}
+		counts[shard]++
+	}
+	for shard, n := range counts {
+		if n < 10000/DEDUPE_SHARDS/2 {
+			t.Errorf("shard %d has %d of 10000 keys", shard, n)
+		}
+	}
+}
+
+// indexStations makes copies of n stations from each of feeds feeds,
+// the copy in the last feed updated most recently
+func indexStations(n int, feeds int) (list []*stationRecord) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for feed := 0; feed < feeds; feed++ {
+		for ix := 0; ix < n; ix++ {
+			rec := testStation("US", "CPT", fmt.Sprintf("LOC%d", ix))
+			rec.src = recordSource{feed: feed, index: ix}
+			rec.Name = fmt.Sprintf("feed %d", feed)
+			rec.LastUpdated = base.AddDate(0, 0, feed)
+			list = append(list, rec)
+		}
+	}
+	return list
+}
+
+// addConcurrently adds the stations to the index on workers goroutines
+func addConcurrently(idx stationIndex, list []*stationRecord, workers int) (streamed int) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	next := make(chan *stationRecord)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range next {
+				if idx.add(rec) {
+					lock.Lock()
+					streamed++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, rec := range list {
+		next <- rec
+	}
+	close(next)
+	wg.Wait()
+	return streamed
+}
+
+func TestMemoryIndexOrder(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagConflict, FlagDeepMerge, FlagDupReport = CONFLICT_NEWEST, false, false
+
+	var want []string
+	for run := 0; run < 5; run++ {
+		list := indexStations(200, 3)
+		rand.New(rand.NewSource(int64(run))).Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+
+		idx := newMemoryIndex(8)
+		if streamed := addConcurrently(idx, list, 4); 0 != streamed {
+			t.Errorf("run %d: %d stations streamed under %s", run, streamed, FlagConflict)
+		}
+		if n := len(idx.duplicateKeys()); 200 != n {
+			t.Errorf("run %d: %d duplicate keys, want 200", run, n)
+		}
+		var got []string
+		_ = idx.stations(func(rec *stationRecord) { got = append(got, dedupeKey(rec)+" "+rec.Name) })
+		if nil == want {
+			want = got
+			for ix, line := range got {
+				if line != fmt.Sprintf("US/CPT/LOC%d feed 2", ix) {
+					t.Fatalf("station %d is %q, want the newest copy in source order", ix, line)
+				}
+			}
+			continue
+		}
+		if len(got) != len(want) {
+			t.Fatalf("run %d: %d stations, want %d", run, len(got), len(want))
+		}
+		for ix := range got {
+			if got[ix] != want[ix] {
+				t.Fatalf("run %d: station %d is %q, first run had %q", run, ix, got[ix], want[ix])
+			}
+		}
+	}
+}
+
+func TestMemoryIndexFirst(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagConflict, FlagDeepMerge, FlagDupReport = CONFLICT_FIRST, false, false
+	defer func() { FlagConflict = CONFLICT_NEWEST }()
+
+	idx := newMemoryIndex(4)
+	if streamed := addConcurrently(idx, indexStations(50, 2), 4); 50 != streamed {
+		t.Errorf("%d stations streamed, want one per key", streamed)
+	}
+	held := 0
+	_ = idx.stations(func(*stationRecord) { held++ })
+	if 0 != held {
+		t.Errorf("%d stations held under %s", held, CONFLICT_FIRST)
+	}
+}
+
+func TestMemoryIndexCollisions(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagConflict, FlagDeepMerge, FlagDupReport = CONFLICT_NEWEST, false, true
+	defer func() { FlagDupReport = false }()
+
+	idx := newMemoryIndex(4)
+	for _, rec := range []*stationRecord{
+		testStation("US", "CPT", "LOC1"),
+		testStation("CA", "FLO", "LOC1"),
+		testStation("US", "CPT", "LOC1"),
+		testStation("US", "CPT", "LOC2"),
+	} {
+		idx.add(rec)
+	}
+	collisions := idx.idCollisions()
+	if 1 != len(collisions) || 2 != len(collisions["LOC1"]) {
+		t.Errorf("collisions = %v, want LOC1 under two keys", collisions)
+	}
+	if _, ok := collisions["LOC1"]["CA/FLO/LOC1"]; !ok {
+		t.Errorf("collisions = %v, want CA/FLO/LOC1 among them", collisions)
+	}
+	copies := idx.duplicateCopies()
+	if 1 != len(copies) || 2 != len(copies["US/CPT/LOC1"]) {
+		t.Errorf("duplicate copies = %v, want two of US/CPT/LOC1", copies)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+// A deep merge combines every copy of a duplicated location instead of
+// keeping one: EVSEs are unioned by evse_id (by uid when either copy
+// lacks an evse_id), connectors within an EVSE by id (by standard,
+// format and power when either lacks an id), images by URL,
+// facilities by value, and regular and exceptional opening times by
+// period. Scalar conflicts go to the copy preferred by the conflict
+// strategy, whose empty fields are filled from the other copies.
+//
+// The merged location records where its pieces came from in
+// "provenance": "location" names the feed of the preferred copy, and
+// every piece contributed by another copy is listed with its feed.
+// Pieces not listed came from the preferred copy.
+//
+//	"provenance": {
+//	  "location": "NA/0",
+//	  "evses[US*CPT*X20]": "CA/1",
+//	  "evses[US*CPT*E20].connectors[2]": "CA/1",
+//	  "facilities[PARKING_LOT]": "CA/1",
+//	  "time_zone": "CA/1"
+//	}
+
+// feedLabel names the feed a station came from: region/feed index
+func feedLabel(rec *stationRecord) string {
+	return fmt.Sprintf("%s/%d", rec.Region, rec.src.feed)
+}
+
+// deepMergeCopies merges all copies into the first, in order
+func deepMergeCopies(all []*stationRecord) {
+	winner := all[0]
+	winner.Provenance = map[string]string{"location": feedLabel(winner)}
+	for _, other := range all[1:] {
+		deepMerge(winner, other)
+	}
+}
+
+// deepMerge merges one more copy into the winner
+func deepMerge(w *stationRecord, o *stationRecord) {
+	label := feedLabel(o)
+
+	for ix := range o.Evses {
+		evse := &o.Evses[ix]
+		wx := findEvse(w.Evses, evse)
+		if wx < 0 {
+			w.Evses = append(w.Evses, *evse)
+			w.Provenance["evses["+evseKey(evse)+"]"] = label
+			continue
+		}
+		we := &w.Evses[wx]
+		path := "evses[" + evseKey(we) + "]"
+		matched := make([]bool, len(we.Connectors))
+		for jx := range evse.Connectors {
+			conn := &evse.Connectors[jx]
+			if cx := findConnector(we.Connectors, conn, matched); cx >= 0 {
+				matched[cx] = true
+				continue
+			}
+			we.Connectors = append(we.Connectors, *conn)
+			w.Provenance[path+".connectors["+connectorKey(conn)+"]"] = label
+		}
+		for _, url := range mergeImages(&we.Images, evse.Images) {
+			w.Provenance[path+".images["+url+"]"] = label
+		}
+		for _, field := range mergeEmptyStructFields(reflect.ValueOf(we).Elem(), reflect.ValueOf(evse).Elem()) {
+			w.Provenance[path+"."+field] = label
+		}
+	}
+
+	for _, url := range mergeImages(&w.Images, o.Images) {
+		w.Provenance["images["+url+"]"] = label
+	}
+
+	for _, facility := range o.Facilities {
+		if !containsString(w.Facilities, facility) {
+			w.Facilities = append(w.Facilities, facility)
+			w.Provenance["facilities["+facility+"]"] = label
+		}
+	}
+
+	for _, period := range mergeHours(&w.OpeningTimes, &o.OpeningTimes) {
+		w.Provenance["opening_times."+period] = label
+	}
+
+	for _, field := range mergeEmptyFields(w, o) {
+		w.Provenance[field] = label
+	}
+}
+
+// evseKey identifies an EVSE: its evse_id, or its uid without one
+func evseKey(evse *denjson.Evses) string {
+	if "" != evse.EvseID {
+		return evse.EvseID
+	}
+	return evse.UID
+}
+
+// findEvse returns the index of the EVSE in the list matching evse by
+// evse_id, or by uid when either lacks an evse_id; -1 if none does.
+func findEvse(list []denjson.Evses, evse *denjson.Evses) int {
+	for ix := range list {
+		if "" != list[ix].EvseID && "" != evse.EvseID {
+			if list[ix].EvseID == evse.EvseID {
+				return ix
+			}
+		} else if "" != evse.UID && list[ix].UID == evse.UID {
+			return ix
+		}
+	}
+	return -1
+}
+
+// findConnector returns the index of the connector in the list matching
+// conn; -1 if none does. Connectors match by id when both have one,
+// otherwise by what they are -- standard, format, power type and
+// ratings -- each connector of the list matching only once, so that
+// connectors without ids are neither all taken for one nor dropped.
+func findConnector(list []denjson.Connector, conn *denjson.Connector, matched []bool) int {
+	for ix := range list {
+		if "" != list[ix].ID && "" != conn.ID {
+			if list[ix].ID == conn.ID {
+				return ix
+			}
+		} else if !matched[ix] && sameConnectorKind(&list[ix], conn) {
+			return ix
+		}
+	}
+	return -1
+}
+
+// sameConnectorKind reports whether two connectors are of the same
+// standard, format, power type and ratings
+func sameConnectorKind(a *denjson.Connector, b *denjson.Connector) bool {
+	return a.Standard == b.Standard && a.Format == b.Format && a.PowerType == b.PowerType &&
+		a.Voltage == b.Voltage && a.Amperage == b.Amperage && a.MaxElectricPower.Equal(b.MaxElectricPower) &&
+		a.MaxPower.Equal(b.MaxPower)
+}
+
+// connectorKey names a connector in the provenance: its id, or without
+// one its standard and format
+func connectorKey(conn *denjson.Connector) string {
+	if "" != conn.ID {
+		return conn.ID
+	}
+	return conn.Standard + "/" + conn.Format
+}
+
+// mergeImages adds the images not already in the list, by URL,
+// returning the URLs of the images added.
+func mergeImages(list *[]denjson.Image, more []denjson.Image) (added []string) {
+	for _, img := range more {
+		found := false
+		for ix := range *list {
+			if (*list)[ix].Url == img.Url {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*list = append(*list, img)
+			added = append(added, img.Url)
+		}
+	}
+	return added
+}
+
+// mergeHours merges opening times, returning a description of each
+// period added. Opening times that are "twentyfourseven" on either side
+// are not merged with regular hours; the winner's choice stands, unless
+// it has no opening times at all.
+func mergeHours(w *denjson.Hours, o *denjson.Hours) (added []string) {
+	if reflect.ValueOf(*o).IsZero() {
+		return nil
+	}
+	if reflect.ValueOf(*w).IsZero() {
+		*w = *o
+		return []string{"*"}
+	}
+	if !w.Twentyfourseven && !o.Twentyfourseven {
+		for _, rh := range o.RegularHours {
+			if !containsRegularHours(w.RegularHours, rh) {
+				w.RegularHours = append(w.RegularHours, rh)
+				added = append(added, fmt.Sprintf("regular_hours[%d %s-%s]", rh.Weekday, rh.PeriodBegin, rh.PeriodEnd))
+			}
+		}
+	}
+	for _, ep := range o.ExceptionalOpenings {
+		if !containsPeriod(w.ExceptionalOpenings, ep) {
+			w.ExceptionalOpenings = append(w.ExceptionalOpenings, ep)
+			added = append(added, fmt.Sprintf("exceptional_openings[%s/%s]", ep.PeriodBegin, ep.PeriodEnd))
+		}
+	}
+	for _, ep := range o.ExceptionalClosings {
+		if !containsPeriod(w.ExceptionalClosings, ep) {
+			w.ExceptionalClosings = append(w.ExceptionalClosings, ep)
+			added = append(added, fmt.Sprintf("exceptional_closings[%s/%s]", ep.PeriodBegin, ep.PeriodEnd))
+		}
+	}
+	return added
+}
+
+func containsRegularHours(list []denjson.RegularHours, rh denjson.RegularHours) bool {
+	for _, item := range list {
+		if item == rh {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPeriod(list []denjson.ExceptionalPeriod, ep denjson.ExceptionalPeriod) bool {
+	for _, item := range list {
+		if item == ep {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+func TestFindEvse(t *testing.T) {
+	list := []denjson.Evses{
+		{UID: "1", EvseID: "US*CPT*E1"},
+		{UID: "2"},
+	}
+	tests := []struct {
+		evse denjson.Evses
+		want int
+	}{
+		{denjson.Evses{UID: "9", EvseID: "US*CPT*E1"}, 0},
+		{denjson.Evses{UID: "1", EvseID: "US*CPT*E9"}, -1}, // evse_ids differ, uid not consulted
+		{denjson.Evses{UID: "1"}, 0},
+		{denjson.Evses{UID: "2", EvseID: "US*CPT*E2"}, 1},
+		{denjson.Evses{UID: "3"}, -1},
+		{denjson.Evses{}, -1},
+	}
+	for _, tt := range tests {
+		if got := findEvse(list, &tt.evse); got != tt.want {
+			t.Errorf("findEvse(uid %q, evse_id %q) = %d, want %d", tt.evse.UID, tt.evse.EvseID, got, tt.want)
+		}
+	}
+}
+
+func TestDeepMergeConnectors(t *testing.T) {
+	ccs := denjson.Connector{Standard: "IEC_62196_T1_COMBO", Format: "CABLE", PowerType: "DC", Amperage: 200, Voltage: 500}
+	j1772 := denjson.Connector{Standard: "IEC_62196_T1", Format: "SOCKET", PowerType: "AC_1_PHASE", Amperage: 32, Voltage: 240}
+	withID := func(c denjson.Connector, id string) denjson.Connector {
+		c.ID = id
+		return c
+	}
+	tests := []struct {
+		name  string
+		win   []denjson.Connector
+		other []denjson.Connector
+		want  int // connectors after the merge
+	}{
+		{"same ids", []denjson.Connector{withID(ccs, "1")}, []denjson.Connector{withID(ccs, "1")}, 1},
+		{"new id", []denjson.Connector{withID(ccs, "1")}, []denjson.Connector{withID(j1772, "2")}, 2},
+		{"no ids, same kind", []denjson.Connector{ccs}, []denjson.Connector{ccs}, 1},
+		{"no ids, other kind", []denjson.Connector{ccs}, []denjson.Connector{j1772}, 2},
+		{"no ids, two of a kind", []denjson.Connector{ccs}, []denjson.Connector{ccs, ccs}, 2},
+		{"no ids, both have two", []denjson.Connector{ccs, j1772}, []denjson.Connector{j1772, ccs}, 2},
+		{"one id, same kind", []denjson.Connector{withID(ccs, "1")}, []denjson.Connector{ccs}, 1},
+		{"one id, other kind", []denjson.Connector{withID(ccs, "1")}, []denjson.Connector{j1772}, 2},
+	}
+	for _, tt := range tests {
+		w := testStation("US", "CPT", "LOC1")
+		w.Evses = []denjson.Evses{{UID: "E1", Connectors: tt.win}}
+		o := testStation("US", "CPT", "LOC1")
+		o.Region, o.src.feed = "CA", 1
+		o.Evses = []denjson.Evses{{UID: "E1", Connectors: tt.other}}
+		deepMergeCopies([]*stationRecord{w, o})
+		if 1 != len(w.Evses) {
+			t.Errorf("%s: %d EVSEs, want 1", tt.name, len(w.Evses))
+			continue
+		}
+		if got := len(w.Evses[0].Connectors); got != tt.want {
+			t.Errorf("%s: %d connectors, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeepMergeProvenance(t *testing.T) {
+	w := testStation("US", "CPT", "LOC1")
+	w.Region = "NA"
+	w.Facilities = []string{"HOTEL"}
+	w.Images = []denjson.Image{{Url: "https://img/1"}}
+	w.Evses = []denjson.Evses{{UID: "1", EvseID: "US*CPT*E1", Connectors: []denjson.Connector{{ID: "1"}}}}
+
+	o := testStation("US", "CPT", "LOC1")
+	o.Region, o.src.feed = "CA", 1
+	o.TimeZone = "America/Vancouver"
+	o.Facilities = []string{"HOTEL", "PARKING_LOT"}
+	o.Images = []denjson.Image{{Url: "https://img/1"}, {Url: "https://img/2"}}
+	o.Evses = []denjson.Evses{
+		{UID: "1", EvseID: "US*CPT*E1", Connectors: []denjson.Connector{{ID: "1"}, {ID: "2"}}},
+		{UID: "2", EvseID: "US*CPT*E2"},
+	}
+
+	deepMergeCopies([]*stationRecord{w, o})
+	want := map[string]string{
+		"location":                       "NA/0",
+		"evses[US*CPT*E1].connectors[2]": "CA/1",
+		"evses[US*CPT*E2]":               "CA/1",
+		"facilities[PARKING_LOT]":        "CA/1",
+		"images[https://img/2]":          "CA/1",
+		"time_zone":                      "CA/1",
+	}
+	for path, label := range want {
+		if got := w.Provenance[path]; got != label {
+			t.Errorf("provenance[%q] = %q, want %q", path, got, label)
+		}
+	}
+	if len(w.Provenance) != len(want) {
+		t.Errorf("provenance = %v, want only %v", w.Provenance, want)
+	}
+}
+
+func TestMergeHours(t *testing.T) {
+	monday := denjson.RegularHours{Weekday: 1, PeriodBegin: "08:00", PeriodEnd: "18:00"}
+	tuesday := denjson.RegularHours{Weekday: 2, PeriodBegin: "08:00", PeriodEnd: "18:00"}
+	closed := denjson.ExceptionalPeriod{PeriodBegin: "2024-12-25T00:00:00Z", PeriodEnd: "2024-12-26T00:00:00Z"}
+	tests := []struct {
+		name        string
+		w, o        denjson.Hours
+		wantAdded   int
+		wantRegular int
+	}{
+		{"nothing to add", denjson.Hours{RegularHours: []denjson.RegularHours{monday}}, denjson.Hours{}, 0, 1},
+		{"winner empty", denjson.Hours{}, denjson.Hours{RegularHours: []denjson.RegularHours{monday}}, 1, 1},
+		{"union of days", denjson.Hours{RegularHours: []denjson.RegularHours{monday}},
+			denjson.Hours{RegularHours: []denjson.RegularHours{monday, tuesday}}, 1, 2},
+		{"24/7 stands", denjson.Hours{Twentyfourseven: true},
+			denjson.Hours{RegularHours: []denjson.RegularHours{monday}}, 0, 0},
+		{"closings still merged", denjson.Hours{Twentyfourseven: true},
+			denjson.Hours{Twentyfourseven: true, ExceptionalClosings: []denjson.ExceptionalPeriod{closed}}, 1, 0},
+	}
+	for _, tt := range tests {
+		added := mergeHours(&tt.w, &tt.o)
+		if len(added) != tt.wantAdded {
+			t.Errorf("%s: added %v, want %d periods", tt.name, added, tt.wantAdded)
+		}
+		if len(tt.w.RegularHours) != tt.wantRegular {
+			t.Errorf("%s: %d regular hours, want %d", tt.name, len(tt.w.RegularHours), tt.wantRegular)
+		}
+	}
+}
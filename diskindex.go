@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+// diskIndex dedupes with an external sort instead of a map, so that
+// merges of any size fit in bounded memory. Every station is spilled,
+// with its dedupe key, into sorted runs on disk; once the feeds are
+// read the runs are merged, bringing the copies of each key together
+// to be resolved one key at a time. Bare IDs go through the same sort
+// (keyed apart from the stations) to find ID collisions. Since no key
+// is known to be new until the end, nothing is written as it arrives,
+// and stations come out in key order.
+type diskIndex struct {
+	dir    string
+	sorter *runSorter
+	seq    atomic.Uint64 // arrival order, for CONFLICT_FIRST
+
+	dups       map[string]struct{}
+	dupCopies  map[string][]*stationRecord
+	collisions map[string]map[string]struct{}
+	kept       string // file of resolved stations, with their sources
+	count      int
+}
+
+// Sort keys of the two kinds of entries; ID entries sort first, so
+// collisions are known before any station is resolved.
+const (
+	SORT_ID_PREFIX      = "i\x00"
+	SORT_STATION_PREFIX = "s\x00"
+)
+
+// newDiskIndex makes an empty index spilling into a new directory
+// under parent (the system temporary directory, if empty), removed
+// when the program ends. The sort buffers up to limit bytes.
+func newDiskIndex(parent string, limit int) (idx *diskIndex, err error) {
+	dir, err := os.MkdirTemp(parent, "mergeFeeds-index-")
+	if nil != err {
+		return nil, err
+	}
+	misc.AtClose(func() { _ = os.RemoveAll(dir) })
+	return &diskIndex{
+		dir:        dir,
+		sorter:     newRunSorter(dir, limit),
+		dups:       make(map[string]struct{}, 8),
+		dupCopies:  make(map[string][]*stationRecord, 8),
+		collisions: make(map[string]map[string]struct{}, 8),
+	}, nil
+}
+
+// add spills a station to the sort. It never returns true: whether
+// a key is new is only known once every station has been added.
+func (idx *diskIndex) add(loc *stationRecord) bool {
+	key := dedupeKey(loc)
+	seq := idx.seq.Add(1)
+	txt, err := json.Marshal(loc)
+	if nil == err {
+		err = idx.sorter.add(sortEntry{key: SORT_ID_PREFIX + loc.ID, seq: seq, data: []byte(key)})
+	}
+	if nil == err {
+		err = idx.sorter.add(sortEntry{key: SORT_STATION_PREFIX + key, seq: seq, data: encodeSpilled(loc.src, txt)})
+	}
+	if nil != err {
+		xLog.Printf("error spilling station %s to the dedupe index because %s", key, err.Error())
+		myFatal(-3)
+	}
+	return false
+}
+
+// resolve merges the runs, resolving the copies of each key by the
+// conflict strategy, and writes the stations kept to a file, each
+// spilled with its source and prefixed with its length. Under
+// CONFLICT_FIRST the copy that arrived first is kept.
+func (idx *diskIndex) resolve() (err error) {
+	if FlagVerbose {
+		xLog.Printf("dedupe index spilled %d sorted runs to %s", idx.sorter.spilled(), idx.dir)
+	}
+	idx.kept = filepath.Join(idx.dir, "kept.bin")
+	f, err := os.Create(idx.kept)
+	if nil != err {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); nil == err {
+			err = closeErr
+		}
+	}()
+	w := bufio.NewWriterSize(f, 1<<16)
+	var num [binary.MaxVarintLen64]byte
+
+	err = idx.sorter.groups(func(group []sortEntry) error {
+		if strings.HasPrefix(group[0].key, SORT_ID_PREFIX) {
+			idx.resolveId(strings.TrimPrefix(group[0].key, SORT_ID_PREFIX), group)
+			return nil
+		}
+		rec, err := idx.resolveStation(strings.TrimPrefix(group[0].key, SORT_STATION_PREFIX), group)
+		if nil != err {
+			return err
+		}
+		txt, err := json.Marshal(rec)
+		if nil != err {
+			return err
+		}
+		data := encodeSpilled(rec.src, txt)
+		idx.count++
+		_, _ = w.Write(num[:binary.PutUvarint(num[:], uint64(len(data)))])
+		_, err = w.Write(data)
+		return err
+	})
+	if nil != err {
+		return err
+	}
+	return w.Flush()
+}
+
+// resolveId records a collision if a bare ID was seen under more than one key
+func (idx *diskIndex) resolveId(id string, group []sortEntry) {
+	keys := make(map[string]struct{}, 2)
+	for _, e := range group {
+		keys[string(e.data)] = struct{}{}
+	}
+	if len(keys) > 1 {
+		idx.collisions[id] = keys
+	}
+}
+
+// resolveStation decodes every copy of a key and returns the one to keep
+func (idx *diskIndex) resolveStation(key string, group []sortEntry) (*stationRecord, error) {
+	var kept *stationRecord
+	for ix, e := range group {
+		loc, err := decodeSpilled(e.data)
+		if nil != err {
+			return nil, fmt.Errorf("decoding station %s: %w", key, err)
+		}
+		if len(group) > 1 && FlagDupReport {
+			// decode again: resolving may change the copy
+			dup, _ := decodeSpilled(e.data)
+			idx.dupCopies[key] = append(idx.dupCopies[key], dup)
+		}
+		switch {
+		case 0 == ix:
+			kept = loc
+		case CONFLICT_FIRST != FlagConflict:
+			kept = resolveConflict(kept, loc)
+		}
+	}
+	if len(group) > 1 {
+		idx.dups[key] = struct{}{}
+	}
+	return mergeCopies(kept), nil
+}
+
+// stations calls write with every station kept, in key order
+func (idx *diskIndex) stations(write func(rec *stationRecord)) error {
+	f, err := os.Open(idx.kept)
+	if nil != err {
+		return err
+	}
+	defer misc.DeferError(f.Close)
+	r := bufio.NewReaderSize(f, 1<<16)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if nil != err {
+			return err
+		}
+		data := make([]byte, n)
+		if _, err = io.ReadFull(r, data); nil != err {
+			return err
+		}
+		rec, err := decodeSpilled(data)
+		if nil != err {
+			return err
+		}
+		write(rec)
+	}
+}
+
+func (idx *diskIndex) duplicateKeys() map[string]struct{} { return idx.dups }
+
+func (idx *diskIndex) duplicateCopies() map[string][]*stationRecord { return idx.dupCopies }
+
+func (idx *diskIndex) idCollisions() map[string]map[string]struct{} { return idx.collisions }
+
+// encodeSpilled prefixes a marshalled station with its source,
+// which JSON does not carry
+func encodeSpilled(src recordSource, txt []byte) []byte {
+	b := make([]byte, 0, len(txt)+4*binary.MaxVarintLen64)
+	b = binary.AppendVarint(b, int64(src.priority))
+	b = binary.AppendVarint(b, int64(src.feed))
+	b = binary.AppendVarint(b, int64(src.page))
+	b = binary.AppendVarint(b, int64(src.index))
+	return append(b, txt...)
+}
+
+// decodeSpilled is the reverse of encodeSpilled
+func decodeSpilled(b []byte) (*stationRecord, error) {
+	src, txt, err := splitSpilled(b)
+	if nil != err {
+		return nil, err
+	}
+	rec := &stationRecord{}
+	err = json.Unmarshal(txt, rec)
+	if nil != err {
+		return nil, err
+	}
+	rec.src = src
+	return rec, nil
+}
+
+// splitSpilled separates a spilled station's source from its JSON
+func splitSpilled(b []byte) (src recordSource, txt []byte, err error) {
+	var fields [4]int64
+	for ix := range fields {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			return src, nil, fmt.Errorf("bad source in spilled station")
+		}
+		fields[ix] = v
+		b = b[n:]
+	}
+	src = recordSource{priority: int(fields[0]), feed: int(fields[1]), page: int(fields[2]), index: int(fields[3])}
+	return src, b, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSpilledRoundTrip(t *testing.T) {
+	for _, src := range []recordSource{
+		{},
+		{priority: -1, feed: 3, page: 12, index: 99},
+		{priority: 1 << 30, feed: 1 << 20, page: 1 << 10, index: 1},
+	} {
+		rec, err := decodeSpilled(encodeSpilled(src, []byte(`{"id":"LOC1","country_code":"US"}`)))
+		if nil != err {
+			t.Fatalf("%+v: %s", src, err.Error())
+		}
+		if rec.src != src || "LOC1" != rec.ID || "US" != rec.CountryCode {
+			t.Errorf("decoded %+v %q %q, want %+v LOC1 US", rec.src, rec.ID, rec.CountryCode, src)
+		}
+	}
+	if _, err := decodeSpilled(nil); nil == err {
+		t.Errorf("decodeSpilled(nil) did not fail")
+	}
+}
+
+// TestDiskIndexMatchesMemory checks that the disk index keeps the same
+// stations as the memory index, when spilled and when not
+func TestDiskIndexMatchesMemory(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagDeepMerge, FlagDupReport = false, false
+	defer func() { FlagConflict = CONFLICT_NEWEST }()
+
+	list := indexStations(100, 3)
+	list = append(list, testStation("CA", "FLO", "LOC7")) // an ID collision
+	rand.New(rand.NewSource(7)).Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+
+	for _, strategy := range []string{CONFLICT_NEWEST, CONFLICT_PRIORITY} {
+		FlagConflict = strategy
+		mem := newMemoryIndex(8)
+		addConcurrently(mem, list, 4)
+		want := make(map[string]string, 101)
+		_ = mem.stations(func(rec *stationRecord) { want[dedupeKey(rec)] = fmt.Sprintf("%s %+v", rec.Name, rec.src) })
+
+		for _, limit := range []int{1 << 20, 2 << 10} {
+			disk, err := newDiskIndex(t.TempDir(), limit)
+			if nil != err {
+				t.Fatal(err)
+			}
+			addConcurrently(disk, list, 4)
+			if err = disk.resolve(); nil != err {
+				t.Fatal(err)
+			}
+			if (disk.sorter.spilled() > 0) != (limit < 1<<20) {
+				t.Errorf("%s, limit %d: spilled %d runs", strategy, limit, disk.sorter.spilled())
+			}
+			got := make(map[string]string, 101)
+			lastKey := ""
+			err = disk.stations(func(rec *stationRecord) {
+				key := dedupeKey(rec)
+				if key <= lastKey {
+					t.Errorf("%s, limit %d: %s after %s, want key order", strategy, limit, key, lastKey)
+				}
+				lastKey = key
+				got[key] = fmt.Sprintf("%s %+v", rec.Name, rec.src)
+			})
+			if nil != err {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("%s, limit %d: %d stations, want %d", strategy, limit, len(got), len(want))
+			}
+			for key, name := range want {
+				if got[key] != name {
+					t.Errorf("%s, limit %d: %s kept %q, want %q", strategy, limit, key, got[key], name)
+				}
+			}
+			if len(disk.duplicateKeys()) != len(mem.duplicateKeys()) {
+				t.Errorf("%s, limit %d: %d duplicate keys, want %d",
+					strategy, limit, len(disk.duplicateKeys()), len(mem.duplicateKeys()))
+			}
+			if keys := disk.idCollisions()["LOC7"]; 2 != len(keys) {
+				t.Errorf("%s, limit %d: LOC7 collisions %v, want two keys", strategy, limit, keys)
+			}
+		}
+	}
+}
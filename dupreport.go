@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+// The duplicates report (duplicates.json and duplicates.txt) lists
+// every duplicated key with each copy -- feed, page, position on the
+// page -- and the fields in which each copy differs from the first
+// copy in source order. Copies are compared as they arrived, before
+// conflict resolution; the region tag is not compared, as it always
+// differs between feeds. Building the report holds every copy of a
+// duplicated key, and under --conflict first the first copy of every
+// key, until the feeds are read.
+
+// duplicateReport is the report on one duplicated key
+type duplicateReport struct {
+	Key         string          `json:"key"`
+	Identical   bool            `json:"identical"`
+	Copies      []duplicateCopy `json:"copies"`
+	Differences []fieldDiff     `json:"differences,omitempty"`
+}
+
+// duplicateCopy is where one copy of a duplicated key was found
+type duplicateCopy struct {
+	Feed        string    `json:"feed"`
+	Page        int       `json:"page"`
+	Index       int       `json:"index"`
+	LastUpdated time.Time `json:"last_updated,omitzero"`
+}
+
+// fieldDiff is one field in which a copy differs from the first copy.
+// Reference is the first copy's value, Value the other copy's; a
+// value missing from one copy is null.
+type fieldDiff struct {
+	Copy      int    `json:"copy"`
+	Path      string `json:"path"`
+	Reference any    `json:"reference"`
+	Value     any    `json:"value"`
+	Note      string `json:"note,omitempty"`
+}
+
+// duplicateSummary is the whole report
+type duplicateSummary struct {
+	Keys        int               `json:"keys"`
+	Identical   int               `json:"identical"`
+	Conflicting int               `json:"conflicting"`
+	Copies      int               `json:"copies"`
+	Duplicates  []duplicateReport `json:"duplicates"`
+}
+
+// writeDuplicateReport compares the copies of every duplicated key and
+// writes the report as JSON and as text. It must run before duplicates
+// are merged, since merging changes the copies.
+func writeDuplicateReport(dupCopies map[string][]*stationRecord) {
+	var summary duplicateSummary
+	keys := make([]string, 0, len(dupCopies))
+	for key := range dupCopies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		copies := dupCopies[key]
+		sort.Slice(copies, func(i, j int) bool { return copies[i].src.before(copies[j].src) })
+		dr := compareCopies(key, copies)
+		summary.Keys++
+		summary.Copies += len(copies)
+		if dr.Identical {
+			summary.Identical++
+		} else {
+			summary.Conflicting++
+		}
+		summary.Duplicates = append(summary.Duplicates, dr)
+	}
+
+	txt, err := json.MarshalIndent(summary, "", "  ")
+	if nil != err {
+		xLog.Printf("error marshalling duplicates report: %s", err.Error())
+	} else {
+		writeOutputFile("duplicates.json", txt)
+	}
+	writeOutputFile("duplicates.txt", []byte(duplicateReportText(&summary)))
+
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("duplicates report: %d keys, %d identical, %d conflicting (%d copies)",
+			summary.Keys, summary.Identical, summary.Conflicting, summary.Copies)
+	}
+}
+
+// compareCopies reports on the copies of one key, in source order
+func compareCopies(key string, copies []*stationRecord) (dr duplicateReport) {
+	dr.Key = key
+	generic := make([]any, len(copies))
+	for ix, rec := range copies {
+		dr.Copies = append(dr.Copies, duplicateCopy{
+			Feed:        feedLabel(rec),
+			Page:        rec.src.page,
+			Index:       rec.src.index,
+			LastUpdated: rec.LastUpdated,
+		})
+		generic[ix] = genericStation(rec)
+	}
+	for ix := 1; ix < len(copies); ix++ {
+		diffValues(ix, "", generic[0], generic[ix], &dr.Differences)
+	}
+	dr.Identical = len(dr.Differences) <= 0
+	return dr
+}
+
+// genericStation is a station as generic JSON (maps, slices,
+// strings, float64 and bool), without its region tag.
+func genericStation(rec *stationRecord) (generic any) {
+	txt, err := json.Marshal(rec)
+	if nil == err {
+		err = json.Unmarshal(txt, &generic)
+	}
+	if nil != err {
+		xLog.Printf("error converting station %s for comparison: %s", rec.ID, err.Error())
+		return nil
+	}
+	if m, ok := generic.(map[string]any); ok {
+		delete(m, "region")
+	}
+	return generic
+}
+
+// diffValues appends a fieldDiff for each difference between the
+// reference value a and value b, descending into objects and arrays.
+// EVSEs are matched by evse_id (or uid) and connectors by id, so that
+// a difference in order is not a difference.
+func diffValues(copyIx int, path string, a any, b any, diffs *[]fieldDiff) {
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+	am, aIsMap := a.(map[string]any)
+	bm, bIsMap := b.(map[string]any)
+	if aIsMap && bIsMap {
+		if strings.HasSuffix(path, "coordinates") {
+			if meters, ok := coordinateDistance(am, bm); ok {
+				*diffs = append(*diffs, fieldDiff{Copy: copyIx, Path: path, Reference: a, Value: b,
+					Note: fmt.Sprintf("differ by %.0fm", meters)})
+				return
+			}
+		}
+		for _, key := range unionKeys(am, bm) {
+			diffValues(copyIx, joinPath(path, key), am[key], bm[key], diffs)
+		}
+		return
+	}
+	as, aIsList := a.([]any)
+	bs, bIsList := b.([]any)
+	if aIsList && bIsList {
+		if keyOf := elementKey(path); nil != keyOf {
+			ak, bk := keyedElements(as, keyOf), keyedElements(bs, keyOf)
+			for _, key := range unionKeys(ak, bk) {
+				diffValues(copyIx, path+"["+key+"]", ak[key], bk[key], diffs)
+			}
+			return
+		}
+		if len(as) == len(bs) {
+			for ix := range as {
+				diffValues(copyIx, path+"["+strconv.Itoa(ix)+"]", as[ix], bs[ix], diffs)
+			}
+			return
+		}
+	}
+	*diffs = append(*diffs, fieldDiff{Copy: copyIx, Path: path, Reference: a, Value: b})
+}
+
+// elementKey returns how to identify the elements of the array at
+// path, or nil if they are compared by position.
+func elementKey(path string) func(m map[string]any) string {
+	switch {
+	case strings.HasSuffix(path, "evses"):
+		return func(m map[string]any) string {
+			if id, _ := m["evse_id"].(string); "" != id {
+				return id
+			}
+			uid, _ := m["uid"].(string)
+			return uid
+		}
+	case strings.HasSuffix(path, "connectors"):
+		return func(m map[string]any) string {
+			id, _ := m["id"].(string)
+			return id
+		}
+	}
+	return nil
+}
+
+// keyedElements maps each object in the list by its key; elements
+// that are not objects, or share a key, are keyed by position too.
+func keyedElements(list []any, keyOf func(m map[string]any) string) map[string]any {
+	keyed := make(map[string]any, len(list))
+	for ix, elem := range list {
+		key := "#" + strconv.Itoa(ix)
+		if m, ok := elem.(map[string]any); ok {
+			key = keyOf(m)
+		}
+		if _, dup := keyed[key]; dup {
+			key += "#" + strconv.Itoa(ix)
+		}
+		keyed[key] = elem
+	}
+	return keyed
+}
+
+// unionKeys lists the keys of both maps, sorted
+func unionKeys[T any](a map[string]T, b map[string]T) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path string, key string) string {
+	if "" == path {
+		return key
+	}
+	return path + "." + key
+}
+
+// coordinateDistance is the distance in meters between two OCPI
+// coordinate objects, if both parse.
+func coordinateDistance(a map[string]any, b map[string]any) (meters float64, ok bool) {
+	lat1, lon1, ok1 := parseCoordinates(a)
+	lat2, lon2, ok2 := parseCoordinates(b)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return haversineMeters(lat1, lon1, lat2, lon2), true
+}
+
+// parseCoordinates reads the latitude and longitude strings of an
+// OCPI coordinate object
+func parseCoordinates(m map[string]any) (lat float64, lon float64, ok bool) {
+	latStr, ok1 := m["latitude"].(string)
+	lonStr, ok2 := m["longitude"].(string)
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	lat, err1 := strconv.ParseFloat(latStr, 64)
+	lon, err2 := strconv.ParseFloat(lonStr, 64)
+	return lat, lon, nil == err1 && nil == err2
+}
+
+const EARTH_RADIUS_METERS = 6371008.8
+
+// haversineMeters is the great-circle distance between two points
+func haversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS_METERS * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// duplicateReportText is the human-readable form of the report
+func duplicateReportText(summary *duplicateSummary) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("duplicates: %d keys, %d identical, %d conflicting (%d copies)\n",
+		summary.Keys, summary.Identical, summary.Conflicting, summary.Copies))
+	for _, dr := range summary.Duplicates {
+		state := "conflicting"
+		if dr.Identical {
+			state = "identical"
+		}
+		sb.WriteString(fmt.Sprintf("\n%s  %s\n", dr.Key, state))
+		for ix, dc := range dr.Copies {
+			sb.WriteString(fmt.Sprintf("  copy %d: feed %s page %d index %d last_updated %s\n",
+				ix, dc.Feed, dc.Page, dc.Index, dc.LastUpdated.Format(time.RFC3339)))
+		}
+		for _, fd := range dr.Differences {
+			if "" != fd.Note {
+				sb.WriteString(fmt.Sprintf("  copy %d differs: %s %s\n", fd.Copy, fd.Path, fd.Note))
+			} else {
+				sb.WriteString(fmt.Sprintf("  copy %d differs: %s: %s vs %s\n",
+					fd.Copy, fd.Path, compactJson(fd.Reference), compactJson(fd.Value)))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// compactJson renders a generic value for the text report
+func compactJson(v any) string {
+	if nil == v {
+		return "(missing)"
+	}
+	txt, err := json.Marshal(v)
+	if nil != err {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(txt)
+}
+
+// writeOutputFile writes a whole file to the output directory
+func writeOutputFile(fn string, body []byte) {
+	var wg sync.WaitGroup
+	out := make(chan []byte, 1)
+	wg.Add(1)
+	go misc.RecordBytes(fn, out, wg.Done)
+	out <- body
+	close(out)
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []string // paths that differ
+	}{
+		{"identical", `{"name":"A","evses":[{"uid":"1"}]}`, `{"name":"A","evses":[{"uid":"1"}]}`, nil},
+		{"scalar", `{"name":"A"}`, `{"name":"B"}`, []string{"name"}},
+		{"missing", `{"name":"A","city":"X"}`, `{"name":"A"}`, []string{"city"}},
+		{"nested", `{"operator":{"name":"A"}}`, `{"operator":{"name":"B"}}`, []string{"operator.name"}},
+		{"evses out of order",
+			`{"evses":[{"evse_id":"E1","status":"AVAILABLE"},{"evse_id":"E2"}]}`,
+			`{"evses":[{"evse_id":"E2"},{"evse_id":"E1","status":"AVAILABLE"}]}`, nil},
+		{"evse status",
+			`{"evses":[{"evse_id":"E1","status":"AVAILABLE"},{"uid":"2"}]}`,
+			`{"evses":[{"uid":"2"},{"evse_id":"E1","status":"CHARGING"}]}`, []string{"evses[E1].status"}},
+		{"connector by id",
+			`{"evses":[{"uid":"1","connectors":[{"id":"1","amperage":32},{"id":"2"}]}]}`,
+			`{"evses":[{"uid":"1","connectors":[{"id":"2"},{"id":"1","amperage":16}]}]}`,
+			[]string{"evses[1].connectors[1].amperage"}},
+		{"facilities by position", `{"facilities":["A","B"]}`, `{"facilities":["B","A"]}`,
+			[]string{"facilities[0]", "facilities[1]"}},
+		{"list length", `{"facilities":["A"]}`, `{"facilities":["A","B"]}`, []string{"facilities"}},
+		{"coordinates",
+			`{"coordinates":{"latitude":"49.0","longitude":"-123.0"}}`,
+			`{"coordinates":{"latitude":"49.001","longitude":"-123.0"}}`, []string{"coordinates"}},
+	}
+	for _, tt := range tests {
+		var a, b any
+		if err := json.Unmarshal([]byte(tt.a), &a); nil != err {
+			t.Fatalf("%s: %s", tt.name, err.Error())
+		}
+		if err := json.Unmarshal([]byte(tt.b), &b); nil != err {
+			t.Fatalf("%s: %s", tt.name, err.Error())
+		}
+		var diffs []fieldDiff
+		diffValues(1, "", a, b, &diffs)
+		var got []string
+		for _, fd := range diffs {
+			got = append(got, fd.Path)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: differences %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for ix := range got {
+			if got[ix] != tt.want[ix] {
+				t.Errorf("%s: differences %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCoordinateNote(t *testing.T) {
+	var diffs []fieldDiff
+	diffValues(1, "coordinates",
+		map[string]any{"latitude": "49.0", "longitude": "-123.0"},
+		map[string]any{"latitude": "49.001", "longitude": "-123.0"}, &diffs)
+	if 1 != len(diffs) || "differ by 111m" != diffs[0].Note {
+		t.Errorf("coordinates 0.001 degrees of latitude apart: %+v, want a note of 111m", diffs)
+	}
+}
+
+func TestHaversineMeters(t *testing.T) {
+	tests := []struct {
+		lat1, lon1, lat2, lon2 float64
+		want, within           float64
+	}{
+		{49, -123, 49, -123, 0, 0},
+		{0, 0, 1, 0, 111195, 1},
+		{0, 0, 0, 180, math.Pi * EARTH_RADIUS_METERS, 1},
+		{49.2827, -123.1207, 47.6062, -122.3321, 195_000, 1_000}, // Vancouver to Seattle
+	}
+	for _, tt := range tests {
+		got := haversineMeters(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		if math.Abs(got-tt.want) > tt.within {
+			t.Errorf("haversineMeters(%v, %v, %v, %v) = %.0f, want %.0f", tt.lat1, tt.lon1, tt.lat2, tt.lon2, got, tt.want)
+		}
+	}
+}
+
+func TestCompareCopies(t *testing.T) {
+	updated := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	a := testStation("US", "CPT", "LOC1")
+	a.Region, a.Name, a.LastUpdated = "NA", "Station", updated
+	b := testStation("US", "CPT", "LOC1")
+	b.Region, b.Name, b.LastUpdated = "CA", "Station", updated
+	b.src = recordSource{feed: 1, page: 2, index: 3}
+
+	dr := compareCopies("US/CPT/LOC1", []*stationRecord{a, b})
+	if !dr.Identical {
+		t.Errorf("copies differing only in region: differences %+v", dr.Differences)
+	}
+	if 2 != len(dr.Copies) || "CA/1" != dr.Copies[1].Feed || 2 != dr.Copies[1].Page || 3 != dr.Copies[1].Index {
+		t.Errorf("copies = %+v", dr.Copies)
+	}
+
+	b.Name = "Other"
+	dr = compareCopies("US/CPT/LOC1", []*stationRecord{a, b})
+	if dr.Identical || 1 != len(dr.Differences) {
+		t.Fatalf("differences = %+v, want one in name", dr.Differences)
+	}
+	if fd := dr.Differences[0]; 1 != fd.Copy || "name" != fd.Path || "Station" != fd.Reference || "Other" != fd.Value {
+		t.Errorf("difference = %+v", fd)
+	}
+}
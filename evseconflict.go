@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+// An EVSE's evse_id (its eMI3 ID) names one physical charger, so it
+// should belong to one location. After dedupe, an evse_id found under
+// more than one location is an EVSE conflict, settled by a policy and
+// reported in evseconflicts.json. EVSEs without an evse_id are not
+// tracked: a uid is only unique within its location.
+
+// EVSE conflict policies
+const (
+	EVSE_KEEP_NEWEST = "newest" // keep the EVSE in the newest location only
+	EVSE_DROP        = "drop"   // drop the EVSE from every location
+	EVSE_KEEP_BOTH   = "both"   // keep it everywhere, flagging the locations
+)
+
+var evsePolicies = []string{EVSE_KEEP_NEWEST, EVSE_DROP, EVSE_KEEP_BOTH}
+
+// checkEvsePolicy makes sure the policy is known; empty is off
+func checkEvsePolicy(policy string) error {
+	if "" == policy {
+		return nil
+	}
+	for _, known := range evsePolicies {
+		if known == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown EVSE conflict policy %s (use one of %s)",
+		policy, strings.Join(evsePolicies, ", "))
+}
+
+// evseLocation is one location an EVSE in conflict was found under
+type evseLocation struct {
+	Key         string    `json:"key"`
+	Feed        string    `json:"feed"`
+	LastUpdated time.Time `json:"last_updated,omitzero"`
+	Kept        bool      `json:"kept"`
+}
+
+// evseConflict is the report on one evse_id under several locations
+type evseConflict struct {
+	EvseID    string         `json:"evse_id"`
+	Locations []evseLocation `json:"locations"`
+}
+
+// evseSummary is the whole EVSE conflict report
+type evseSummary struct {
+	Policy    string         `json:"policy"`
+	Evses     int            `json:"evses"`
+	Conflicts int            `json:"conflicts"`
+	Removed   int            `json:"removed"`
+	Flagged   int            `json:"flagged_locations"`
+	Details   []evseConflict `json:"details"`
+}
+
+// evseTracker is the stationStage finding EVSE conflicts. It holds
+// every station until the input ends, noting the locations of each
+// evse_id.
+type evseTracker struct {
+	policy   string
+	stations []*stationRecord
+	keys     []string
+	evses    map[string][]int  // normalized evse_id to stations
+	order    []string          // evse_ids in the order first seen
+	names    map[string]string // normalized evse_id to the evse_id first seen
+}
+
+func newEvseTracker(policy string) *evseTracker {
+	return &evseTracker{
+		policy: policy,
+		evses:  make(map[string][]int, 4096),
+		names:  make(map[string]string, 4096),
+	}
+}
+
+// normalizeEvseId makes equivalent eMI3 IDs equal: the separators
+// are optional and the ID is not case sensitive
+func normalizeEvseId(id string) string {
+	return strings.ToUpper(strings.NewReplacer("*", "", " ", "", "-", "").Replace(id))
+}
+
+// process holds the station, noting its EVSEs; nothing is passed on until flush
+func (et *evseTracker) process(rec *stationRecord) []*stationRecord {
+	ix := len(et.stations)
+	et.stations = append(et.stations, rec)
+	et.keys = append(et.keys, dedupeKey(rec))
+	for jx := range rec.Evses {
+		if "" == rec.Evses[jx].EvseID {
+			continue
+		}
+		id := normalizeEvseId(rec.Evses[jx].EvseID)
+		list, seen := et.evses[id]
+		if !seen {
+			et.order = append(et.order, id)
+			et.names[id] = rec.Evses[jx].EvseID
+		}
+		if len(list) <= 0 || list[len(list)-1] != ix {
+			et.evses[id] = append(list, ix)
+		}
+	}
+	return nil
+}
+
+// flush settles each conflict by the policy, writes the report and
+// passes on the stations in the order they came
+func (et *evseTracker) flush() []*stationRecord {
+	summary := evseSummary{Policy: et.policy, Evses: len(et.evses), Details: []evseConflict{}}
+	flagged := make(map[int]struct{}, 8)
+
+	for _, id := range et.order {
+		list := et.evses[id]
+		if len(list) < 2 {
+			continue
+		}
+		conflict := evseConflict{EvseID: et.names[id]}
+		keep := -1
+		switch et.policy {
+		case EVSE_KEEP_NEWEST:
+			keep = list[0]
+			for _, ix := range list[1:] {
+				if newerStation(et.stations[keep], et.stations[ix]) == et.stations[ix] {
+					keep = ix
+				}
+			}
+		}
+		for _, ix := range list {
+			rec := et.stations[ix]
+			loc := evseLocation{Key: et.keys[ix], Feed: feedLabel(rec), LastUpdated: rec.LastUpdated}
+			switch {
+			case EVSE_KEEP_BOTH == et.policy:
+				loc.Kept = true
+				rec.EvseConflicts = append(rec.EvseConflicts, et.names[id])
+				flagged[ix] = struct{}{}
+			case ix == keep:
+				loc.Kept = true
+			default:
+				rec.Evses = removeEvse(rec.Evses, id)
+				summary.Removed++
+			}
+			conflict.Locations = append(conflict.Locations, loc)
+		}
+		summary.Conflicts++
+		summary.Details = append(summary.Details, conflict)
+	}
+	summary.Flagged = len(flagged)
+
+	txt, err := json.MarshalIndent(summary, "", "  ")
+	if nil != err {
+		xLog.Printf("error marshalling EVSE conflict report: %s", err.Error())
+	} else {
+		writeOutputFile("evseconflicts.json", txt)
+	}
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("EVSE conflicts: %d evse_ids under more than one location (policy %s); %d EVSEs removed, %d locations flagged",
+			summary.Conflicts, et.policy, summary.Removed, summary.Flagged)
+	}
+	return et.stations
+}
+
+// removeEvse returns a new list without the EVSEs with the
+// (normalized) evse_id; the list itself is left alone, since copies
+// held for reports may share it.
+func removeEvse(list []denjson.Evses, id string) []denjson.Evses {
+	kept := make([]denjson.Evses, 0, len(list))
+	for _, evse := range list {
+		if normalizeEvseId(evse.EvseID) != id {
+			kept = append(kept, evse)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+func TestNormalizeEvseId(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"US*CPT*E12345", "USCPTE12345", true},
+		{"us*cpt*e12345", "US*CPT*E12345", true},
+		{"DE-ABC-E1 2", "de*abc*e12", true},
+		{"US*CPT*E1", "US*CPT*E2", false},
+	}
+	for _, tt := range tests {
+		if same := normalizeEvseId(tt.a) == normalizeEvseId(tt.b); same != tt.same {
+			t.Errorf("normalizeEvseId(%q) == normalizeEvseId(%q) is %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
+
+func TestCheckEvsePolicy(t *testing.T) {
+	for _, policy := range append([]string{""}, evsePolicies...) {
+		if err := checkEvsePolicy(policy); nil != err {
+			t.Errorf("checkEvsePolicy(%q): %s", policy, err.Error())
+		}
+	}
+	if nil == checkEvsePolicy("oldest") {
+		t.Errorf("checkEvsePolicy(\"oldest\") accepted an unknown policy")
+	}
+}
+
+// TestRemoveEvse checks that the EVSEs are removed from a new list,
+// leaving any other holder of the original list undisturbed
+func TestRemoveEvse(t *testing.T) {
+	list := []denjson.Evses{
+		{UID: "1", EvseID: "US*CPT*E1"},
+		{UID: "2", EvseID: "US*CPT*E2"},
+		{UID: "3", EvseID: "uscpte1"},
+		{UID: "4"},
+	}
+	held := list // as a report or a merged copy would hold it
+
+	got := removeEvse(list, normalizeEvseId("US*CPT*E1"))
+	if 2 != len(got) || "2" != got[0].UID || "4" != got[1].UID {
+		t.Errorf("removeEvse left %+v, want uids 2 and 4", got)
+	}
+	for ix, uid := range []string{"1", "2", "3", "4"} {
+		if held[ix].UID != uid {
+			t.Errorf("original list changed: evse %d has uid %q, want %q", ix, held[ix].UID, uid)
+		}
+	}
+	if got = removeEvse(list, "NONE"); 4 != len(got) {
+		t.Errorf("removeEvse of an absent evse_id left %d EVSEs, want 4", len(got))
+	}
+}
+
+func TestEvseTrackerProcess(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	et := newEvseTracker(EVSE_KEEP_NEWEST)
+	a := testStation("US", "CPT", "LOC1")
+	a.Evses = []denjson.Evses{{UID: "1", EvseID: "US*CPT*E1"}, {UID: "2", EvseID: "US*CPT*E1"}, {UID: "3"}}
+	b := testStation("US", "FLO", "LOC9")
+	b.Evses = []denjson.Evses{{UID: "1", EvseID: "uscpte1"}, {UID: "2", EvseID: "US*FLO*E2"}}
+	et.process(a)
+	et.process(b)
+
+	if got := et.evses[normalizeEvseId("US*CPT*E1")]; 2 != len(got) || 0 != got[0] || 1 != got[1] {
+		t.Errorf("US*CPT*E1 found under stations %v, want [0 1]", got)
+	}
+	if 2 != len(et.order) || "US*CPT*E1" != et.names[et.order[0]] {
+		t.Errorf("evse_ids %v named %v, want US*CPT*E1 first as first seen", et.order, et.names)
+	}
+}
@@ -2,95 +2,519 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"unicode"
 
 	denjson "github.com/nathanverrilli/denJson"
 	misc "github.com/nathanverrilli/nlvMisc"
 )
 
-// filterJsonPage processes JSON location data from an input channel, filters duplicates, and writes filtered data to an output.
-// It handles JSON parsing, marshaling, and error handling, while managing synchronization with goroutines.
-// The function writes filtered data to a JSON file and sends errors to an error channel.
-// A callback function is called when the processing is complete. NOT THREAD SAFE, DO NOT MULTITHREAD
-func filterJsonPage(jsonPage <-chan []byte, outError chan<- []byte, allDone func()) {
-	var wg sync.WaitGroup
-	var ld denjson.LocationData
-	var needComma = false
+// stationRecord is a location as written to stations.json,
+// tagged with the region of the feed that supplied it. OCPI 2.2
+// feeds also identify the CPO that owns the location.
+type stationRecord struct {
+	denjson.Location
+	CountryCode string `json:"country_code,omitempty"` // OCPI 2.2
+	PartyID     string `json:"party_id,omitempty"`     // OCPI 2.2
+	Region      string `json:"region,omitempty"`
 
-	defer allDone()
+	Provenance     map[string]string `json:"provenance,omitempty"`      // deep merge only
+	NearDuplicates []string          `json:"near_duplicates,omitempty"` // keys merged in by --nearbymerge
+	EvseConflicts  []string          `json:"evse_conflicts,omitempty"`  // evse_ids also under other locations
+	Geofence       string            `json:"geofence,omitempty"`        // area containing it, with --geofencetag
+
+	src    recordSource     // where the station was found
+	copies []*stationRecord // duplicates held for merging
+}
+
+// stationFields are the fields that can make up the dedupe key
+var stationFields = map[string]func(rec *stationRecord) string{
+	"id":           func(rec *stationRecord) string { return rec.ID },
+	"country_code": func(rec *stationRecord) string { return rec.CountryCode },
+	"party_id":     func(rec *stationRecord) string { return rec.PartyID },
+	"region":       func(rec *stationRecord) string { return rec.Region },
+	"country":      func(rec *stationRecord) string { return rec.Country },
+	"name":         func(rec *stationRecord) string { return rec.Name },
+	"address":      func(rec *stationRecord) string { return rec.Address },
+	"city":         func(rec *stationRecord) string { return rec.City },
+	"postal_code":  func(rec *stationRecord) string { return rec.PostalCode },
+}
+
+// checkDedupeKey makes sure every field of the dedupe key is known
+func checkDedupeKey(fields []string) error {
+	if len(fields) <= 0 {
+		return fmt.Errorf("dedupe key has no fields")
+	}
+	for _, field := range fields {
+		if _, ok := stationFields[field]; !ok {
+			return fmt.Errorf("unknown dedupe key field %s", field)
+		}
+	}
+	return nil
+}
+
+// dedupeKey identifies a station for duplicate detection. In OCPI a
+// location ID is only unique within its country code and party ID,
+// so by default the key is country_code/party_id/id. A '/' or '%'
+// within a field is escaped as in a URL (%2F, %25), so that fields
+// ("A", "B/C") and ("A/B", "C") make different keys.
+func dedupeKey(rec *stationRecord) string {
+	var sb strings.Builder
+	for ix, field := range FlagDedupeKey {
+		if ix > 0 {
+			sb.WriteRune('/')
+		}
+		sb.WriteString(keyField(stationFields[field](rec)))
+	}
+	return sb.String()
+}
+
+var keyEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// keyField is a field as it appears in a key
+func keyField(field string) string {
+	return keyEscaper.Replace(field)
+}
+
+// keyGaps counts, by feed, the stations missing a field of the dedupe
+// key, whose keys then rest on the other fields alone. OCPI 2.1 feeds,
+// for one, have no country_code or party_id.
+type keyGaps struct {
+	lock   sync.Mutex
+	counts map[string]map[string]int // feed, field: stations
+}
+
+func newKeyGaps() *keyGaps {
+	return &keyGaps{counts: make(map[string]map[string]int, 4)}
+}
+
+// note counts the empty key fields of a station
+func (kg *keyGaps) note(rec *stationRecord) {
+	for _, field := range FlagDedupeKey {
+		if "" != stationFields[field](rec) {
+			continue
+		}
+		feed := feedLabel(rec)
+		kg.lock.Lock()
+		fields, ok := kg.counts[feed]
+		if !ok {
+			fields = make(map[string]int, len(FlagDedupeKey))
+			kg.counts[feed] = fields
+		}
+		fields[field]++
+		kg.lock.Unlock()
+	}
+}
+
+// report warns of each feed with stations missing key fields
+func (kg *keyGaps) report() {
+	feeds := make([]string, 0, len(kg.counts))
+	for feed := range kg.counts {
+		feeds = append(feeds, feed)
+	}
+	sort.Strings(feeds)
+	for _, feed := range feeds {
+		var missing []string
+		for _, field := range FlagDedupeKey {
+			if count := kg.counts[feed][field]; count > 0 {
+				missing = append(missing, fmt.Sprintf("%d without %s", count, field))
+			}
+		}
+		xLog.Printf("warning: feed %s has stations missing dedupe key fields (%s); their keys rest on the other fields",
+			feed, strings.Join(missing, ", "))
+	}
+}
+
+// stationPage is the envelope of a page of locations from a feed
+type stationPage struct {
+	Data []stationRecord `json:"data,omitempty"`
+}
+
+// rawStationPage is a page with each location left undecoded
+type rawStationPage struct {
+	Data []json.RawMessage `json:"data,omitempty"`
+}
+
+// stationWriter streams a `{"data": [ ... ] }` document to a
+// file, keeping track of the annoying JSON comma.
+type stationWriter struct {
+	out       chan []byte
+	needComma bool
+	count     int
+}
 
-	stationOut := make(chan []byte, 32)
+// newStationWriter starts recording to the named file; wg.Done()
+// is called once the file is completely written.
+func newStationWriter(fn string, wg *sync.WaitGroup) (sw *stationWriter) {
+	out := make(chan []byte, 32)
 	wg.Add(1)
-	go misc.RecordBytes("stations.json", stationOut, wg.Done)
+	go misc.RecordBytes(fn, out, wg.Done)
+	return startStationWriter(out)
+}
+
+// startStationWriter starts the document on a channel being recorded
+func startStationWriter(out chan []byte) (sw *stationWriter) {
+	sw = &stationWriter{out: out}
+	sw.out <- []byte("{\"data\": [ ")
+	return sw
+}
+
+// write adds one marshalled station to the document
+func (sw *stationWriter) write(txt []byte) {
+	if sw.needComma {
+		sw.out <- []byte(",\n")
+	} else {
+		sw.needComma = true
+	}
+	sw.out <- txt
+	sw.count++
+}
+
+// close finishes the document. The writer may not be used afterward.
+func (sw *stationWriter) close() {
+	sw.out <- []byte(" ] } ")
+	close(sw.out)
+}
+
+func (sw *stationWriter) written() int {
+	return sw.count
+}
+
+// regionFileName is the per-region output file for a region, less
+// the extension of its format, e.g. stations-na
+func regionFileName(region string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || '-' == r {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, region)
+	return "stations-" + name
+}
 
-	stationOut <- []byte("{\"data\": [ ")
+// STATION_BATCH_SIZE is how many held stations go to the writer at a time
+const STATION_BATCH_SIZE = 256
 
-	for b := range jsonPage {
-		err := json.Unmarshal(b, &ld)
+// stationStage is a step between dedupe and output, run on the writer
+// goroutine, so it sees every kept station in output order and needs no
+// locking. process takes a station and returns the stations to pass on
+// now (none, to hold it); flush returns whatever is held once the input
+// ends.
+type stationStage interface {
+	process(rec *stationRecord) []*stationRecord
+	flush() []*stationRecord
+}
+
+// newStationStages makes the stages selected by the flags, in order
+func newStationStages() (stages []stationStage) {
+	if nil != whereExpr {
+		stages = append(stages, newWhereFilter(whereExpr))
+	}
+	if nil != theGeofence {
+		stages = append(stages, newGeofenceFilter(theGeofence))
+	}
+	if FlagNearbyRadius > 0 {
+		stages = append(stages, newNearbyDetector(FlagNearbyRadius))
+	}
+	if "" != FlagEvseConflict {
+		stages = append(stages, newEvseTracker(FlagEvseConflict))
+	}
+	if FlagQuality {
+		// last, to score the stations written
+		stages = append(stages, newQualityScorer())
+	}
+	return stages
+}
+
+// stationOutput writes kept stations to stations.json (in each
+// FlagOutputFormat) and, with
+// FlagRegionFiles, to a file per region, after passing them through
+// the stages; with FlagSort they are held and sorted first. It is
+// used from the single writer goroutine, so it needs no locking.
+type stationOutput struct {
+	stages      []stationStage
+	sorted      *sortedOutput
+	wg          sync.WaitGroup
+	stationOut  []recordWriter
+	regionOut   map[string][]recordWriter
+	regionCount map[string]int
+	count       int // stations written, whether or not every format takes them
+}
+
+func newStationOutput() (so *stationOutput, err error) {
+	so = &stationOutput{
+		stages:      newStationStages(),
+		regionOut:   make(map[string][]recordWriter, 4),
+		regionCount: make(map[string]int, 4),
+	}
+	if FlagSort {
+		so.sorted, err = newSortedOutput(FlagIndexDir, FlagMemLimit<<20/2)
 		if nil != err {
-			xLog.Printf("error parsing JSON: %s", err.Error())
-			outError <- []byte(err.Error())
-			outError <- b
-			outError <- []byte("\n")
-		}
-
-		for _, loc := range ld.Data {
-			ok := filterDuplicateStations(&loc)
-			if ok {
-				txt, err := json.Marshal(loc)
-				if nil != err {
-					xLog.Printf("error marshalling station: %s", err.Error())
-				} else {
-					if needComma {
-						stationOut <- []byte(",\n")
-					} else {
-						needComma = true
-					}
-					stationOut <- txt
-				}
-			}
+			return nil, err
 		}
 	}
-	stationOut <- []byte(" ] } ")
-	close(stationOut)
-	wg.Wait()
+	so.stationOut = newRecordWriters("stations", &so.wg)
+	return so, nil
+}
+
+// stage passes stations through the stages from the one at ix on,
+// writing whatever comes out of the last
+func (so *stationOutput) stage(ix int, recs []*stationRecord) {
+	if ix >= len(so.stages) {
+		for _, rec := range recs {
+			so.write(rec)
+		}
+		return
+	}
+	for _, rec := range recs {
+		so.stage(ix+1, so.stages[ix].process(rec))
+	}
+}
+
+// write writes one station to its files, or holds it for the sort
+func (so *stationOutput) write(loc *stationRecord) {
+	if nil == so.sorted {
+		so.emit(loc)
+		return
+	}
+	err := so.sorted.add(loc)
+	if nil != err {
+		xLog.Printf("error sorting station: %s", err.Error())
+	}
+}
+
+// emit marshals one station, transformed by --transform (and made
+// canonical with FlagSort), to its files
+func (so *stationOutput) emit(loc *stationRecord) {
+	var txt []byte
+	var err error
+	if nil != theTransform {
+		txt, err = theTransform.apply(loc)
+	} else {
+		txt, err = json.Marshal(loc)
+	}
+	if nil == err && FlagSort {
+		txt, err = canonicalJson(txt)
+	}
+	if nil != err {
+		xLog.Printf("error marshalling station: %s", err.Error())
+		return
+	}
+	for _, rw := range so.stationOut {
+		rw.write(loc, txt)
+	}
+	so.count++
+	so.regionCount[loc.Region]++
+	if FlagRegionFiles {
+		writers, ok := so.regionOut[loc.Region]
+		if !ok {
+			writers = newRecordWriters(regionFileName(loc.Region), &so.wg)
+			so.regionOut[loc.Region] = writers
+		}
+		for _, rw := range writers {
+			rw.write(loc, txt)
+		}
+	}
+}
+
+// writeAll writes every batch of stations received, in order, then
+// flushes the stages, finishes the files and calls allDone once they
+// are written.
+func (so *stationOutput) writeAll(kept <-chan []*stationRecord, allDone func()) {
+	defer allDone()
+	for batch := range kept {
+		for _, loc := range batch {
+			so.stage(0, []*stationRecord{loc})
+		}
+	}
+	for ix, stage := range so.stages {
+		so.stage(ix+1, stage.flush())
+	}
+	if nil != so.sorted {
+		err := so.sorted.each(so.emit)
+		if nil != err {
+			xLog.Printf("error sorting stations because %s", err.Error())
+			myFatal(-3)
+		}
+	}
+	for _, rw := range so.stationOut {
+		rw.close()
+	}
+	for _, writers := range so.regionOut {
+		for _, rw := range writers {
+			rw.close()
+		}
+	}
+	so.wg.Wait()
+}
+
+// filterJsonPage processes JSON location data from an input channel, filters duplicates, and writes filtered data to an output.
+// Pages are decoded and deduplicated by FlagWorkers workers in parallel, sharing a dedupeIndex; a single writer
+// goroutine writes stations.json (and, with FlagRegionFiles, the per-region files), so output is never interleaved.
+// Each station is tagged with the region of its page. Errors are sent to an error channel.
+// Under the CONFLICT_FIRST strategy with the memory index each page's new stations are written as the page is
+// processed; otherwise they are held until every page is in, duplicates resolved, then written in source order
+// (key order, for the disk index) so that the output is deterministic. With FlagSort every station is held and
+// written in --sortkey order. A callback function is called when the processing is complete.
+func filterJsonPage(jsonPage <-chan feedPage, outError chan<- []byte, allDone func()) {
+	var wgWorkers sync.WaitGroup
+	var wgWriter sync.WaitGroup
+
+	defer allDone()
+
+	idx, err := newStationIndex()
+	if nil != err {
+		xLog.Printf("error creating the dedupe index because %s", err.Error())
+		myFatal(-3)
+	}
+	var q *quarantine
+	if "" != FlagSchema {
+		q = newQuarantine()
+	}
+	so, err := newStationOutput()
+	if nil != err {
+		xLog.Printf("error creating the station sort because %s", err.Error())
+		myFatal(-3)
+	}
+	gaps := newKeyGaps()
+	kept := make(chan []*stationRecord, 16)
+	wgWriter.Add(1)
+	go so.writeAll(kept, wgWriter.Done)
+
+	for w := 0; w < max(1, FlagWorkers); w++ {
+		wgWorkers.Add(1)
+		go filterWorker(idx, q, theNormalizer, gaps, jsonPage, kept, outError, wgWorkers.Done)
+	}
+	wgWorkers.Wait()
+	gaps.report()
+	if nil != q {
+		q.close()
+	}
+	if nil != theNormalizer {
+		theNormalizer.report()
+	}
+
+	err = idx.resolve()
+	if nil != err {
+		xLog.Printf("error resolving duplicate stations because %s", err.Error())
+		myFatal(-3)
+	}
+	if FlagDupReport {
+		// before merging changes the copies
+		writeDuplicateReport(idx.duplicateCopies())
+	}
+	var batch []*stationRecord
+	err = idx.stations(func(rec *stationRecord) {
+		batch = append(batch, rec)
+		if len(batch) >= STATION_BATCH_SIZE {
+			kept <- batch
+			batch = nil
+		}
+	})
+	if nil != err {
+		xLog.Printf("error reading resolved stations because %s", err.Error())
+		myFatal(-3)
+	}
+	if len(batch) > 0 {
+		kept <- batch
+	}
+	close(kept)
+	wgWriter.Wait()
+
+	if FlagDebug || FlagVerbose {
+		printRegionStats(so.regionCount, so.count)
+		xLog.Printf("duplicate stations dropped: %d keys (conflict strategy %s); id collisions kept: %d ids",
+			len(idx.duplicateKeys()), FlagConflict, len(idx.idCollisions()))
+	}
 	if FlagDebug {
-		printDuplicateStats()
+		printDuplicateStats(idx)
 	}
 
 }
 
-func printDuplicateStats() {
-	var sb strings.Builder
-	xLog.Printf("duplicate station count: %d\n\tduplicates:", len(dupStations))
-	ix := 0
-	for k := range dupStations {
-		ix++
-		if 0 == ix%5 {
-			xLog.Printf("%s", sb.String())
-			sb.Reset()
-			sb.WriteRune(' ')
-		}
-		sb.WriteString(k)
-		sb.WriteRune(' ')
-	}
-	xLog.Printf("%s", sb.String())
-}
-
-var stations = make(map[string]struct{}, 16384)
-var dupStations = make(map[string]struct{}, 8)
-
-// filterDuplicateStations checks if a station is already present
-// in the stations map, filtering out duplicates. It adds new
-// station IDs to the map and increments a duplicate counter for
-// repeated entries.
-func filterDuplicateStations(loc *denjson.Location) bool {
-	_, ok := stations[loc.ID]
-	if !ok {
-		stations[loc.ID] = struct{}{}
-		return true
-	}
-	dupStations[loc.ID] = struct{}{}
-	return false
+// filterWorker decodes pages and adds their stations to the index until
+// the input is closed. With a quarantine, stations violating the OCPI
+// schema go to it instead, and the rest of the page is kept. With a
+// normalizer, stations are normalized before they are indexed. Empty
+// dedupe key fields are counted in gaps. The stations of a page to be
+// written at once go to the writer as one batch, keeping a page's
+// stations together.
+func filterWorker(idx stationIndex, q *quarantine, norm *normalizer, gaps *keyGaps, jsonPage <-chan feedPage,
+	kept chan<- []*stationRecord, outError chan<- []byte, allDone func()) {
+	defer allDone()
+
+	for page := range jsonPage {
+		// the envelope first, then each location on its own, so that one
+		// bad location costs only itself and not the page
+		var raw rawStationPage
+		err := json.Unmarshal(page.body, &raw)
+		if nil != err {
+			xLog.Printf("error parsing JSON page %d of feed %s/%d: %s", page.page, page.region, page.feed, err.Error())
+			// one message, so that workers' errors do not interleave
+			msg := make([]byte, 0, len(err.Error())+len(page.body)+1)
+			msg = append(append(append(msg, err.Error()...), page.body...), '\n')
+			outError <- msg
+			continue
+		}
+
+		// decode each page afresh: stations may be held past this page
+		ld := stationPage{Data: make([]stationRecord, len(raw.Data))}
+		bad := make([]bool, len(raw.Data))
+		for ix := range raw.Data {
+			err = json.Unmarshal(raw.Data[ix], &ld.Data[ix])
+			if nil != err {
+				bad[ix] = true
+				note := fmt.Sprintf("error parsing location %d of page %d of feed %s/%d (%s): %s\n",
+					ix, page.page, page.region, page.feed, page.url, err.Error())
+				xLog.Print(note)
+				msg := make([]byte, 0, len(note)+len(raw.Data[ix])+1)
+				msg = append(append(append(msg, note...), raw.Data[ix]...), '\n')
+				outError <- msg
+			}
+		}
+
+		var batch []*stationRecord
+		for ix := range ld.Data {
+			if bad[ix] {
+				continue
+			}
+			loc := &ld.Data[ix]
+			loc.Region = page.region
+			loc.src = recordSource{priority: page.priority, feed: page.feed, page: page.page, index: ix}
+			if nil != q {
+				violations := validateRawLocation(raw.Data[ix], FlagSchema)
+				if len(violations) > 0 {
+					q.add(&quarantinedStation{Feed: feedLabel(loc), Page: page.page, Index: ix,
+						Url: page.url, Violations: violations, Location: raw.Data[ix]})
+					continue
+				}
+			}
+			if nil != norm {
+				norm.apply(loc)
+			}
+			gaps.note(loc)
+			if idx.add(loc) {
+				batch = append(batch, loc)
+			}
+		}
+		if len(batch) > 0 {
+			kept <- batch
+		}
+	}
+}
+
+// printRegionStats logs the number of stations written for each region
+func printRegionStats(regionCount map[string]int, total int) {
+	regions := make([]string, 0, len(regionCount))
+	for region := range regionCount {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		xLog.Printf("stations written for region %s: %d", region, regionCount[region])
+	}
+	xLog.Printf("total stations written (all regions): %d", total)
 }
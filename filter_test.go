@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRegionFileName(t *testing.T) {
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"NA", "stations-na"},
+		{"ca", "stations-ca"},
+		{"eu-west", "stations-eu-west"},
+		{"127.0.0.1", "stations-127_0_0_1"},
+		{"A/B", "stations-a_b"},
+		{"Île", "stations-île"},
+	}
+	for _, tt := range tests {
+		if got := regionFileName(tt.region); got != tt.want {
+			t.Errorf("regionFileName(%q) = %q, want %q", tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestStationWriterDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		stations []string
+	}{
+		{"empty", nil},
+		{"one", []string{`{"id":"1"}`}},
+		{"several", []string{`{"id":"1"}`, `{"id":"2"}`, `{"id":"3"}`}},
+	}
+	for _, tt := range tests {
+		out := make(chan []byte, 2*len(tt.stations)+2)
+		sw := startStationWriter(out)
+		for _, txt := range tt.stations {
+			sw.write([]byte(txt))
+		}
+		sw.close()
+		var doc []byte
+		for txt := range out {
+			doc = append(doc, txt...)
+		}
+
+		var page rawStationPage
+		if err := json.Unmarshal(doc, &page); nil != err {
+			t.Errorf("%s: document %q is not JSON: %s", tt.name, doc, err)
+			continue
+		}
+		if len(page.Data) != len(tt.stations) || sw.written() != len(tt.stations) {
+			t.Errorf("%s: %d stations read, %d written, want %d", tt.name, len(page.Data), sw.written(), len(tt.stations))
+		}
+	}
+}
+
+// testStation is a station with the fields of the default dedupe key
+func testStation(countryCode, partyID, id string) *stationRecord {
+	rec := &stationRecord{CountryCode: countryCode, PartyID: partyID}
+	rec.ID = id
+	return rec
+}
+
+func TestDedupeKey(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	tests := []struct {
+		rec  *stationRecord
+		want string
+	}{
+		{testStation("CA", "CPC", "LOC1"), "CA/CPC/LOC1"},
+		{testStation("A", "B/C", "1"), "A/B%2FC/1"},
+		{testStation("A/B", "C", "1"), "A%2FB/C/1"},
+		{testStation("US", "CPT", "a/b"), "US/CPT/a%2Fb"},
+		{testStation("US", "CPT", "100%"), "US/CPT/100%25"},
+		{testStation("US", "CPT", "a%2Fb"), "US/CPT/a%252Fb"},
+		{testStation("", "", "LOC1"), "//LOC1"},
+	}
+	seen := make(map[string]*stationRecord, len(tests))
+	for _, tt := range tests {
+		got := dedupeKey(tt.rec)
+		if got != tt.want {
+			t.Errorf("dedupeKey(%q, %q, %q) = %q, want %q", tt.rec.CountryCode, tt.rec.PartyID, tt.rec.ID, got, tt.want)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("stations %+v and %+v share key %q", other, tt.rec, got)
+		}
+		seen[got] = tt.rec
+	}
+}
+
+func TestKeyGaps(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	stations := []*stationRecord{
+		testStation("CA", "CPC", "1"),
+		testStation("", "", "2"),
+		testStation("", "", "3"),
+		testStation("US", "", "4"),
+	}
+	stations[3].src.feed = 1
+	gaps := newKeyGaps()
+	for _, rec := range stations {
+		gaps.note(rec)
+	}
+	want := map[string]map[string]int{
+		"/0": {"country_code": 2, "party_id": 2},
+		"/1": {"party_id": 1},
+	}
+	if len(gaps.counts) != len(want) {
+		t.Fatalf("gaps in %d feeds, want %d: %v", len(gaps.counts), len(want), gaps.counts)
+	}
+	for feed, fields := range want {
+		for field, count := range fields {
+			if got := gaps.counts[feed][field]; got != count {
+				t.Errorf("feed %s: %d without %s, want %d", feed, got, field, count)
+			}
+		}
+	}
+}
+
+// TestFilterWorkerDecode checks that a bad location costs only itself,
+// and a bad page only itself
+func TestFilterWorkerDecode(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagConflict, FlagDeepMerge, FlagDupReport = CONFLICT_FIRST, false, false
+	defer func() { FlagConflict = CONFLICT_NEWEST }()
+
+	pages := []feedPage{
+		{region: "NA", feed: 0, page: 1, url: "https://a/locations", body: []byte(`{"data": [
+			{"country_code": "US", "party_id": "CPT", "id": "LOC1"},
+			{"country_code": "US", "party_id": "CPT", "id": 2},
+			{"country_code": "US", "party_id": "CPT", "id": "LOC3", "coordinates": "nowhere"},
+			{"country_code": "US", "party_id": "CPT", "id": "LOC4"}]}`)},
+		{region: "NA", feed: 0, page: 2, body: []byte(`{"data": [{"id": "LOC5"}`)},
+		{region: "CA", feed: 1, page: 1, body: []byte(`{"data": [{"country_code": "CA", "party_id": "FLO", "id": "LOC6"}]}`)},
+	}
+	in := make(chan feedPage, len(pages))
+	for _, page := range pages {
+		in <- page
+	}
+	close(in)
+	kept := make(chan []*stationRecord, len(pages))
+	outError := make(chan []byte, 8)
+	filterWorker(newMemoryIndex(4), nil, nil, newKeyGaps(), in, kept, outError, func() {})
+	close(kept)
+	close(outError)
+
+	var got []string
+	for batch := range kept {
+		for _, rec := range batch {
+			got = append(got, fmt.Sprintf("%s %s/%d", dedupeKey(rec), feedLabel(rec), rec.src.index))
+		}
+	}
+	want := []string{"US/CPT/LOC1 NA/0/0", "US/CPT/LOC4 NA/0/3", "CA/FLO/LOC6 CA/1/0"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+
+	var errs []string
+	for msg := range outError {
+		errs = append(errs, string(msg))
+	}
+	if 3 != len(errs) {
+		t.Fatalf("%d errors, want 3: %q", len(errs), errs)
+	}
+	if !strings.HasPrefix(errs[0], "error parsing location 1 of page 1 of feed NA/0 (https://a/locations)") ||
+		!strings.Contains(errs[0], `"id": 2}`) {
+		t.Errorf("error %q, want location 1 and its JSON", errs[0])
+	}
+	if !strings.HasPrefix(errs[1], "error parsing location 2 of page 1") {
+		t.Errorf("error %q, want location 2", errs[1])
+	}
+	if !strings.HasSuffix(errs[2], `{"data": [{"id": "LOC5"}`+"\n") {
+		t.Errorf("error %q, want the bad page", errs[2])
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A geofence is a set of areas, each a polygon with optional holes:
+// either a bounding box given on the command line as
+// minLon,minLat,maxLon,maxLat (GeoJSON bbox order) or the Polygon and
+// MultiPolygon features of a GeoJSON file. A station is inside if its
+// coordinates are inside an outer ring and not inside any of that
+// polygon's holes. A point on a boundary may fall either way.
+
+// geoRing is a closed ring of [longitude, latitude] points
+type geoRing [][2]float64
+
+// geoPolygon is an outer ring and its holes, with the outer ring's bounding box
+type geoPolygon struct {
+	outer          geoRing
+	holes          []geoRing
+	minLon, minLat float64
+	maxLon, maxLat float64
+}
+
+// geoArea is a named geofence feature
+type geoArea struct {
+	name     string
+	polygons []geoPolygon
+}
+
+// geofence is the areas stations are kept in
+type geofence struct {
+	source string
+	areas  []geoArea
+}
+
+// loadGeofence reads a bounding box or a GeoJSON file
+func loadGeofence(spec string) (*geofence, error) {
+	if box, ok := parseBoundingBox(spec); ok {
+		ring := geoRing{{box[0], box[1]}, {box[2], box[1]}, {box[2], box[3]}, {box[0], box[3]}, {box[0], box[1]}}
+		return &geofence{source: spec, areas: []geoArea{{name: "bbox", polygons: []geoPolygon{newGeoPolygon(ring, nil)}}}}, nil
+	}
+
+	txt, err := os.ReadFile(spec)
+	if nil != err {
+		return nil, err
+	}
+	var doc geoJsonObject
+	err = json.Unmarshal(txt, &doc)
+	if nil != err {
+		return nil, fmt.Errorf("parsing GeoJSON %s: %w", spec, err)
+	}
+	gf := &geofence{source: spec}
+	err = gf.addObject(&doc, "")
+	if nil != err {
+		return nil, fmt.Errorf("in GeoJSON %s: %w", spec, err)
+	}
+	if len(gf.areas) <= 0 {
+		return nil, fmt.Errorf("GeoJSON %s has no Polygon or MultiPolygon", spec)
+	}
+	return gf, nil
+}
+
+// parseBoundingBox reads minLon,minLat,maxLon,maxLat
+func parseBoundingBox(spec string) (box [4]float64, ok bool) {
+	parts := strings.Split(spec, ",")
+	if 4 != len(parts) {
+		return box, false
+	}
+	for ix, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if nil != err {
+			return box, false
+		}
+		box[ix] = v
+	}
+	return box, box[0] < box[2] && box[1] < box[3]
+}
+
+// geoJsonObject is the part of any GeoJSON object a geofence needs
+type geoJsonObject struct {
+	Type        string          `json:"type"`
+	Features    []geoJsonObject `json:"features"`
+	Geometry    *geoJsonObject  `json:"geometry"`
+	Geometries  []geoJsonObject `json:"geometries"`
+	Properties  map[string]any  `json:"properties"`
+	ID          any             `json:"id"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// addObject adds the polygons of a GeoJSON object, naming each area
+// by its feature's "name" property, or else its ID
+func (gf *geofence) addObject(obj *geoJsonObject, name string) error {
+	switch obj.Type {
+	case "FeatureCollection":
+		for ix := range obj.Features {
+			if err := gf.addObject(&obj.Features[ix], ""); nil != err {
+				return err
+			}
+		}
+	case "Feature":
+		if nil == obj.Geometry {
+			return nil
+		}
+		if s, ok := obj.Properties["name"].(string); ok && "" != s {
+			name = s
+		} else if nil != obj.ID {
+			name = fmt.Sprint(obj.ID)
+		} else {
+			name = fmt.Sprintf("feature-%d", len(gf.areas)+1)
+		}
+		return gf.addObject(obj.Geometry, name)
+	case "GeometryCollection":
+		for ix := range obj.Geometries {
+			if err := gf.addObject(&obj.Geometries[ix], name); nil != err {
+				return err
+			}
+		}
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &rings); nil != err {
+			return fmt.Errorf("bad Polygon coordinates: %w", err)
+		}
+		polygon, err := polygonFromRings(rings)
+		if nil != err {
+			return err
+		}
+		gf.addPolygons(name, polygon)
+	case "MultiPolygon":
+		var polys [][][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &polys); nil != err {
+			return fmt.Errorf("bad MultiPolygon coordinates: %w", err)
+		}
+		var polygons []geoPolygon
+		for _, rings := range polys {
+			polygon, err := polygonFromRings(rings)
+			if nil != err {
+				return err
+			}
+			polygons = append(polygons, polygon)
+		}
+		gf.addPolygons(name, polygons...)
+	}
+	// points and lines enclose nothing
+	return nil
+}
+
+// addPolygons adds polygons to the named area
+func (gf *geofence) addPolygons(name string, polygons ...geoPolygon) {
+	if "" == name {
+		name = fmt.Sprintf("feature-%d", len(gf.areas)+1)
+	}
+	for ix := range gf.areas {
+		if gf.areas[ix].name == name {
+			gf.areas[ix].polygons = append(gf.areas[ix].polygons, polygons...)
+			return
+		}
+	}
+	gf.areas = append(gf.areas, geoArea{name: name, polygons: polygons})
+}
+
+// polygonFromRings makes a polygon of GeoJSON rings: the outer ring, then holes
+func polygonFromRings(rings [][][]float64) (polygon geoPolygon, err error) {
+	if len(rings) <= 0 {
+		return polygon, fmt.Errorf("polygon without rings")
+	}
+	var converted []geoRing
+	for _, ring := range rings {
+		if len(ring) < 4 {
+			return polygon, fmt.Errorf("polygon ring of %d positions (at least 4 needed)", len(ring))
+		}
+		r := make(geoRing, 0, len(ring))
+		for _, pos := range ring {
+			if len(pos) < 2 {
+				return polygon, fmt.Errorf("position of %d coordinates", len(pos))
+			}
+			r = append(r, [2]float64{pos[0], pos[1]})
+		}
+		converted = append(converted, r)
+	}
+	return newGeoPolygon(converted[0], converted[1:]), nil
+}
+
+func newGeoPolygon(outer geoRing, holes []geoRing) geoPolygon {
+	p := geoPolygon{outer: outer, holes: holes,
+		minLon: outer[0][0], maxLon: outer[0][0], minLat: outer[0][1], maxLat: outer[0][1]}
+	for _, pt := range outer {
+		p.minLon, p.maxLon = min(p.minLon, pt[0]), max(p.maxLon, pt[0])
+		p.minLat, p.maxLat = min(p.minLat, pt[1]), max(p.maxLat, pt[1])
+	}
+	return p
+}
+
+// contains is true if the point is inside the outer ring and no hole
+func (p *geoPolygon) contains(lon float64, lat float64) bool {
+	if lon < p.minLon || lon > p.maxLon || lat < p.minLat || lat > p.maxLat {
+		return false
+	}
+	if !p.outer.contains(lon, lat) {
+		return false
+	}
+	for _, hole := range p.holes {
+		if hole.contains(lon, lat) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains is the even-odd ray casting test
+func (r geoRing) contains(lon float64, lat float64) (inside bool) {
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		xi, yi := r[i][0], r[i][1]
+		xj, yj := r[j][0], r[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// areaOf names the first area containing the point, or "" if none does
+func (gf *geofence) areaOf(lat float64, lon float64) string {
+	for _, area := range gf.areas {
+		for ix := range area.polygons {
+			if area.polygons[ix].contains(lon, lat) {
+				return area.name
+			}
+		}
+	}
+	return ""
+}
+
+// geofenceFilter is the stationStage keeping the stations inside the
+// geofence, tagging each with its area if FlagGeofenceTag is set
+type geofenceFilter struct {
+	gf        *geofence
+	seen      int
+	outside   int
+	unlocated int
+}
+
+func newGeofenceFilter(gf *geofence) *geofenceFilter {
+	return &geofenceFilter{gf: gf}
+}
+
+// process passes on the station if it is inside
+func (gff *geofenceFilter) process(rec *stationRecord) []*stationRecord {
+	gff.seen++
+	lat, lon, ok := stationCoordinates(rec)
+	if !ok {
+		gff.unlocated++
+		return nil
+	}
+	area := gff.gf.areaOf(lat, lon)
+	if "" == area {
+		gff.outside++
+		return nil
+	}
+	if FlagGeofenceTag {
+		rec.Geofence = area
+	}
+	return []*stationRecord{rec}
+}
+
+// flush logs the counts; nothing is held
+func (gff *geofenceFilter) flush() []*stationRecord {
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("geofence %s: %d of %d stations inside (%d areas); %d outside, %d without valid coordinates",
+			gff.gf.source, gff.seen-gff.outside-gff.unlocated, gff.seen, len(gff.gf.areas), gff.outside, gff.unlocated)
+	}
+	return nil
+}
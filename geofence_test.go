@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBoundingBox(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"-123.3,49.0,-122.5,49.4", true},
+		{" -123.3 , 49.0 , -122.5 , 49.4 ", true},
+		{"-122.5,49.0,-123.3,49.4", false}, // min and max swapped
+		{"-123.3,49.0,-122.5", false},
+		{"a,b,c,d", false},
+		{"fence.geojson", false},
+	}
+	for _, tt := range tests {
+		if _, ok := parseBoundingBox(tt.spec); ok != tt.ok {
+			t.Errorf("parseBoundingBox(%q) ok = %v, want %v", tt.spec, ok, tt.ok)
+		}
+	}
+}
+
+func TestPolygonContains(t *testing.T) {
+	// a 10x10 square with a 2x2 hole in the middle
+	square := geoRing{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}
+	hole := geoRing{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}}
+	withHole := newGeoPolygon(square, []geoRing{hole})
+	// an L: the square less its upper right quarter
+	ell := newGeoPolygon(geoRing{{0, 0}, {10, 0}, {10, 5}, {5, 5}, {5, 10}, {0, 10}, {0, 0}}, nil)
+
+	tests := []struct {
+		name     string
+		polygon  geoPolygon
+		lon, lat float64
+		want     bool
+	}{
+		{"inside", withHole, 1, 1, true},
+		{"in the hole", withHole, 5, 5, false},
+		{"beside the hole", withHole, 7, 5, true},
+		{"outside the box", withHole, 11, 5, false},
+		{"below", withHole, 5, -1, false},
+		{"in the L", ell, 2, 8, true},
+		{"in the L's notch", ell, 8, 8, false},
+		{"in the box but not the L", ell, 7, 9, false},
+	}
+	for _, tt := range tests {
+		if got := tt.polygon.contains(tt.lon, tt.lat); got != tt.want {
+			t.Errorf("%s: contains(%g, %g) = %v, want %v", tt.name, tt.lon, tt.lat, got, tt.want)
+		}
+	}
+}
+
+func TestLoadGeofence(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "fence.geojson")
+	doc := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "downtown"},
+		 "geometry": {"type": "Polygon", "coordinates": [
+			[[0,0],[10,0],[10,10],[0,10],[0,0]],
+			[[4,4],[6,4],[6,6],[4,6],[4,4]]]}},
+		{"type": "Feature", "id": 7,
+		 "geometry": {"type": "MultiPolygon", "coordinates": [
+			[[[20,0],[30,0],[30,10],[20,10],[20,0]]],
+			[[[40,0],[50,0],[50,10],[40,10],[40,0]]]]}},
+		{"type": "Feature", "geometry": {"type": "Point", "coordinates": [5,5]}}]}`
+	if err := os.WriteFile(fn, []byte(doc), 0o644); nil != err {
+		t.Fatal(err)
+	}
+	gf, err := loadGeofence(fn)
+	if nil != err {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		lat, lon float64
+		want     string
+	}{
+		{1, 1, "downtown"},
+		{5, 5, ""}, // the hole
+		{5, 25, "7"},
+		{5, 45, "7"},
+		{5, 35, ""},
+	}
+	for _, tt := range tests {
+		if got := gf.areaOf(tt.lat, tt.lon); got != tt.want {
+			t.Errorf("areaOf(%g, %g) = %q, want %q", tt.lat, tt.lon, got, tt.want)
+		}
+	}
+
+	box, err := loadGeofence("-123.3,49.0,-122.5,49.4")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "bbox" != box.areaOf(49.25, -123.1) || "" != box.areaOf(49.5, -123.1) {
+		t.Errorf("bounding box areas wrong")
+	}
+
+	for name, bad := range map[string]string{
+		"points.geojson": `{"type": "Point", "coordinates": [5,5]}`,
+		"short.geojson":  `{"type": "Polygon", "coordinates": [[[0,0],[1,0],[0,0]]]}`,
+		"bad.geojson":    `{"type": "Polygon", "coordinates": "x"}`,
+	} {
+		fn = filepath.Join(dir, name)
+		if err = os.WriteFile(fn, []byte(bad), 0o644); nil != err {
+			t.Fatal(err)
+		}
+		if _, err = loadGeofence(fn); nil == err || !strings.Contains(err.Error(), name) {
+			t.Errorf("loadGeofence(%s): error %v, want one naming the file", name, err)
+		}
+	}
+}
+
+func TestGeofenceFilter(t *testing.T) {
+	gf, err := loadGeofence("-124,49,-122,50")
+	if nil != err {
+		t.Fatal(err)
+	}
+	FlagGeofenceTag = true
+	defer func() { FlagGeofenceTag = false }()
+	gff := newGeofenceFilter(gf)
+	for _, pos := range [][2]string{{"49.25", "-123.1"}, {"48", "-123.1"}, {"", ""}, {"91", "0"}} {
+		rec := testStation("CA", "FLO", "LOC1")
+		rec.Coordinates.Latitude, rec.Coordinates.Longitude = pos[0], pos[1]
+		out := gff.process(rec)
+		inside := "49.25" == pos[0]
+		if (1 == len(out)) != inside {
+			t.Errorf("station at %v passed on %d", pos, len(out))
+		}
+		if inside && "bbox" != rec.Geofence {
+			t.Errorf("station at %v tagged %q, want bbox", pos, rec.Geofence)
+		}
+	}
+	if 4 != gff.seen || 1 != gff.outside || 2 != gff.unlocated {
+		t.Errorf("seen %d, outside %d, unlocated %d; want 4, 1, 2", gff.seen, gff.outside, gff.unlocated)
+	}
+}
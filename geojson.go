@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+// The geojson output format writes stations.geojson, a GeoJSON
+// FeatureCollection of a Point feature per station (or, with
+// --geojsonevses, per EVSE) carrying the --geojsonprops properties.
+// Stations without valid coordinates are not written, and counted.
+
+// FORMAT_GEOJSON is the GeoJSON output format
+const FORMAT_GEOJSON = "geojson"
+
+// GeoJSON properties of a feature
+const (
+	GEO_PROP_ID              = "id"
+	GEO_PROP_NAME            = "name"
+	GEO_PROP_OPERATOR        = "operator"
+	GEO_PROP_ADDRESS         = "address"
+	GEO_PROP_CITY            = "city"
+	GEO_PROP_COUNTRY         = "country"
+	GEO_PROP_CONNECTOR_TYPES = "connector_types" // connector standards, sorted
+	GEO_PROP_MAX_POWER       = "max_power"       // W, of the most powerful connector
+	GEO_PROP_EVSE_COUNT      = "evse_count"
+	GEO_PROP_FEED            = "feed" // region/feed the station came from
+	GEO_PROP_REGION          = "region"
+	GEO_PROP_LAST_UPDATED    = "last_updated"
+)
+
+// geoProperties are the properties that can be written, and how each
+// is found for a station and, per EVSE, its EVSEs (nil for the station)
+var geoProperties = map[string]func(rec *stationRecord, evses []denjson.Evses) any{
+	GEO_PROP_ID:       func(rec *stationRecord, _ []denjson.Evses) any { return rec.ID },
+	GEO_PROP_NAME:     func(rec *stationRecord, _ []denjson.Evses) any { return rec.Name },
+	GEO_PROP_OPERATOR: func(rec *stationRecord, _ []denjson.Evses) any { return rec.Operator.Name },
+	GEO_PROP_ADDRESS:  func(rec *stationRecord, _ []denjson.Evses) any { return rec.Address },
+	GEO_PROP_CITY:     func(rec *stationRecord, _ []denjson.Evses) any { return rec.City },
+	GEO_PROP_COUNTRY:  func(rec *stationRecord, _ []denjson.Evses) any { return rec.Country },
+	GEO_PROP_CONNECTOR_TYPES: func(_ *stationRecord, evses []denjson.Evses) any {
+		return connectorStandards(evses)
+	},
+	GEO_PROP_MAX_POWER: func(_ *stationRecord, evses []denjson.Evses) any {
+		return maxEvsePower(evses)
+	},
+	GEO_PROP_EVSE_COUNT: func(_ *stationRecord, evses []denjson.Evses) any { return len(evses) },
+	GEO_PROP_FEED:       func(rec *stationRecord, _ []denjson.Evses) any { return feedLabel(rec) },
+	GEO_PROP_REGION:     func(rec *stationRecord, _ []denjson.Evses) any { return rec.Region },
+	GEO_PROP_LAST_UPDATED: func(rec *stationRecord, _ []denjson.Evses) any {
+		if rec.LastUpdated.IsZero() {
+			return nil
+		}
+		return rec.LastUpdated
+	},
+}
+
+// checkGeoProperties makes sure every property named is known
+func checkGeoProperties(props []string) error {
+	for _, prop := range props {
+		if _, ok := geoProperties[prop]; !ok {
+			known := make([]string, 0, len(geoProperties))
+			for name := range geoProperties {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown property %s (use %s)", prop, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// connectorStandards lists the connector standards of the EVSEs, sorted
+func connectorStandards(evses []denjson.Evses) []string {
+	seen := make(map[string]struct{}, 4)
+	standards := make([]string, 0, 4)
+	for _, evse := range evses {
+		for _, conn := range evse.Connectors {
+			if _, ok := seen[conn.Standard]; !ok && "" != conn.Standard {
+				seen[conn.Standard] = struct{}{}
+				standards = append(standards, conn.Standard)
+			}
+		}
+	}
+	sort.Strings(standards)
+	return standards
+}
+
+// connectorPower is a connector's power in W: max_electric_power if
+// given, else voltage times amperage, else max_power
+func connectorPower(conn *denjson.Connector) float64 {
+	switch {
+	case conn.MaxElectricPower.IsPositive():
+		return conn.MaxElectricPower.InexactFloat64()
+	case conn.Voltage*conn.Amperage > 0:
+		return float64(conn.Voltage * conn.Amperage)
+	}
+	return math.Max(0, conn.MaxPower.InexactFloat64())
+}
+
+// maxEvsePower is the power in W of the most powerful connector
+func maxEvsePower(evses []denjson.Evses) (power float64) {
+	for ix := range evses {
+		for jx := range evses[ix].Connectors {
+			power = math.Max(power, connectorPower(&evses[ix].Connectors[jx]))
+		}
+	}
+	return power
+}
+
+// geoPoint is a GeoJSON Point, [longitude, latitude]
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// geoFeature is a GeoJSON Feature
+type geoFeature struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id"`
+	Geometry   geoPoint       `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+// geojsonWriter streams a FeatureCollection document
+type geojsonWriter struct {
+	fn        string
+	out       chan []byte
+	needComma bool
+	count     int // stations written
+	features  int
+	unlocated int
+}
+
+func startGeojsonWriter(fn string, out chan []byte) *geojsonWriter {
+	gw := &geojsonWriter{fn: fn, out: out}
+	gw.out <- []byte("{\"type\": \"FeatureCollection\", \"features\": [ ")
+	return gw
+}
+
+// write adds the feature of the station, or of each of its EVSEs
+func (gw *geojsonWriter) write(rec *stationRecord, _ []byte) {
+	lat, lon, ok := stationCoordinates(rec)
+	if !FlagGeojsonEvses {
+		if !ok {
+			gw.unlocated++
+			return
+		}
+		gw.feature(dedupeKey(rec), lat, lon, geoFeatureProperties(rec, rec.Evses))
+		gw.count++
+		return
+	}
+
+	wrote := false
+	for ix := range rec.Evses {
+		evse := &rec.Evses[ix]
+		evseLat, evseLon, evseOk := readCoordinates(evse.Coordinates.Latitude, evse.Coordinates.Longitude)
+		if !evseOk {
+			// an EVSE is where its location is, unless it says otherwise
+			evseLat, evseLon, evseOk = lat, lon, ok
+		}
+		if !evseOk {
+			continue
+		}
+		props := geoFeatureProperties(rec, rec.Evses[ix:ix+1])
+		props["evse_uid"] = evse.UID
+		if "" != evse.EvseID {
+			props["evse_id"] = evse.EvseID
+		}
+		if "" != evse.Status {
+			props["status"] = evse.Status
+		}
+		gw.feature(dedupeKey(rec)+"/"+keyField(evse.UID), evseLat, evseLon, props)
+		wrote = true
+	}
+	if wrote {
+		gw.count++
+	} else if len(rec.Evses) > 0 || !ok {
+		gw.unlocated++
+	}
+}
+
+// geoFeatureProperties are the --geojsonprops of a station, for the EVSEs given
+func geoFeatureProperties(rec *stationRecord, evses []denjson.Evses) map[string]any {
+	props := make(map[string]any, len(FlagGeojsonProps)+3)
+	for _, prop := range FlagGeojsonProps {
+		if value := geoProperties[prop](rec, evses); nil != value && "" != value {
+			props[prop] = value
+		}
+	}
+	return props
+}
+
+func (gw *geojsonWriter) feature(id string, lat float64, lon float64, props map[string]any) {
+	txt, err := json.Marshal(geoFeature{Type: "Feature", ID: id,
+		Geometry:   geoPoint{Type: "Point", Coordinates: [2]float64{lon, lat}},
+		Properties: props})
+	if nil != err {
+		xLog.Printf("error marshalling GeoJSON feature %s: %s", id, err.Error())
+		return
+	}
+	if gw.needComma {
+		gw.out <- []byte(",\n")
+	} else {
+		gw.needComma = true
+	}
+	gw.out <- txt
+	gw.features++
+}
+
+// close finishes the document, logging the stations not written
+func (gw *geojsonWriter) close() {
+	gw.out <- []byte(" ] } ")
+	close(gw.out)
+	if gw.unlocated > 0 {
+		xLog.Printf("%s: %d stations without valid coordinates not written", gw.fn, gw.unlocated)
+	}
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("%s: %d features of %d stations", gw.fn, gw.features, gw.count)
+	}
+}
+
+func (gw *geojsonWriter) written() int {
+	return gw.count
+}
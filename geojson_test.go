@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+	misc "github.com/nathanverrilli/nlvMisc"
+	"github.com/shopspring/decimal"
+)
+
+// writeAll writes the stations with a writer started on a channel,
+// and returns what it wrote
+func writeAll(start func(out chan []byte) recordWriter, recs ...*stationRecord) []byte {
+	out := make(chan []byte, 4)
+	done := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		for txt := range out {
+			buf.Write(txt)
+		}
+		done <- buf.Bytes()
+	}()
+	rw := start(out)
+	for _, rec := range recs {
+		rw.write(rec, nil)
+	}
+	rw.close()
+	return <-done
+}
+
+func TestConnectorPower(t *testing.T) {
+	tests := []struct {
+		conn denjson.Connector
+		want float64
+	}{
+		{denjson.Connector{MaxElectricPower: decimal.NewFromInt(50000), Voltage: 400, Amperage: 10}, 50000},
+		{denjson.Connector{Voltage: 240, Amperage: 32}, 7680},
+		{denjson.Connector{Voltage: 240, MaxPower: decimal.NewFromFloat(3.7)}, 3.7},
+		{denjson.Connector{MaxElectricPower: decimal.NewFromInt(-1), MaxPower: decimal.NewFromInt(-5)}, 0},
+		{denjson.Connector{}, 0},
+	}
+	for _, tt := range tests {
+		if got := connectorPower(&tt.conn); got != tt.want {
+			t.Errorf("connectorPower(%+v) = %g, want %g", tt.conn, got, tt.want)
+		}
+	}
+
+	evses := []denjson.Evses{
+		{Connectors: []denjson.Connector{{Standard: "IEC_62196_T1", Voltage: 240, Amperage: 32}}},
+		{Connectors: []denjson.Connector{{Standard: "CHADEMO", MaxElectricPower: decimal.NewFromInt(50000)},
+			{Standard: "IEC_62196_T1"}, {}}},
+	}
+	if got := maxEvsePower(evses); 50000 != got {
+		t.Errorf("maxEvsePower = %g, want 50000", got)
+	}
+	if got := connectorStandards(evses); !reflect.DeepEqual(got, []string{"CHADEMO", "IEC_62196_T1"}) {
+		t.Errorf("connectorStandards = %q", got)
+	}
+	if nil != checkGeoProperties([]string{GEO_PROP_ID, GEO_PROP_MAX_POWER}) || nil == checkGeoProperties([]string{"colour"}) {
+		t.Errorf("checkGeoProperties accepts the wrong properties")
+	}
+}
+
+func TestGeojsonWriter(t *testing.T) {
+	defer func() { FlagGeojsonProps, FlagGeojsonEvses = nil, false }()
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagGeojsonProps = []string{GEO_PROP_NAME, GEO_PROP_CITY, GEO_PROP_EVSE_COUNT}
+
+	located := testStation("US", "CPT", "LOC1")
+	located.Name = "Depot"
+	located.Coordinates = denjson.GeoLocation{Latitude: "49.25", Longitude: "-123.1"}
+	located.Evses = []denjson.Evses{
+		{UID: "E/1", Status: "AVAILABLE"},
+		{UID: "E2", Coordinates: denjson.GeoLocation{Latitude: "49.3", Longitude: "-123.2"}},
+	}
+	unlocated := testStation("US", "CPT", "LOC2")
+	unlocated.Coordinates = denjson.GeoLocation{Latitude: "91", Longitude: "0"}
+	evseOnly := testStation("US", "CPT", "LOC3")
+	evseOnly.Evses = []denjson.Evses{{UID: "1", Coordinates: denjson.GeoLocation{Latitude: "1", Longitude: "2"}}}
+
+	tests := []struct {
+		evses bool
+		ids   []string
+		props []map[string]any
+		geo   [][2]float64
+	}{
+		{false, []string{"US/CPT/LOC1"},
+			[]map[string]any{{"name": "Depot", "evse_count": 2.0}},
+			[][2]float64{{-123.1, 49.25}}},
+		{true, []string{"US/CPT/LOC1/E%2F1", "US/CPT/LOC1/E2", "US/CPT/LOC3/1"},
+			[]map[string]any{
+				{"name": "Depot", "evse_count": 1.0, "evse_uid": "E/1", "status": "AVAILABLE"},
+				{"name": "Depot", "evse_count": 1.0, "evse_uid": "E2"},
+				{"evse_count": 1.0, "evse_uid": "1"}},
+			[][2]float64{{-123.1, 49.25}, {-123.2, 49.3}, {2, 1}}},
+	}
+	for _, tt := range tests {
+		FlagGeojsonEvses = tt.evses
+		var gw *geojsonWriter
+		txt := writeAll(func(out chan []byte) recordWriter {
+			gw = startGeojsonWriter("stations.geojson", out)
+			return gw
+		}, located, unlocated, evseOnly)
+
+		var fc struct {
+			Type     string       `json:"type"`
+			Features []geoFeature `json:"features"`
+		}
+		if err := json.Unmarshal(txt, &fc); nil != err {
+			t.Fatalf("evses %v: %s in %s", tt.evses, err.Error(), txt)
+		}
+		if "FeatureCollection" != fc.Type || len(fc.Features) != len(tt.ids) {
+			t.Fatalf("evses %v: %s", tt.evses, txt)
+		}
+		for ix, f := range fc.Features {
+			if f.ID != tt.ids[ix] || f.Geometry.Coordinates != tt.geo[ix] || !reflect.DeepEqual(f.Properties, tt.props[ix]) {
+				t.Errorf("evses %v: feature %d is %+v", tt.evses, ix, f)
+			}
+		}
+		wantCount, wantUnlocated := 1, 2
+		if tt.evses {
+			wantCount, wantUnlocated = 2, 1
+		}
+		if gw.written() != wantCount || gw.unlocated != wantUnlocated {
+			t.Errorf("evses %v: %d stations written, %d unlocated", tt.evses, gw.written(), gw.unlocated)
+		}
+	}
+}
+
+// TestStationOutputCount checks that stations left out of a format,
+// as GeoJSON leaves out stations without coordinates, are still counted
+func TestStationOutputCount(t *testing.T) {
+	defer misc.OptionOutputDir(misc.OptionOutputDir(t.TempDir()))
+	defer func() { FlagOutputFormat = []string{FORMAT_JSON} }()
+	FlagOutputFormat = []string{FORMAT_GEOJSON, FORMAT_JSON}
+
+	so := &stationOutput{regionCount: make(map[string]int, 1)}
+	so.stationOut = newRecordWriters("stations", &so.wg)
+	so.emit(testStation("US", "CPT", "LOC1"))
+	for _, rw := range so.stationOut {
+		rw.close()
+	}
+	so.wg.Wait()
+	if 1 != so.count || 0 != so.stationOut[0].written() || 1 != so.stationOut[1].written() {
+		t.Errorf("counted %d stations, geojson wrote %d, json %d; want 1, 0, 1",
+			so.count, so.stationOut[0].written(), so.stationOut[1].written())
+	}
+}
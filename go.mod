@@ -8,7 +8,7 @@ require (
 	github.com/spf13/pflag v1.0.10
 )
 
-require github.com/shopspring/decimal v1.4.0 // indirect
+require github.com/shopspring/decimal v1.4.0
 
 // use local versions of these packages
 // replace github.com/nathanverrilli/denJson v0.1.0 => ../denJson
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+const HEALTHCHECK_TIMEOUT = 15 * time.Second
+const CERT_WARN_DAYS = 14
+
+// healthResult is the outcome of checking one endpoint. Latencies
+// are in milliseconds; a phase that was not reached has zero latency.
+type healthResult struct {
+	Region     string    `json:"region"`
+	Base       string    `json:"baseUrl"`
+	Required   bool      `json:"required"`
+	Healthy    bool      `json:"healthy"`
+	DnsMs      int64     `json:"dnsMs"`
+	TcpMs      int64     `json:"tcpMs"`
+	TlsMs      int64     `json:"tlsMs,omitempty"`
+	RequestMs  int64     `json:"requestMs"`
+	CertExpiry time.Time `json:"certExpiry,omitzero"`
+	HttpStatus int       `json:"httpStatus,omitempty"`
+	OcpiStatus int       `json:"ocpiStatus,omitempty"`
+	TotalCount int       `json:"xTotalCount"`
+	Warning    string    `json:"warning,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Health check report formats
+const (
+	HEALTH_FORMAT_TABLE = "table"
+	HEALTH_FORMAT_JSON  = "json"
+)
+
+// checkHealthFormat makes sure the report format is known
+func checkHealthFormat(format string) error {
+	switch strings.ToLower(format) {
+	case HEALTH_FORMAT_TABLE, HEALTH_FORMAT_JSON:
+		return nil
+	}
+	return fmt.Errorf("unknown health check format %s (use %s or %s)", format, HEALTH_FORMAT_TABLE, HEALTH_FORMAT_JSON)
+}
+
+// healthCheck checks every endpoint concurrently -- DNS, TCP, TLS and an
+// authenticated request for a single location -- and writes a report to
+// stdout as a table or JSON. Returns the program exit code: 0 when
+// all required endpoints are healthy, 1 otherwise, and -1 for an
+// unknown format, which is rejected before any endpoint is checked.
+func healthCheck(endpoints []endPoint, format string) (rc int) {
+	err := checkHealthFormat(format)
+	if nil != err {
+		xLog.Printf("%s", err.Error())
+		return -1
+	}
+
+	var wg sync.WaitGroup
+	results := make([]healthResult, len(endpoints))
+
+	for ix := range endpoints {
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			results[ix] = checkEndpoint(&endpoints[ix])
+		}(ix)
+	}
+	wg.Wait()
+
+	if HEALTH_FORMAT_JSON == strings.ToLower(format) {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	} else {
+		err = writeHealthTable(os.Stdout, results)
+	}
+	if nil != err {
+		xLog.Printf("error writing health check report: %s", err.Error())
+	}
+
+	for _, hr := range results {
+		if !hr.Healthy {
+			xLog.Printf("endpoint %s (region %s) is unhealthy: %s", hr.Base, hr.Region, hr.Error)
+			if hr.Required {
+				rc = 1
+			}
+		} else if FlagVerbose {
+			xLog.Printf("endpoint %s (region %s) is healthy", hr.Base, hr.Region)
+		}
+	}
+	return rc
+}
+
+// checkEndpoint runs each phase of the check in turn, stopping
+// at the first phase that fails.
+func checkEndpoint(ep *endPoint) (hr healthResult) {
+	hr.Region = ep.Region
+	hr.Base = ep.Base
+	hr.Required = !ep.Optional
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), HEALTHCHECK_TIMEOUT)
+	defer cancelFunc()
+
+	u, err := url.Parse(ep.Base)
+	if nil != err {
+		hr.Error = "bad base URL: " + err.Error()
+		return hr
+	}
+	port := u.Port()
+	if !misc.IsStringSet(&port) {
+		port = "443"
+		if "http" == u.Scheme {
+			port = "80"
+		}
+	}
+
+	// DNS
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	hr.DnsMs = time.Since(start).Milliseconds()
+	if nil != err {
+		hr.Error = "dns: " + err.Error()
+		return hr
+	}
+	if len(addrs) <= 0 {
+		hr.Error = "dns: no addresses for " + u.Hostname()
+		return hr
+	}
+
+	// TCP
+	var dialer net.Dialer
+	start = time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0], port))
+	hr.TcpMs = time.Since(start).Milliseconds()
+	if nil != err {
+		hr.Error = "tcp: " + err.Error()
+		return hr
+	}
+
+	// TLS
+	if "https" == u.Scheme {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: FlagDestInsecure,
+		})
+		start = time.Now()
+		err = tlsConn.HandshakeContext(ctx)
+		hr.TlsMs = time.Since(start).Milliseconds()
+		if nil != err {
+			_ = conn.Close()
+			hr.Error = "tls: " + err.Error()
+			return hr
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			hr.CertExpiry = certs[0].NotAfter
+			if time.Now().After(hr.CertExpiry) {
+				_ = tlsConn.Close()
+				hr.Error = "tls: certificate expired " + hr.CertExpiry.Format(time.RFC3339)
+				return hr
+			}
+			if time.Until(hr.CertExpiry) < CERT_WARN_DAYS*24*time.Hour {
+				hr.Warning = "certificate expires " + hr.CertExpiry.Format(time.RFC3339)
+			}
+		}
+		conn = tlsConn
+	}
+	_ = conn.Close()
+
+	// authenticated minimal request
+	probe := *ep
+	probe.PageSize = 1
+	probeUrl, err := probe.moduleUrl(LOCATIONS_MODULE)
+	if nil != err {
+		hr.Error = "request: " + err.Error()
+		return hr
+	}
+	start = time.Now()
+	err = probeRequest(ctx, ep, probeUrl, &hr)
+	hr.RequestMs = time.Since(start).Milliseconds()
+	if nil != err {
+		hr.Error = "request: " + err.Error()
+		return hr
+	}
+
+	hr.Healthy = true
+	return hr
+}
+
+// probeRequest makes a single request (no retries) and records the
+// HTTP status, the OCPI status code of the body and X-Total-Count.
+// OCPI success codes are 1000-1999; feeds that omit the status
+// code are accepted on the strength of the HTTP status.
+func probeRequest(ctx context.Context, ep *endPoint, probeUrl string, hr *healthResult) error {
+	hReq, err := http.NewRequestWithContext(ctx, http.MethodGet, probeUrl, nil)
+	if nil != err {
+		return err
+	}
+	for key, val := range headers {
+		hReq.Header.Set(key, val)
+	}
+	for key, val := range ep.Headers {
+		hReq.Header.Set(key, val)
+	}
+	hReq.Header.Set("Authorization", ep.Token)
+
+	resp, err := hc.Do(hReq)
+	if nil != err {
+		return err
+	}
+	defer misc.DeferError(resp.Body.Close)
+	hr.HttpStatus = resp.StatusCode
+
+	body, err := io.ReadAll(resp.Body)
+	if nil != err {
+		return err
+	}
+	xCountHeader := resp.Header.Get("X-Total-Count")
+	if misc.IsStringSet(&xCountHeader) {
+		hr.TotalCount, err = strconv.Atoi(xCountHeader)
+		if nil != err {
+			return fmt.Errorf("bad X-Total-Count header %s", xCountHeader)
+		}
+	}
+	if http.StatusOK != resp.StatusCode {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	var status struct {
+		StatusCode    int    `json:"status_code"`
+		StatusMessage string `json:"status_message"`
+	}
+	err = json.Unmarshal(body, &status)
+	if nil != err {
+		return fmt.Errorf("response is not JSON: %s", err.Error())
+	}
+	hr.OcpiStatus = status.StatusCode
+	if 0 != status.StatusCode && (status.StatusCode < 1000 || status.StatusCode > 1999) {
+		return fmt.Errorf("OCPI status %d %s", status.StatusCode, status.StatusMessage)
+	}
+	return nil
+}
+
+// writeHealthTable writes the results as an aligned text table
+func writeHealthTable(w io.Writer, results []healthResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "REGION\tBASE URL\tREQUIRED\tHEALTHY\tDNS ms\tTCP ms\tTLS ms\tREQ ms\tCERT EXPIRY\tHTTP\tOCPI\tX-TOTAL-COUNT\tNOTE")
+	for _, hr := range results {
+		expiry := "-"
+		if !hr.CertExpiry.IsZero() {
+			expiry = hr.CertExpiry.Format("2006-01-02")
+		}
+		note := hr.Error
+		if !misc.IsStringSet(&note) {
+			note = hr.Warning
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%t\t%t\t%d\t%d\t%d\t%d\t%s\t%d\t%d\t%d\t%s\n",
+			hr.Region, hr.Base, hr.Required, hr.Healthy,
+			hr.DnsMs, hr.TcpMs, hr.TlsMs, hr.RequestMs,
+			expiry, hr.HttpStatus, hr.OcpiStatus, hr.TotalCount, note)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		totalCount string
+		body       string
+		wantErr    bool
+		wantOcpi   int
+		wantTotal  int
+	}{
+		{"healthy", http.StatusOK, "25", `{"status_code": 1000, "data": []}`, false, 1000, 25},
+		{"no OCPI status", http.StatusOK, "", `{"data": []}`, false, 0, 0},
+		{"OCPI client error", http.StatusOK, "0", `{"status_code": 2001, "status_message": "invalid"}`, true, 2001, 0},
+		{"HTTP error", http.StatusUnauthorized, "", `{}`, true, 0, 0},
+		{"not JSON", http.StatusOK, "", `<html>`, true, 0, 0},
+		{"bad X-Total-Count", http.StatusOK, "many", `{"status_code": 1000}`, true, 0, 0},
+	}
+	for _, tt := range tests {
+		var gotAuth string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotAuth = r.Header.Get("Authorization")
+			if "" != tt.totalCount {
+				w.Header().Set("X-Total-Count", tt.totalCount)
+			}
+			w.WriteHeader(tt.status)
+			_, _ = w.Write([]byte(tt.body))
+		}))
+
+		ep := endPoint{Base: server.URL, Token: "Token abc"}
+		var hr healthResult
+		err := probeRequest(context.Background(), &ep, server.URL+"/locations?limit=1", &hr)
+		server.Close()
+
+		if tt.wantErr != (nil != err) {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if hr.HttpStatus != tt.status || hr.OcpiStatus != tt.wantOcpi || hr.TotalCount != tt.wantTotal {
+			t.Errorf("%s: HTTP %d OCPI %d total %d, want %d %d %d", tt.name,
+				hr.HttpStatus, hr.OcpiStatus, hr.TotalCount, tt.status, tt.wantOcpi, tt.wantTotal)
+		}
+		if "Token abc" != gotAuth {
+			t.Errorf("%s: Authorization %q", tt.name, gotAuth)
+		}
+	}
+}
+
+func TestHealthCheckFormat(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		format  string
+		wantErr bool
+	}{{"table", false}, {"JSON", false}, {"yaml", true}, {"", true}} {
+		if err := checkHealthFormat(tt.format); tt.wantErr != (nil != err) {
+			t.Errorf("checkHealthFormat(%q): error %v", tt.format, err)
+		}
+	}
+	if rc := healthCheck([]endPoint{{Region: "NA", Base: server.URL + "/"}}, "yaml"); -1 != rc || 0 != hits {
+		t.Errorf("healthCheck with an unknown format returned %d after %d requests, want -1 after none", rc, hits)
+	}
+}
+
+func TestWriteHealthTable(t *testing.T) {
+	var sb strings.Builder
+	err := writeHealthTable(&sb, []healthResult{
+		{Region: "NA", Base: "https://na.example/", Required: true, Healthy: true, HttpStatus: 200, OcpiStatus: 1000},
+		{Region: "CA", Base: "https://ca.example/", Required: false, Error: "dns: no such host"},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if 3 != len(lines) {
+		t.Fatalf("got %d lines, want a header and 2 rows:\n%s", len(lines), sb.String())
+	}
+	if !strings.HasSuffix(lines[2], "dns: no such host") {
+		t.Errorf("unhealthy row does not end with its error: %q", lines[2])
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// defaultStationsFile is the file written by run and merge
+var defaultStationsFile = filepath.Join(DEFAULT_OUTPUT_DIR, "stations.json")
+
+// loadStationsFile reads a stations file as written by filterJsonPage,
+// in any output format
+func loadStationsFile(fn string) (stations []stationRecord, err error) {
+	raw, err := readStationsRaw(fn)
+	if nil != err {
+		return nil, err
+	}
+	stations = make([]stationRecord, len(raw))
+	for ix := range raw {
+		err = json.Unmarshal(raw[ix], &stations[ix])
+		if nil != err {
+			return nil, fmt.Errorf("error parsing station %d of stations file %s: %s", ix, fn, err.Error())
+		}
+	}
+	return stations, nil
+}
+
+// stationsFileArg is the stations file named by the arguments,
+// or the default stations file when none is named.
+func stationsFileArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return defaultStationsFile
+}
+
+// validateCommand checks that the endpoints file loads and that a
+// request URL can be built for every endpoint, then that each
+// stations file named parses and every station has an ID, and with
+// --schema that every station is valid OCPI.
+func validateCommand(args []string) (rc int) {
+	endpoints := loadEndpoints(FlagAuthTokenFile)
+	seen := make(map[string]int, len(endpoints))
+	for ix := range endpoints {
+		firstUrl, err := endpoints[ix].moduleUrl(LOCATIONS_MODULE)
+		if nil != err {
+			xLog.Printf("endpoint %d: %s", ix, err.Error())
+			rc = 1
+			continue
+		}
+		if prev, ok := seen[firstUrl]; ok {
+			xLog.Printf("warning: endpoints %d and %d both request %s", prev, ix, firstUrl)
+		}
+		seen[firstUrl] = ix
+	}
+	xLog.Printf("endpoints file %s: %d endpoints", FlagAuthTokenFile, len(endpoints))
+
+	for _, fn := range args {
+		stations, err := loadStationsFile(fn)
+		if nil != err {
+			xLog.Printf("%s", err.Error())
+			rc = 1
+			continue
+		}
+		missingId := 0
+		for ix := range stations {
+			if "" == stations[ix].ID {
+				missingId++
+			}
+		}
+		if missingId > 0 {
+			xLog.Printf("stations file %s: %d of %d stations have no id", fn, missingId, len(stations))
+			rc = 1
+		} else {
+			xLog.Printf("stations file %s: %d stations", fn, len(stations))
+		}
+		if "" != FlagSchema && 0 != validateStationsSchema(fn) {
+			rc = 1
+		}
+	}
+	if 0 == rc {
+		xLog.Printf("valid")
+	}
+	return rc
+}
+
+// validateStationsSchema checks every station of a stations file
+// against the OCPI schema, logging the violations of each invalid one
+func validateStationsSchema(fn string) (rc int) {
+	raw, err := readStationsRaw(fn)
+	if nil != err {
+		xLog.Printf("%s", err.Error())
+		return 1
+	}
+	invalid := 0
+	for ix := range raw {
+		violations := validateRawLocation(raw[ix], FlagSchema)
+		if len(violations) > 0 {
+			invalid++
+			xLog.Printf("stations file %s: station %d is not valid OCPI %s:\n\t%s",
+				fn, ix, FlagSchema, strings.Join(violations, "\n\t"))
+		}
+	}
+	xLog.Printf("stations file %s: %d of %d stations are not valid OCPI %s", fn, invalid, len(raw), FlagSchema)
+	if invalid > 0 {
+		return 1
+	}
+	return 0
+}
+
+// diffCommand compares two stations files by dedupe key, counting
+// stations added, removed and changed. Exits 1 if they differ.
+func diffCommand(args []string) (rc int) {
+	if 2 != len(args) {
+		xLog.Printf("diff needs two stations files (old and new), got %d", len(args))
+		return -1
+	}
+	oldStations, err := stationsByKey(args[0])
+	if nil != err {
+		xLog.Printf("%s", err.Error())
+		return -1
+	}
+	newStations, err := stationsByKey(args[1])
+	if nil != err {
+		xLog.Printf("%s", err.Error())
+		return -1
+	}
+
+	var added, removed, changed []string
+	unchanged := 0
+	for key, newTxt := range newStations {
+		oldTxt, ok := oldStations[key]
+		if !ok {
+			added = append(added, key)
+		} else if !bytes.Equal(oldTxt, newTxt) {
+			changed = append(changed, key)
+		} else {
+			unchanged++
+		}
+	}
+	for key := range oldStations {
+		if _, ok := newStations[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	if FlagDiffList {
+		for _, list := range []struct {
+			mark string
+			keys []string
+		}{{"+", added}, {"-", removed}, {"~", changed}} {
+			sort.Strings(list.keys)
+			for _, key := range list.keys {
+				_, _ = fmt.Fprintf(os.Stdout, "%s %s\n", list.mark, key)
+			}
+		}
+	}
+	xLog.Printf("%s -> %s: %d added, %d removed, %d changed, %d unchanged",
+		args[0], args[1], len(added), len(removed), len(changed), unchanged)
+	if len(added)+len(removed)+len(changed) > 0 {
+		rc = 1
+	}
+	return rc
+}
+
+// stationsByKey loads a stations file, mapping each station's
+// dedupe key to the station's JSON for comparison.
+func stationsByKey(fn string) (byKey map[string][]byte, err error) {
+	stations, err := loadStationsFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	byKey = make(map[string][]byte, len(stations))
+	for ix := range stations {
+		txt, err := json.Marshal(stations[ix])
+		if nil != err {
+			return nil, err
+		}
+		byKey[dedupeKey(&stations[ix])] = txt
+	}
+	return byKey, nil
+}
+
+// statsCommand writes a summary of a stations file to stdout
+func statsCommand(args []string) int {
+	fn := stationsFileArg(args)
+	stations, err := loadStationsFile(fn)
+	if nil != err {
+		xLog.Printf("%s", err.Error())
+		return -1
+	}
+
+	evseCount, connectorCount := 0, 0
+	byRegion := make(map[string]int, 4)
+	byCountry := make(map[string]int, 4)
+	byStandard := make(map[string]int, 8)
+	byPowerType := make(map[string]int, 4)
+	for ix := range stations {
+		byRegion[stations[ix].Region]++
+		byCountry[stations[ix].Country]++
+		evseCount += len(stations[ix].Evses)
+		for _, evse := range stations[ix].Evses {
+			connectorCount += len(evse.Connectors)
+			for _, conn := range evse.Connectors {
+				byStandard[conn.Standard]++
+				byPowerType[conn.PowerType]++
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "file\t%s\n", fn)
+	_, _ = fmt.Fprintf(tw, "locations\t%d\n", len(stations))
+	_, _ = fmt.Fprintf(tw, "evses\t%d\n", evseCount)
+	_, _ = fmt.Fprintf(tw, "connectors\t%d\n", connectorCount)
+	writeCounts(tw, "region", byRegion)
+	writeCounts(tw, "country", byCountry)
+	writeCounts(tw, "connector standard", byStandard)
+	writeCounts(tw, "connector power type", byPowerType)
+	err = tw.Flush()
+	if nil != err {
+		xLog.Printf("error writing stats: %s", err.Error())
+		return -1
+	}
+	return 0
+}
+
+// writeCounts writes a heading then one line per key, sorted by key
+func writeCounts(w io.Writer, heading string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	_, _ = fmt.Fprintf(w, "\nby %s\t\n", heading)
+	for _, key := range keys {
+		label := key
+		if "" == label {
+			label = "(none)"
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%d\n", label, counts[key])
+	}
+}
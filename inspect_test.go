@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStationsFileArg(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, defaultStationsFile},
+		{[]string{"a.json"}, "a.json"},
+		{[]string{"a.json", "b.json"}, "a.json"},
+	}
+	for _, tt := range tests {
+		if got := stationsFileArg(tt.args); got != tt.want {
+			t.Errorf("stationsFileArg(%v) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWriteCounts(t *testing.T) {
+	tests := []struct {
+		counts map[string]int
+		want   string
+	}{
+		{map[string]int{}, "\nby region\t\n"},
+		{map[string]int{"NA": 2, "CA": 1}, "\nby region\t\n  CA\t1\n  NA\t2\n"},
+		{map[string]int{"": 3, "US": 1}, "\nby region\t\n  (none)\t3\n  US\t1\n"},
+	}
+	for _, tt := range tests {
+		var sb strings.Builder
+		writeCounts(&sb, "region", tt.counts)
+		if sb.String() != tt.want {
+			t.Errorf("writeCounts(%v) = %q, want %q", tt.counts, sb.String(), tt.want)
+		}
+	}
+}
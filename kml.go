@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	denjson "github.com/nathanverrilli/denJson"
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+// The kml output format writes stations.kml, for Google Earth and
+// other mapping tools: a placemark per location with valid
+// coordinates, its balloon summarizing the location's EVSEs,
+// connectors and power, in a folder per operator or region
+// (--kmlfolders), styled by the standard of its most powerful
+// connector. Folders are written whole, so placemarks are sorted into
+// their folders with a runSorter as they arrive, spilling to disk
+// past a quarter of --memlimit, and written out once the last station
+// is in.
+
+// FORMAT_KML is the KML output format
+const FORMAT_KML = "kml"
+
+// KML folder groupings
+const (
+	KML_FOLDERS_OPERATOR = "operator"
+	KML_FOLDERS_REGION   = "region"
+	KML_FOLDERS_NONE     = "none"
+)
+
+// KML_NO_FOLDER names the folder of stations without an operator or region
+const KML_NO_FOLDER = "(none)"
+
+// KML_STYLE_OTHER is the style of stations without connectors
+const KML_STYLE_OTHER = "connector-other"
+
+// kmlStandardColors are the icon colors (KML aabbggrr) of the common
+// connector standards; others get a color from their name
+var kmlStandardColors = map[string]string{
+	"CHADEMO":            "ff00a5ff", // orange
+	"IEC_62196_T1":       "ffff901e", // blue
+	"IEC_62196_T1_COMBO": "ff8b0000", // dark blue
+	"IEC_62196_T2":       "ff32cd32", // green
+	"IEC_62196_T2_COMBO": "ff006400", // dark green
+	"TESLA_R":            "ff3c14dc", // red
+	"TESLA_S":            "ff0000b2", // dark red
+	"DOMESTIC_A":         "ffd3d3d3", // grey
+	"DOMESTIC_B":         "ffd3d3d3",
+}
+
+// checkKmlFolders makes sure the folder grouping is known
+func checkKmlFolders(folders string) error {
+	switch folders {
+	case KML_FOLDERS_OPERATOR, KML_FOLDERS_REGION, KML_FOLDERS_NONE:
+		return nil
+	}
+	return fmt.Errorf("unknown KML folders %s (use %s, %s or %s)",
+		folders, KML_FOLDERS_OPERATOR, KML_FOLDERS_REGION, KML_FOLDERS_NONE)
+}
+
+// kmlStyleId is the style of a connector standard
+func kmlStyleId(standard string) string {
+	if "" == standard {
+		return KML_STYLE_OTHER
+	}
+	return "connector-" + strings.Map(func(r rune) rune {
+		if ('A' <= r && r <= 'Z') || ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') || '_' == r {
+			return r
+		}
+		return '_'
+	}, standard)
+}
+
+// kmlColor is the icon color of a connector standard
+func kmlColor(standard string) string {
+	if color, ok := kmlStandardColors[standard]; ok {
+		return color
+	}
+	if "" == standard {
+		return "ff808080"
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(standard))
+	return fmt.Sprintf("ff%06x", h.Sum32()&0xffffff)
+}
+
+// kmlWriter sorts the placemarks into their folders, in the order they
+// arrive, writing the document on close
+type kmlWriter struct {
+	fn         string
+	out        chan []byte
+	placemarks *runSorter // keyed by folder
+	seq        uint64
+	standards  map[string]struct{}
+	count      int
+	unlocated  int
+}
+
+// startKmlWriter sorts placemarks in a new directory under
+// FlagIndexDir, removed when the program ends
+func startKmlWriter(fn string, out chan []byte) *kmlWriter {
+	dir, err := os.MkdirTemp(FlagIndexDir, "mergeFeeds-kml-")
+	if nil != err {
+		xLog.Printf("error making a directory to sort %s in because %s", fn, err.Error())
+		myFatal(-3)
+	}
+	misc.AtClose(func() { _ = os.RemoveAll(dir) })
+	return &kmlWriter{fn: fn, out: out,
+		placemarks: newRunSorter(dir, FlagMemLimit<<20/4),
+		standards:  make(map[string]struct{}, 8)}
+}
+
+// xmlText escapes text for XML
+func xmlText(s string) string {
+	var sb strings.Builder
+	_ = xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+// primaryStandard is the standard of the most powerful connector
+func primaryStandard(evses []denjson.Evses) (standard string) {
+	best := -1.0
+	for ix := range evses {
+		for jx := range evses[ix].Connectors {
+			conn := &evses[ix].Connectors[jx]
+			if power := connectorPower(conn); power > best {
+				best, standard = power, conn.Standard
+			}
+		}
+	}
+	return standard
+}
+
+// kmlFolder is the folder a station goes in
+func kmlFolder(rec *stationRecord) string {
+	var folder string
+	switch FlagKmlFolders {
+	case KML_FOLDERS_OPERATOR:
+		folder = rec.Operator.Name
+	case KML_FOLDERS_REGION:
+		folder = rec.Region
+	}
+	if "" == strings.TrimSpace(folder) {
+		return KML_NO_FOLDER
+	}
+	return folder
+}
+
+// write adds the placemark of a station to its folder
+func (kw *kmlWriter) write(rec *stationRecord, _ []byte) {
+	lat, lon, ok := stationCoordinates(rec)
+	if !ok {
+		kw.unlocated++
+		return
+	}
+	standard := primaryStandard(rec.Evses)
+	kw.standards[standard] = struct{}{}
+
+	name := rec.Name
+	if "" == name {
+		name = rec.ID
+	}
+	buf := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(buf, "<Placemark>\n<name>%s</name>\n<styleUrl>#%s</styleUrl>\n",
+		xmlText(name), kmlStyleId(standard))
+	_, _ = fmt.Fprintf(buf, "<description><![CDATA[%s]]></description>\n", kmlDescription(rec))
+	// the key has slashes, so it is data rather than the placemark's XML id
+	_, _ = fmt.Fprintf(buf, "<ExtendedData><Data name=\"key\"><value>%s</value></Data>"+
+		"<Data name=\"feed\"><value>%s</value></Data></ExtendedData>\n",
+		xmlText(dedupeKey(rec)), xmlText(feedLabel(rec)))
+	_, _ = fmt.Fprintf(buf, "<Point><coordinates>%s,%s,0</coordinates></Point>\n</Placemark>\n",
+		strconv.FormatFloat(lon, 'f', -1, 64), strconv.FormatFloat(lat, 'f', -1, 64))
+	kw.seq++
+	err := kw.placemarks.add(sortEntry{key: kmlFolder(rec), seq: kw.seq, data: buf.Bytes()})
+	if nil != err {
+		xLog.Printf("error sorting a placemark of %s because %s", kw.fn, err.Error())
+		myFatal(-3)
+	}
+	kw.count++
+}
+
+// kmlDescription is the balloon of a station: its address, then a
+// table of its EVSEs and their connectors
+func kmlDescription(rec *stationRecord) string {
+	var sb strings.Builder
+	e := html.EscapeString
+	address := strings.TrimSpace(strings.Join([]string{rec.Address, rec.City, rec.PostalCode, rec.Country}, " "))
+	if "" != address {
+		sb.WriteString("<p>" + e(address) + "</p>")
+	}
+	if "" != rec.Operator.Name {
+		sb.WriteString("<p>Operator: " + e(rec.Operator.Name) + "</p>")
+	}
+	connectors := 0
+	for _, evse := range rec.Evses {
+		connectors += len(evse.Connectors)
+	}
+	sb.WriteString(fmt.Sprintf("<p>%d EVSEs, %d connectors, max %s kW</p>",
+		len(rec.Evses), connectors, kmlKw(maxEvsePower(rec.Evses))))
+	if len(rec.Evses) > 0 {
+		sb.WriteString("<table><tr><th>EVSE</th><th>Status</th><th>Connector</th><th>Format</th><th>kW</th></tr>")
+		for _, evse := range rec.Evses {
+			id := evse.EvseID
+			if "" == id {
+				id = evse.UID
+			}
+			if len(evse.Connectors) <= 0 {
+				sb.WriteString("<tr><td>" + e(id) + "</td><td>" + e(evse.Status) + "</td><td></td><td></td><td></td></tr>")
+			}
+			for jx := range evse.Connectors {
+				conn := &evse.Connectors[jx]
+				sb.WriteString("<tr><td>" + e(id) + "</td><td>" + e(evse.Status) + "</td><td>" + e(conn.Standard) +
+					"</td><td>" + e(conn.Format) + "</td><td>" + kmlKw(connectorPower(conn)) + "</td></tr>")
+			}
+		}
+		sb.WriteString("</table>")
+	}
+	return sb.String()
+}
+
+// kmlKw is power in W as kW
+func kmlKw(w float64) string {
+	if w <= 0 {
+		return "?"
+	}
+	return strconv.FormatFloat(w/1000, 'f', -1, 64)
+}
+
+// close writes the document: the styles of the standards seen, then
+// the folders in name order
+func (kw *kmlWriter) close() {
+	defer close(kw.out)
+	kw.out <- []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n<Document>\n<name>stations</name>\n")
+
+	standards := make([]string, 0, len(kw.standards))
+	for standard := range kw.standards {
+		standards = append(standards, standard)
+	}
+	sort.Strings(standards)
+	for _, standard := range standards {
+		kw.out <- []byte(fmt.Sprintf("<Style id=\"%s\"><IconStyle><color>%s</color></IconStyle></Style>\n",
+			kmlStyleId(standard), kmlColor(standard)))
+	}
+
+	folder, folders := "", 0
+	err := kw.placemarks.each(func(e *sortEntry) error {
+		if KML_FOLDERS_NONE != FlagKmlFolders && (0 == folders || e.key != folder) {
+			if folders > 0 {
+				kw.out <- []byte("</Folder>\n")
+			}
+			kw.out <- []byte("<Folder>\n<name>" + xmlText(e.key) + "</name>\n")
+			folder = e.key
+			folders++
+		}
+		kw.out <- e.data
+		return nil
+	})
+	if nil != err {
+		xLog.Printf("error reading the sorted placemarks of %s because %s", kw.fn, err.Error())
+	}
+	if folders > 0 {
+		kw.out <- []byte("</Folder>\n")
+	}
+	kw.out <- []byte("</Document>\n</kml>\n")
+
+	if kw.unlocated > 0 {
+		xLog.Printf("%s: %d stations without valid coordinates not written", kw.fn, kw.unlocated)
+	}
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("%s: %d placemarks in %d folders", kw.fn, kw.count, folders)
+	}
+}
+
+func (kw *kmlWriter) written() int {
+	return kw.count
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+	"github.com/shopspring/decimal"
+)
+
+func TestKmlStyles(t *testing.T) {
+	tests := []struct{ standard, id, color string }{
+		{"CHADEMO", "connector-CHADEMO", "ff00a5ff"},
+		{"IEC_62196_T2_COMBO", "connector-IEC_62196_T2_COMBO", "ff006400"},
+		{"", KML_STYLE_OTHER, "ff808080"},
+		{"NEMA 5-20 \"plug\"", "connector-NEMA_5_20__plug_", kmlColor("NEMA 5-20 \"plug\"")},
+	}
+	for _, tt := range tests {
+		if got := kmlStyleId(tt.standard); got != tt.id {
+			t.Errorf("kmlStyleId(%q) = %q, want %q", tt.standard, got, tt.id)
+		}
+		if got := kmlColor(tt.standard); got != tt.color || 8 != len(got) || !strings.HasPrefix(got, "ff") {
+			t.Errorf("kmlColor(%q) = %q, want %q", tt.standard, got, tt.color)
+		}
+	}
+	if kmlColor("GBT_AC") == kmlColor("GBT_DC") {
+		t.Errorf("unlisted standards share a color")
+	}
+	for _, folders := range []string{KML_FOLDERS_OPERATOR, KML_FOLDERS_REGION, KML_FOLDERS_NONE} {
+		if nil != checkKmlFolders(folders) {
+			t.Errorf("checkKmlFolders(%s) failed", folders)
+		}
+	}
+	if nil == checkKmlFolders("city") {
+		t.Errorf("checkKmlFolders accepted city")
+	}
+}
+
+func TestPrimaryStandard(t *testing.T) {
+	tests := []struct {
+		evses []denjson.Evses
+		want  string
+	}{
+		{nil, ""},
+		{[]denjson.Evses{{Connectors: []denjson.Connector{{Standard: "IEC_62196_T1"}}}}, "IEC_62196_T1"},
+		{[]denjson.Evses{
+			{Connectors: []denjson.Connector{{Standard: "IEC_62196_T1", Voltage: 240, Amperage: 32}}},
+			{Connectors: []denjson.Connector{{Standard: "CHADEMO", MaxElectricPower: decimal.NewFromInt(50000)},
+				{Standard: "TESLA_S", MaxElectricPower: decimal.NewFromInt(50000)}}},
+		}, "CHADEMO"},
+	}
+	for _, tt := range tests {
+		if got := primaryStandard(tt.evses); got != tt.want {
+			t.Errorf("primaryStandard(%+v) = %q, want %q", tt.evses, got, tt.want)
+		}
+	}
+}
+
+// kmlDoc is the part of a KML document the tests look at
+type kmlDoc struct {
+	Styles []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"Document>Style"`
+	Folders    []kmlTestFolder    `xml:"Document>Folder"`
+	Placemarks []kmlTestPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlTestFolder struct {
+	Name       string             `xml:"name"`
+	Placemarks []kmlTestPlacemark `xml:"Placemark"`
+}
+
+type kmlTestPlacemark struct {
+	Name        string `xml:"name"`
+	Style       string `xml:"styleUrl"`
+	Description string `xml:"description"`
+	Coordinates string `xml:"Point>coordinates"`
+}
+
+func TestKmlWriter(t *testing.T) {
+	defer func() { FlagKmlFolders, FlagIndexDir = KML_FOLDERS_OPERATOR, "" }()
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagIndexDir = t.TempDir()
+
+	tricky := testStation("US", "CPT", "LOC1")
+	tricky.Name = "Tom & Jerry's <Depot>"
+	tricky.Address = "1 Main St ]]> & more"
+	tricky.Operator.Name = "Zap & Co"
+	tricky.Coordinates = denjson.GeoLocation{Latitude: "49.25", Longitude: "-123.1"}
+	tricky.Evses = []denjson.Evses{{UID: "<1>", Connectors: []denjson.Connector{{Standard: "CHADEMO"}}}}
+	plain := testStation("CA", "FLO", "LOC2")
+	plain.Region = "NA"
+	plain.Coordinates = denjson.GeoLocation{Latitude: "45.5", Longitude: "-73.6"}
+	unlocated := testStation("CA", "FLO", "LOC3")
+
+	tests := []struct {
+		folders string
+		want    []string // folder names
+	}{
+		{KML_FOLDERS_OPERATOR, []string{KML_NO_FOLDER, "Zap & Co"}},
+		{KML_FOLDERS_REGION, []string{KML_NO_FOLDER, "NA"}},
+		{KML_FOLDERS_NONE, nil},
+	}
+	for _, tt := range tests {
+		FlagKmlFolders = tt.folders
+		var kw *kmlWriter
+		txt := writeAll(func(out chan []byte) recordWriter {
+			kw = startKmlWriter("stations.kml", out)
+			return kw
+		}, tricky, plain, unlocated)
+
+		var doc kmlDoc
+		if err := xml.Unmarshal(txt, &doc); nil != err {
+			t.Fatalf("folders %s: %s in\n%s", tt.folders, err.Error(), txt)
+		}
+		if 2 != kw.written() || 1 != kw.unlocated || 2 != len(doc.Styles) {
+			t.Errorf("folders %s: %d placemarks, %d unlocated, %d styles", tt.folders, kw.written(), kw.unlocated, len(doc.Styles))
+		}
+		placemarks := doc.Placemarks
+		var names []string
+		for _, folder := range doc.Folders {
+			names = append(names, folder.Name)
+			placemarks = append(placemarks, folder.Placemarks...)
+		}
+		if strings.Join(names, "|") != strings.Join(tt.want, "|") || 2 != len(placemarks) {
+			t.Errorf("folders %s: folders %q of %d placemarks, want %q", tt.folders, names, len(placemarks), tt.want)
+			continue
+		}
+		for _, pm := range placemarks {
+			switch pm.Name {
+			case tricky.Name:
+				if "#connector-CHADEMO" != pm.Style || "-123.1,49.25,0" != pm.Coordinates ||
+					!strings.Contains(pm.Description, "1 Main St ]]&gt; &amp; more") ||
+					!strings.Contains(pm.Description, "<td>&lt;1&gt;</td>") {
+					t.Errorf("folders %s: placemark %+v", tt.folders, pm)
+				}
+			case "LOC2":
+				if "#"+KML_STYLE_OTHER != pm.Style || !strings.Contains(pm.Description, "0 EVSEs, 0 connectors, max ? kW") {
+					t.Errorf("folders %s: placemark %+v", tt.folders, pm)
+				}
+			default:
+				t.Errorf("folders %s: unexpected placemark %q", tt.folders, pm.Name)
+			}
+		}
+	}
+}
+
+// TestKmlWriterSpills checks that placemarks keep their folders, and
+// their order within them, whether sorted in memory or spilled
+func TestKmlWriterSpills(t *testing.T) {
+	defer func() { FlagKmlFolders, FlagIndexDir, FlagMemLimit = KML_FOLDERS_OPERATOR, "", 0 }()
+	FlagKmlFolders, FlagIndexDir = KML_FOLDERS_REGION, t.TempDir()
+
+	var recs []*stationRecord
+	for ix := 0; ix < 3*MAX_MERGE_RUNS; ix++ {
+		rec := testStation("US", "CPT", fmt.Sprintf("LOC%03d", ix))
+		rec.Region = []string{"NA", "EU", "AP"}[ix%3]
+		rec.Coordinates = denjson.GeoLocation{Latitude: "1", Longitude: "2"}
+		recs = append(recs, rec)
+	}
+	for _, limit := range []int{512, 0} { // 0 spills every placemark
+		FlagMemLimit = limit
+		var kw *kmlWriter
+		txt := writeAll(func(out chan []byte) recordWriter {
+			kw = startKmlWriter("stations.kml", out)
+			return kw
+		}, recs...)
+		if spilled := kw.placemarks.spilled() > 0; spilled != (0 == limit) {
+			t.Errorf("memlimit %d: spilled %v", limit, spilled)
+		}
+
+		var doc kmlDoc
+		if err := xml.Unmarshal(txt, &doc); nil != err {
+			t.Fatalf("memlimit %d: %s", limit, err.Error())
+		}
+		var got []string
+		for _, folder := range doc.Folders {
+			names := make([]string, 0, len(folder.Placemarks))
+			for _, pm := range folder.Placemarks {
+				names = append(names, pm.Name)
+			}
+			got = append(got, folder.Name+": "+strings.Join(names[:3], ",")+fmt.Sprintf(" (%d)", len(names)))
+		}
+		want := []string{"AP: LOC002,LOC005,LOC008 (64)", "EU: LOC001,LOC004,LOC007 (64)", "NA: LOC000,LOC003,LOC006 (64)"}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("memlimit %d: folders %q, want %q", limit, got, want)
+		}
+	}
+}
@@ -2,19 +2,48 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+
+	misc "github.com/nathanverrilli/nlvMisc"
 )
 
+const LOCATIONS_MODULE = "locations"
+const DEFAULT_LOCATIONS_PATH = "den/cpo/1.0/locations/"
+const DEFAULT_PAGE_SIZE = 1000
+
 type endPointData struct {
 	Endpoints []endPoint `json:"endpoints"`
 }
+
+// endPoint describes one feed. Only the base URL and token are
+// required; module paths default to the DEN paths, the page size
+// to DEFAULT_PAGE_SIZE. Query parameters are added to the first
+// request of each module (later requests follow the Link header),
+// and headers are sent with every request to the feed. An optional
+// endpoint does not fail the health check when it is unreachable.
+// Priority ranks feeds for conflict resolution, lower first; feeds
+// of equal priority rank in the order of the endpoints file.
 type endPoint struct {
-	Region string `json:"region"`
-	Base   string `json:"baseUrl"`
-	Token  string `json:"token"`
+	Region   string            `json:"region"`
+	Base     string            `json:"baseUrl"`
+	Token    string            `json:"token"`
+	Modules  map[string]string `json:"modules,omitempty"`
+	PageSize int               `json:"pageSize,omitempty"`
+	Query    map[string]string `json:"query,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Optional bool              `json:"optional,omitempty"`
+	Priority int               `json:"priority,omitempty"`
 }
 
-func loadEndpoints(fn string) (regions, bases, tokens []string) {
+// loadEndpoints reads the endpoints file, filling in defaults for
+// anything an endpoint does not declare. An endpoint without a region
+// is tagged with the host name of its base URL, so that every merged
+// location can be traced to its source.
+func loadEndpoints(fn string) (endpoints []endPoint) {
 	body, err := os.ReadFile(fn)
 	if nil != err {
 		xLog.Printf("error reading endpoints file: %s", err.Error())
@@ -26,13 +55,81 @@ func loadEndpoints(fn string) (regions, bases, tokens []string) {
 		xLog.Printf("error parsing endpoints file %s: %s", fn, err.Error())
 		myFatal()
 	}
-	regions = make([]string, len(ed.Endpoints))
-	bases = make([]string, len(ed.Endpoints))
-	tokens = make([]string, len(ed.Endpoints))
-	for i, ep := range ed.Endpoints {
-		regions[i] = ep.Region
-		bases[i] = ep.Base
-		tokens[i] = ep.Token
+	for ix := range ed.Endpoints {
+		err = ed.Endpoints[ix].setDefaults()
+		if nil != err {
+			xLog.Printf("error in endpoints file %s, endpoint %d: %s", fn, ix, err.Error())
+			myFatal()
+		}
+	}
+	return ed.Endpoints
+}
+
+// setDefaults validates an endpoint and fills in the region,
+// module paths and page size where they were not declared.
+func (ep *endPoint) setDefaults() error {
+	if !misc.IsStringSet(&ep.Base) {
+		return fmt.Errorf("baseUrl is not set")
+	}
+	if _, err := url.Parse(ep.Base); nil != err {
+		return fmt.Errorf("baseUrl %s is not a valid URL: %s", ep.Base, err.Error())
+	}
+	if !misc.IsStringSet(&ep.Region) {
+		ep.Region = defaultRegion(ep.Base)
+	}
+	if ep.PageSize < 0 {
+		return fmt.Errorf("pageSize %d for %s must not be negative", ep.PageSize, ep.Base)
+	}
+	if 0 == ep.PageSize {
+		ep.PageSize = DEFAULT_PAGE_SIZE
+	}
+	if nil == ep.Modules {
+		ep.Modules = make(map[string]string, 1)
+	}
+	if _, ok := ep.Modules[LOCATIONS_MODULE]; !ok {
+		ep.Modules[LOCATIONS_MODULE] = DEFAULT_LOCATIONS_PATH
+	}
+	return nil
+}
+
+// moduleUrl builds the URL of the first page of a module, resolving
+// the module path against the base URL and adding the paging and
+// extra query parameters.
+func (ep *endPoint) moduleUrl(module string) (string, error) {
+	modulePath, ok := ep.Modules[module]
+	if !ok {
+		return "", fmt.Errorf("endpoint %s does not declare module %s", ep.Base, module)
+	}
+	base, err := url.Parse(ep.Base)
+	if nil != err {
+		return "", err
+	}
+	// resolve relative to the base "directory", not its last element
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(strings.TrimPrefix(modulePath, "/"))
+	if nil != err {
+		return "", fmt.Errorf("module %s path %s is not valid: %s", module, modulePath, err.Error())
+	}
+	u := base.ResolveReference(ref)
+
+	query := u.Query()
+	query.Set("limit", strconv.Itoa(ep.PageSize))
+	query.Set("offset", "0")
+	for key, val := range ep.Query {
+		query.Set(key, val)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// defaultRegion names a region for an endpoint that does not
+// declare one, using the host name of the base URL.
+func defaultRegion(base string) string {
+	u, err := url.Parse(base)
+	if nil != err || !misc.IsStringSet(&u.Host) {
+		return base
 	}
-	return regions, bases, tokens
+	return u.Hostname()
 }
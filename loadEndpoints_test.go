@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestDefaultRegion(t *testing.T) {
+	tests := []struct {
+		base string
+		want string
+	}{
+		{"https://ocpi.chargepoint.com/", "ocpi.chargepoint.com"},
+		{"https://ocpi-ca.chargepoint.com:8443/den/", "ocpi-ca.chargepoint.com"},
+		{"http://127.0.0.1:18080", "127.0.0.1"},
+		{"not a url", "not a url"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := defaultRegion(tt.base); got != tt.want {
+			t.Errorf("defaultRegion(%q) = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		ep       endPoint
+		wantErr  bool
+		region   string
+		pageSize int
+		path     string
+	}{
+		{"defaults", endPoint{Base: "https://ocpi.example.com/"}, false,
+			"ocpi.example.com", DEFAULT_PAGE_SIZE, DEFAULT_LOCATIONS_PATH},
+		{"declared", endPoint{Base: "https://ocpi.example.com/", Region: "EU", PageSize: 50,
+			Modules: map[string]string{LOCATIONS_MODULE: "ocpi/2.2/locations"}}, false,
+			"EU", 50, "ocpi/2.2/locations"},
+		{"no base", endPoint{Region: "EU"}, true, "", 0, ""},
+		{"bad base", endPoint{Base: "://nope"}, true, "", 0, ""},
+		{"negative page size", endPoint{Base: "https://ocpi.example.com/", PageSize: -1}, true, "", 0, ""},
+	}
+	for _, tt := range tests {
+		err := tt.ep.setDefaults()
+		if tt.wantErr {
+			if nil == err {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if tt.ep.Region != tt.region || tt.ep.PageSize != tt.pageSize || tt.ep.Modules[LOCATIONS_MODULE] != tt.path {
+			t.Errorf("%s: region %q page size %d path %q, want %q %d %q", tt.name,
+				tt.ep.Region, tt.ep.PageSize, tt.ep.Modules[LOCATIONS_MODULE], tt.region, tt.pageSize, tt.path)
+		}
+	}
+}
+
+func TestModuleUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		ep      endPoint
+		module  string
+		want    string
+		wantErr bool
+	}{
+		{"base with slash",
+			endPoint{Base: "https://h.example/", PageSize: 10, Modules: map[string]string{"locations": "den/cpo/1.0/locations/"}},
+			"locations", "https://h.example/den/cpo/1.0/locations/?limit=10&offset=0", false},
+		{"base without slash keeps its last element",
+			endPoint{Base: "https://h.example/ocpi", PageSize: 10, Modules: map[string]string{"locations": "/2.2/locations"}},
+			"locations", "https://h.example/ocpi/2.2/locations?limit=10&offset=0", false},
+		{"extra query, sorted",
+			endPoint{Base: "https://h.example/", PageSize: 5, Modules: map[string]string{"locations": "l"},
+				Query: map[string]string{"date_from": "2024-01-01T00:00:00Z"}},
+			"locations", "https://h.example/l?date_from=2024-01-01T00%3A00%3A00Z&limit=5&offset=0", false},
+		{"query overrides paging",
+			endPoint{Base: "https://h.example/", PageSize: 5, Modules: map[string]string{"locations": "l"},
+				Query: map[string]string{"limit": "1"}},
+			"locations", "https://h.example/l?limit=1&offset=0", false},
+		{"undeclared module",
+			endPoint{Base: "https://h.example/", Modules: map[string]string{"locations": "l"}},
+			"tariffs", "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.ep.moduleUrl(tt.module)
+		if tt.wantErr != (nil != err) {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: moduleUrl = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
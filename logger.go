@@ -18,6 +18,9 @@ var xLogFile *os.File
 var xLogBuffWriter *bufio.Writer
 var xLog log.Logger
 
+// xLogPath is the absolute path of the log file, set by initLog
+var xLogPath string
+
 // flushLog flushes the log buffer if it is not nil.
 // If flushing the buffer results in an error, it logs the error message to standard output.
 // This function is typically used to ensure that all log messages are written before shutting down the logging service.
@@ -63,7 +66,8 @@ func closeLog() {
 // If opening the log file encounters an error, it logs the error message to standard output using safeLogPrintf.
 // It creates a new bufio.Writer to be used as the log buffer and sets the log writers to the standard output and the log buffer.
 // It sets the log flags to include the date, time, UTC, and short file.
-// It resolves the absolute path of the log file and logs it using safeLogPrintf.
+// It resolves the absolute path of the log file into xLogPath, for init to log once
+// the command has chosen where the console copy of the log goes.
 // This function is typically called at the initialization of the logging service.
 // The log file name should be passed as the lfName argument.
 func initLog(lfName string) {
@@ -85,13 +89,18 @@ func initLog(lfName string) {
 	xLog.SetFlags(log.Ldate | log.Ltime | log.LUTC | log.Lshortfile)
 	xLog.SetOutput(io.MultiWriter(logWriters...))
 
-	logPath, err := filepath.Abs(xLogFile.Name())
+	xLogPath, err = filepath.Abs(xLogFile.Name())
 	if nil != err {
 		_, _ = safeLogPrintf("huh? could not resolve logfilename %s because %s",
 			xLogFile.Name(), err.Error())
 		myFatal()
 	}
-	_, _ = safeLogPrintf("Logfile set to %s", logPath)
+}
+
+// setLogConsole sends the console copy of the log to w instead of
+// stdout; the log file still gets everything.
+func setLogConsole(w io.Writer) {
+	xLog.SetOutput(io.MultiWriter(w, xLogBuffWriter))
 }
 
 var myFatalMutex sync.Mutex
@@ -10,13 +10,14 @@ import (
 
 const DEFAULT_OUTPUT_DIR = ".output"
 
-func init() {
+func main() {
 	// initialize program boilerplate stuff
 	// turn on logger
 	initLog("mergeFeeds.log")
 	misc.AtClose(closeLog)
 	// get program options
 	initFlags()
+	_, _ = safeLogPrintf("Logfile set to %s", xLogPath)
 	// set these options in misc from flags
 	_ = misc.OptionPrintf(safeLogPrintf)
 	_ = misc.OptionFatal(myFatal)
@@ -25,15 +26,23 @@ func init() {
 	_ = misc.OptionOutputDir(DEFAULT_OUTPUT_DIR)
 
 	// handle ctrl-c or kill
-	signalChan := make(chan os.Signal) // important: this channel should not be buffered
+	signalChan := make(chan os.Signal, 1) // signal.Notify does not block, so buffer one signal
 	signal.Notify(signalChan, os.Interrupt, os.Kill)
 	go misc.HandleSignal(signalChan)
 
-}
+	rc := theCommand.run(nFlags.Args())
 
-func main() {
+	// flush the log so the run summary is kept in the logfile
+	misc.FinishClose()
+	os.Exit(rc)
+}
 
-	var url = "den/cpo/1.0/locations/?limit=1000&offset=0"
+// runPipeline connects a source of pages to a sink: pages flow over
+// outJson, feed errors to error.log. The source runs on this goroutine
+// and calls allDone when it has sent its last page; the sink calls
+// allDone when it has consumed them all.
+func runPipeline(source func(out chan<- feedPage, outError chan<- []byte, allDone func()) error,
+	sink func(in <-chan feedPage, outError chan<- []byte, allDone func())) (rc int) {
 
 	var err error
 	var wgJson sync.WaitGroup
@@ -44,21 +53,17 @@ func main() {
 	wgError.Add(1)
 	wgFeeds.Add(1)
 
-	outJson := make(chan []byte, 16) // close called from here
-	outError := make(chan []byte, 4) // close called from outJson
+	outJson := make(chan feedPage, 16) // close called from here
+	outError := make(chan []byte, 4)   // close called from outJson
 
 	go misc.RecordBytes("error.log", outError, wgError.Done)
-	go filterJsonPage(outJson, outError, wgJson.Done)
-
-	// load endpoints
-	_, productionEndpointUrls, ProductionEndpointTokens := loadEndpoints(FlagAuthTokenFile)
+	go sink(outJson, outError, wgJson.Done)
 
-	go func() {
-		err = mergeFeeds(productionEndpointUrls, ProductionEndpointTokens, url, outJson, outError, wgFeeds.Done)
-		if err != nil {
-			xLog.Printf("error merging feeds because %s", err.Error())
-		}
-	}()
+	err = source(outJson, outError, wgFeeds.Done)
+	if err != nil {
+		xLog.Printf("error merging feeds because %s", err.Error())
+		rc = -1
+	}
 	wgFeeds.Wait()
 
 	close(outJson)
@@ -67,4 +72,10 @@ func main() {
 	close(outError)
 	wgError.Wait()
 
+	if 0 == rc && qualityFailed {
+		xLog.Printf("data quality below the thresholds set")
+		rc = 1
+	}
+
+	return rc
 }
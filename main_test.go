@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests without the program setup of main: there
+// are no program flags to parse, and the tracked logfile is left alone
+func TestMain(m *testing.M) {
+	xLog.SetOutput(os.Stderr)
+	os.Exit(m.Run())
+}
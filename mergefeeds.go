@@ -3,24 +3,40 @@ package main
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"sync"
-
-	misc "github.com/nathanverrilli/nlvMisc"
+	"time"
 )
 
+// feedPage is one page of location JSON as returned by a feed,
+// tagged with the region and priority of the endpoint that supplied
+// it, the index of the feed in the endpoints file and the page number
+// within the feed (from 1). The request URL, fetch time and
+// response headers are kept for the raw page archive.
+type feedPage struct {
+	region   string
+	priority int
+	feed     int
+	page     int
+	url      string
+	fetched  time.Time
+	header   http.Header
+	body     []byte
+}
+
 // mergeFeeds combines multiple JSON location pages into a single output.
+// The request URL for each feed is built from its endpoint's locations
+// module, page size and query parameters, and each page is tagged with
+// the region of its feed.
 // Since output goes to a channel, this function is thread-safe.
-func mergeFeeds(base []string, tokens []string, url string, out chan<- []byte, outError chan<- []byte, allDone func()) (err error) {
+func mergeFeeds(endpoints []endPoint, out chan<- feedPage, outError chan<- []byte, allDone func()) (err error) {
 	var wg sync.WaitGroup
-	var recordCount = make([]int, len(base))
+	var recordCount = make([]int, len(endpoints))
 	defer allDone()
 
 	// sanity
-	if len(base) <= 0 || len(base) != len(tokens) {
-		return fmt.Errorf("mergefeeds(): base and token lists must have identical positive length")
-	}
-	if !misc.IsStringSet(&url) {
-		return fmt.Errorf("mergefeeds(): url is not set")
+	if len(endpoints) <= 0 {
+		return fmt.Errorf("mergefeeds(): no endpoints to merge")
 	}
 	if out == nil {
 		return fmt.Errorf("mergefeeds(): output is not set")
@@ -28,19 +44,27 @@ func mergeFeeds(base []string, tokens []string, url string, out chan<- []byte, o
 	if outError == nil {
 		return fmt.Errorf("mergefeeds(): error output is not set")
 	}
+	firstUrls := make([]string, len(endpoints))
+	for ix := range endpoints {
+		firstUrls[ix], err = endpoints[ix].moduleUrl(LOCATIONS_MODULE)
+		if nil != err {
+			return fmt.Errorf("mergefeeds(): %s", err.Error())
+		}
+	}
 
-	for ix, baseStr := range base {
+	for ix := range endpoints {
 		wg.Add(1)
-		go pullFeed(baseStr+url, tokens[ix], &recordCount[ix], out, outError, wg.Done)
+		go pullFeed(ix, &endpoints[ix], firstUrls[ix], &recordCount[ix], out, outError, wg.Done)
 	}
 	wg.Wait()
 
 	if FlagDebug {
 		totalCount := 0
 		// these counts are filled in by the pullFeed goroutines
-		for ix := 0; ix < len(base); ix++ {
+		for ix := 0; ix < len(endpoints); ix++ {
 			totalCount += recordCount[ix]
-			xLog.Printf("records from feed %s: %d", base[ix], recordCount[ix])
+			xLog.Printf("records from feed %s (region %s): %d",
+				endpoints[ix].Base, endpoints[ix].Region, recordCount[ix])
 		}
 		xLog.Printf("total records (all feeds): %d", totalCount)
 	}
@@ -51,9 +75,11 @@ func mergeFeeds(base []string, tokens []string, url string, out chan<- []byte, o
 // handling synchronization and errors. This thread-safe function runs as
 // multiple goroutines, synchronizing using the provided mutex and waitgroup.Done()
 // to signal completion. The sync pain is due to the annoying JSON comma,
-// which forces mutex protection around writes.
-func pullFeed(nextUrl string, token string, rc *int, out chan<- []byte, outError chan<- []byte, allDone func()) {
+// which forces mutex protection around writes. Every page is tagged with
+// the feed's region.
+func pullFeed(feed int, ep *endPoint, nextUrl string, rc *int, out chan<- feedPage, outError chan<- []byte, allDone func()) {
 	var body []byte
+	var header http.Header
 	var err error
 
 	defer allDone()
@@ -66,12 +92,15 @@ func pullFeed(nextUrl string, token string, rc *int, out chan<- []byte, outError
 		if FlagDebug {
 			xLog.Printf("Processing %s\n", nextUrl)
 		}
-		body, nextUrl, *rc, err = requestJsonObject(nextUrl, token)
+		thisUrl := nextUrl
+		fetched := time.Now().UTC()
+		body, nextUrl, *rc, header, err = requestJsonObject(thisUrl, ep.Token, ep.Headers)
 		if err != nil {
 			outError <- []byte(err.Error())
 			outError <- body
 		} else {
-			out <- body
+			out <- feedPage{region: ep.Region, priority: ep.Priority, feed: feed, page: pageCount + 1,
+				url: thisUrl, fetched: fetched, header: header, body: body}
 		}
 
 		pageCount++
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Near duplicates are stations with different keys that describe the
+// same physical site, as when two CPO feeds list a site under their
+// own IDs. After exact dedupe, stations from different feeds within
+// FlagNearbyRadius meters of each other are scored on distance and on
+// the similarity of their names and addresses; pairs scoring at least
+// FlagNearbyConfidence are reported in nearduplicates.json and, with
+// FlagNearbyMerge, merged like exact duplicates -- only in groups
+// whose every two stations are such a pair.
+
+// Weights of the parts of a near duplicate's confidence. A name or
+// address missing from either station does not count.
+const (
+	NEARBY_WEIGHT_DISTANCE = 0.4
+	NEARBY_WEIGHT_NAME     = 0.3
+	NEARBY_WEIGHT_ADDRESS  = 0.3
+)
+
+// nearbySide is one station of a candidate pair
+type nearbySide struct {
+	Key     string `json:"key"`
+	Feed    string `json:"feed"`
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// nearbyPair is a candidate near duplicate
+type nearbyPair struct {
+	A                 nearbySide `json:"a"`
+	B                 nearbySide `json:"b"`
+	DistanceMeters    float64    `json:"distance_m"`
+	NameSimilarity    *float64   `json:"name_similarity,omitempty"`
+	AddressSimilarity *float64   `json:"address_similarity,omitempty"`
+	Confidence        float64    `json:"confidence"`
+
+	a, b int // positions of the stations in the detector
+}
+
+// nearbySummary is the whole near duplicates report
+type nearbySummary struct {
+	RadiusMeters  float64      `json:"radius_m"`
+	MinConfidence float64      `json:"min_confidence"`
+	Stations      int          `json:"stations"`
+	Pairs         int          `json:"pairs"`
+	Clusters      int          `json:"clusters"`
+	Merged        int          `json:"merged"`
+	Candidates    []nearbyPair `json:"candidates"`
+}
+
+// nearbyStation is a station held by the detector with what is needed to compare it
+type nearbyStation struct {
+	rec      *stationRecord
+	key      string
+	lat, lon float64
+	located  bool
+	name     string // normalized
+	address  string // normalized
+}
+
+// nearbyDetector is the stationStage finding near duplicates. It holds
+// every station until the input ends, indexed in a grid of cells about
+// the radius across, so only stations in neighbouring cells are compared.
+type nearbyDetector struct {
+	radius   float64
+	cellDeg  float64
+	stations []*nearbyStation
+	grid     map[[2]int64][]int
+}
+
+func newNearbyDetector(radius float64) *nearbyDetector {
+	return &nearbyDetector{
+		radius:  radius,
+		cellDeg: radius / (EARTH_RADIUS_METERS * math.Pi / 180),
+		grid:    make(map[[2]int64][]int, 1024),
+	}
+}
+
+// process holds the station; nothing is passed on until flush
+func (nd *nearbyDetector) process(rec *stationRecord) []*stationRecord {
+	ns := &nearbyStation{
+		rec:     rec,
+		key:     dedupeKey(rec),
+		name:    normalizeText(rec.Name),
+		address: normalizeText(strings.Join([]string{rec.Address, rec.City}, " ")),
+	}
+	ns.lat, ns.lon, ns.located = stationCoordinates(rec)
+	nd.stations = append(nd.stations, ns)
+	return nil
+}
+
+// cell is the grid cell of a point. Longitude is scaled by the
+// latitude, so a cell is about as wide as it is high.
+func (nd *nearbyDetector) cell(lat float64, lon float64) [2]int64 {
+	scale := math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	return [2]int64{int64(math.Floor(lat / nd.cellDeg)), int64(math.Floor(lon * scale / nd.cellDeg))}
+}
+
+// flush finds the near duplicates, writes the report and passes on
+// the stations in the order they came, merged if FlagNearbyMerge.
+func (nd *nearbyDetector) flush() []*stationRecord {
+	var pairs []nearbyPair
+	for ix, ns := range nd.stations {
+		if !ns.located {
+			continue
+		}
+		c := nd.cell(ns.lat, ns.lon)
+		for dLat := int64(-1); dLat <= 1; dLat++ {
+			for dLon := int64(-1); dLon <= 1; dLon++ {
+				for _, jx := range nd.grid[[2]int64{c[0] + dLat, c[1] + dLon}] {
+					pair, ok := nd.compare(jx, ix)
+					if ok {
+						pairs = append(pairs, pair)
+					}
+				}
+			}
+		}
+		nd.grid[c] = append(nd.grid[c], ix)
+	}
+
+	clusters := nd.cluster(pairs)
+	summary := nearbySummary{
+		RadiusMeters:  nd.radius,
+		MinConfidence: FlagNearbyConfidence,
+		Stations:      len(nd.stations),
+		Pairs:         len(pairs),
+		Clusters:      len(clusters),
+		Candidates:    pairs,
+	}
+
+	out := make([]*stationRecord, 0, len(nd.stations))
+	absorbed := make(map[int]struct{}, 8)
+	if FlagNearbyMerge {
+		for _, members := range clusters {
+			nd.merge(members, absorbed)
+			summary.Merged += len(members) - 1
+		}
+	}
+	for ix, ns := range nd.stations {
+		if _, ok := absorbed[ix]; !ok {
+			out = append(out, ns.rec)
+		}
+	}
+
+	sort.SliceStable(summary.Candidates, func(i, j int) bool {
+		return summary.Candidates[i].Confidence > summary.Candidates[j].Confidence
+	})
+	if nil == summary.Candidates {
+		summary.Candidates = []nearbyPair{}
+	}
+	txt, err := json.MarshalIndent(summary, "", "  ")
+	if nil != err {
+		xLog.Printf("error marshalling near duplicates report: %s", err.Error())
+	} else {
+		writeOutputFile("nearduplicates.json", txt)
+	}
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("near duplicates within %gm: %d candidate pairs in %d clusters; %d stations merged",
+			nd.radius, summary.Pairs, summary.Clusters, summary.Merged)
+	}
+	return out
+}
+
+// compare scores two stations, returning the pair if they are from
+// different feeds, within the radius and confident enough
+func (nd *nearbyDetector) compare(jx int, ix int) (pair nearbyPair, ok bool) {
+	a, b := nd.stations[jx], nd.stations[ix]
+	if a.rec.src.feed == b.rec.src.feed {
+		return pair, false
+	}
+	meters := haversineMeters(a.lat, a.lon, b.lat, b.lon)
+	if meters > nd.radius {
+		return pair, false
+	}
+
+	score := NEARBY_WEIGHT_DISTANCE * (1 - meters/nd.radius)
+	weight := NEARBY_WEIGHT_DISTANCE
+	pair = nearbyPair{
+		A:              nearbySide{Key: a.key, Feed: feedLabel(a.rec), Name: a.rec.Name, Address: a.rec.Address},
+		B:              nearbySide{Key: b.key, Feed: feedLabel(b.rec), Name: b.rec.Name, Address: b.rec.Address},
+		DistanceMeters: math.Round(meters*10) / 10,
+		a:              jx,
+		b:              ix,
+	}
+	if "" != a.name && "" != b.name {
+		sim := roundScore(textSimilarity(a.name, b.name))
+		pair.NameSimilarity = &sim
+		score += NEARBY_WEIGHT_NAME * sim
+		weight += NEARBY_WEIGHT_NAME
+	}
+	if "" != a.address && "" != b.address {
+		sim := roundScore(textSimilarity(a.address, b.address))
+		pair.AddressSimilarity = &sim
+		score += NEARBY_WEIGHT_ADDRESS * sim
+		weight += NEARBY_WEIGHT_ADDRESS
+	}
+	pair.Confidence = roundScore(score / weight)
+	return pair, pair.Confidence >= FlagNearbyConfidence
+}
+
+// cluster groups the stations joined by pairs. A group only forms
+// where every two of its stations are themselves a pair, so stations
+// are never merged through a station in between (A near B and B near
+// C does not make A a near duplicate of C). Pairs are taken from the
+// most confident, joining two groups when every station of one is
+// paired with every station of the other. Each cluster is in the order
+// the stations came and the clusters in order of their first station.
+func (nd *nearbyDetector) cluster(pairs []nearbyPair) (clusters [][]int) {
+	paired := make(map[[2]int]struct{}, len(pairs))
+	for _, pair := range pairs {
+		paired[[2]int{min(pair.a, pair.b), max(pair.a, pair.b)}] = struct{}{}
+	}
+	order := make([]nearbyPair, len(pairs))
+	copy(order, pairs)
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].Confidence != order[j].Confidence {
+			return order[i].Confidence > order[j].Confidence
+		}
+		if min(order[i].a, order[i].b) != min(order[j].a, order[j].b) {
+			return min(order[i].a, order[i].b) < min(order[j].a, order[j].b)
+		}
+		return max(order[i].a, order[i].b) < max(order[j].a, order[j].b)
+	})
+
+	groupOf := make(map[int][]int, 2*len(pairs))
+	for _, pair := range order {
+		ga, gb := groupOf[pair.a], groupOf[pair.b]
+		if nil == ga {
+			ga = []int{pair.a}
+		}
+		if nil == gb {
+			gb = []int{pair.b}
+		}
+		if ga[0] == gb[0] || !allPaired(paired, ga, gb) {
+			continue
+		}
+		joined := append(append(make([]int, 0, len(ga)+len(gb)), ga...), gb...)
+		sort.Ints(joined)
+		for _, ix := range joined {
+			groupOf[ix] = joined
+		}
+	}
+
+	for ix, group := range groupOf {
+		if ix == group[0] {
+			clusters = append(clusters, group)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+	return clusters
+}
+
+// allPaired reports whether every station of a is paired with every station of b
+func allPaired(paired map[[2]int]struct{}, a []int, b []int) bool {
+	for _, ix := range a {
+		for _, jx := range b {
+			if _, ok := paired[[2]int{min(ix, jx), max(ix, jx)}]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// merge merges a cluster into the station the conflict strategy
+// prefers, marking the others absorbed. The survivor lists the keys
+// merged into it in "near_duplicates".
+func (nd *nearbyDetector) merge(members []int, absorbed map[int]struct{}) {
+	first := nd.stations[members[0]].rec
+	for _, ix := range members[1:] {
+		first.copies = append(first.copies, nd.stations[ix].rec)
+	}
+	winner := mergeCopies(first)
+	first.copies = nil
+	for _, ix := range members {
+		ns := nd.stations[ix]
+		if ns.rec == winner {
+			continue
+		}
+		absorbed[ix] = struct{}{}
+		winner.NearDuplicates = append(winner.NearDuplicates, ns.key)
+	}
+	sort.Strings(winner.NearDuplicates)
+}
+
+// stationCoordinates parses a station's coordinates, which must be in range
+func stationCoordinates(rec *stationRecord) (lat float64, lon float64, ok bool) {
+	return readCoordinates(rec.Coordinates.Latitude, rec.Coordinates.Longitude)
+}
+
+// readCoordinates reads a latitude and longitude, ok if both are in range
+func readCoordinates(latitude string, longitude string) (lat float64, lon float64, ok bool) {
+	lat, err1 := strconv.ParseFloat(latitude, 64)
+	lon, err2 := strconv.ParseFloat(longitude, 64)
+	if nil != err1 || nil != err2 {
+		return 0, 0, false
+	}
+	return lat, lon, math.Abs(lat) <= 90 && math.Abs(lon) <= 180
+}
+
+// textAbbreviations are expanded when normalizing names and addresses
+var textAbbreviations = map[string]string{
+	"st": "street", "str": "street", "ave": "avenue", "av": "avenue",
+	"rd": "road", "blvd": "boulevard", "dr": "drive", "ln": "lane",
+	"hwy": "highway", "pkwy": "parkway", "ct": "court", "pl": "place",
+	"sq": "square", "n": "north", "s": "south", "e": "east", "w": "west",
+	"ctr": "center", "centre": "center", "mt": "mount", "ste": "suite",
+}
+
+// normalizeText lowercases text, turns punctuation into spaces and
+// expands common abbreviations, so that "12 Main St." and
+// "12 main street" compare equal
+func normalizeText(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for ix, word := range words {
+		if long, ok := textAbbreviations[word]; ok {
+			words[ix] = long
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// textSimilarity is the Dice coefficient of the character bigrams of
+// two normalized strings: 1 for equal strings, 0 for nothing in common
+func textSimilarity(a string, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ba, bb := bigrams(a), bigrams(b)
+	if len(ba) <= 0 || len(bb) <= 0 {
+		return 0
+	}
+	total := 0
+	for _, n := range ba {
+		total += n
+	}
+	for _, n := range bb {
+		total += n
+	}
+	common := 0
+	for gram, n := range ba {
+		common += min(n, bb[gram])
+	}
+	return 2 * float64(common) / float64(total)
+}
+
+// bigrams counts the pairs of adjacent characters in a string
+func bigrams(s string) map[string]int {
+	runes := []rune(s)
+	grams := make(map[string]int, len(runes))
+	for ix := 0; ix+1 < len(runes); ix++ {
+		grams[string(runes[ix:ix+2])]++
+	}
+	return grams
+}
+
+// roundScore rounds a score to three places for the report
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
+}
+
+// checkNearby makes sure the near duplicate flags make sense
+func checkNearby() error {
+	if FlagNearbyRadius < 0 {
+		return fmt.Errorf("radius must not be negative, not %g", FlagNearbyRadius)
+	}
+	if FlagNearbyConfidence < 0 || FlagNearbyConfidence > 1 {
+		return fmt.Errorf("confidence must be from 0 to 1, not %g", FlagNearbyConfidence)
+	}
+	if FlagNearbyMerge && FlagNearbyRadius <= 0 {
+		return fmt.Errorf("merging near duplicates needs a --nearby radius")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"12 Main St.", "12 main street"},
+		{"12 main street", "12 main street"},
+		{"  N. Harbour Blvd,  Unit 4 ", "north harbour boulevard unit 4"},
+		{"Centre Commercial", "center commercial"},
+		{"Straße 5", "straße 5"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeText(tt.in); got != tt.want {
+			t.Errorf("normalizeText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTextSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		min, max float64
+	}{
+		{"main street", "main street", 1, 1},
+		{"abc", "xyz", 0, 0},
+		{"a", "b", 0, 0},
+		{"", "main", 0, 0},
+		{"night", "nacht", 0.25, 0.25}, // one common bigram of four each
+		{"walmart supercenter", "walmart supercentre", 0.8, 0.95},
+	}
+	for _, tt := range tests {
+		got := textSimilarity(tt.a, tt.b)
+		if got < tt.min || got > tt.max {
+			t.Errorf("textSimilarity(%q, %q) = %g, want %g to %g", tt.a, tt.b, got, tt.min, tt.max)
+		}
+		if back := textSimilarity(tt.b, tt.a); back != got {
+			t.Errorf("textSimilarity(%q, %q) = %g, but %g the other way", tt.a, tt.b, got, back)
+		}
+	}
+}
+
+// nearbyStations makes a detector holding a station per feed at each
+// latitude, all named alike, on the same meridian
+func nearbyStations(radius float64, lats ...float64) *nearbyDetector {
+	nd := newNearbyDetector(radius)
+	for ix, lat := range lats {
+		rec := testStation("US", fmt.Sprintf("P%d", ix), "LOC1")
+		rec.src.feed = ix
+		rec.Name = "Main Street Chargers"
+		rec.Coordinates.Latitude = fmt.Sprint(lat)
+		rec.Coordinates.Longitude = "-123"
+		nd.process(rec)
+	}
+	return nd
+}
+
+// allPairs compares every two stations of the detector
+func allPairs(nd *nearbyDetector) (pairs []nearbyPair) {
+	for ix := range nd.stations {
+		for jx := 0; jx < ix; jx++ {
+			if pair, ok := nd.compare(jx, ix); ok {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	return pairs
+}
+
+func TestNearbyCluster(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagNearbyConfidence = 0.5
+	const m = 1 / 111195.0 // a meter in degrees of latitude
+	tests := []struct {
+		name string
+		lats []float64
+		want [][]int
+	}{
+		{"pair", []float64{49, 49 + 10*m}, [][]int{{0, 1}}},
+		{"too far", []float64{49, 49 + 150*m}, nil},
+		{"all close", []float64{49, 49 + 10*m, 49 + 20*m}, [][]int{{0, 1, 2}}},
+		// 0-1 and 1-2 are within 100m, 0-2 are not: only the closer pair joins
+		{"chain", []float64{49, 49 + 80*m, 49 + 150*m}, [][]int{{1, 2}}},
+		{"two sites", []float64{49, 49 + 5*m, 50, 50 + 5*m}, [][]int{{0, 1}, {2, 3}}},
+	}
+	for _, tt := range tests {
+		nd := nearbyStations(100, tt.lats...)
+		got := nd.cluster(allPairs(nd))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: clusters %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNearbyCompare(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	FlagNearbyConfidence = 0.5
+	nd := nearbyStations(100, 49, 49.0001, 49.0002)
+	nd.stations[2].rec.src.feed = 1
+	nd.stations[2].name = normalizeText("Airport Parking")
+
+	if _, ok := nd.compare(1, 2); ok {
+		t.Errorf("stations from the same feed paired")
+	}
+	pair, ok := nd.compare(0, 1)
+	if !ok || nil == pair.NameSimilarity || 1 != *pair.NameSimilarity || nil != pair.AddressSimilarity {
+		t.Errorf("alike names 11m apart: %+v, ok %v", pair, ok)
+	}
+	FlagNearbyConfidence = 0.9
+	if pair, ok = nd.compare(0, 2); ok {
+		t.Errorf("different names 22m apart paired at confidence %g", pair.Confidence)
+	}
+	FlagNearbyConfidence = 0
+}
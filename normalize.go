@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// Feeds format the same facts differently. The normalizers, each
+// chosen by name with --normalize, rewrite a station's fields to one
+// form as the station is decoded, before it is deduplicated, so that
+// dedupe keys and every later stage see the normalized station.
+
+// Normalizers
+const (
+	NORMALIZE_COORDINATES = "coordinates" // 6 decimal places
+	NORMALIZE_ADDRESS     = "address"     // spacing, and casing of all-upper or all-lower text
+	NORMALIZE_POSTAL_CODE = "postalcode"  // national postal code formats
+	NORMALIZE_COUNTRY     = "country"     // country alpha-3, country_code alpha-2
+	NORMALIZE_POWER       = "power"       // max_electric_power in W, not kW
+	NORMALIZE_TIME_ZONE   = "timezone"    // IANA names, not legacy names or abbreviations
+	NORMALIZE_ALL         = "all"
+)
+
+// COORDINATE_PLACES is the decimal places of normalized coordinates, about 0.1 m
+const COORDINATE_PLACES = 6
+
+// MAX_KW_POWER is the largest max_electric_power taken to be in kW:
+// no connector delivers so little as 1000 W
+const MAX_KW_POWER = 1000
+
+// normalizerDef is a named normalizer, true if it changed the station
+type normalizerDef struct {
+	name  string
+	apply func(rec *stationRecord) bool
+}
+
+var normalizerDefs = []normalizerDef{
+	{NORMALIZE_COORDINATES, normalizeCoordinates},
+	{NORMALIZE_ADDRESS, normalizeAddress},
+	{NORMALIZE_POSTAL_CODE, normalizePostalCode},
+	{NORMALIZE_COUNTRY, normalizeCountry},
+	{NORMALIZE_POWER, normalizePower},
+	{NORMALIZE_TIME_ZONE, normalizeTimeZone},
+}
+
+// normalizer applies the normalizers selected, counting the stations
+// each changed. It is shared by the workers.
+type normalizer struct {
+	defs    []normalizerDef
+	changed []atomic.Int64
+	seen    atomic.Int64
+}
+
+// newNormalizer makes the normalizer for the names given; nil if none are
+func newNormalizer(names []string) (norm *normalizer, err error) {
+	if len(names) <= 0 {
+		return nil, nil
+	}
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if NORMALIZE_ALL == name {
+			for _, def := range normalizerDefs {
+				selected[def.name] = true
+			}
+			continue
+		}
+		known := false
+		for _, def := range normalizerDefs {
+			known = known || def.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown normalizer %s (use %s, or %s)",
+				name, strings.Join(normalizerNames(), ", "), NORMALIZE_ALL)
+		}
+		selected[name] = true
+	}
+	norm = &normalizer{}
+	for _, def := range normalizerDefs {
+		if selected[def.name] {
+			norm.defs = append(norm.defs, def)
+		}
+	}
+	norm.changed = make([]atomic.Int64, len(norm.defs))
+	return norm, nil
+}
+
+func normalizerNames() (names []string) {
+	for _, def := range normalizerDefs {
+		names = append(names, def.name)
+	}
+	return names
+}
+
+// apply runs each normalizer, in order, over the station
+func (norm *normalizer) apply(rec *stationRecord) {
+	norm.seen.Add(1)
+	for ix := range norm.defs {
+		if norm.defs[ix].apply(rec) {
+			norm.changed[ix].Add(1)
+		}
+	}
+}
+
+// report logs how many stations each normalizer changed
+func (norm *normalizer) report() {
+	if FlagDebug || FlagVerbose {
+		for ix := range norm.defs {
+			xLog.Printf("normalizer %s changed %d of %d stations",
+				norm.defs[ix].name, norm.changed[ix].Load(), norm.seen.Load())
+		}
+	}
+}
+
+// setString sets a field, noting whether it changed
+func setString(field *string, value string, changed *bool) {
+	if *field != value {
+		*field = value
+		*changed = true
+	}
+}
+
+// normalizeCoordinates writes coordinates to COORDINATE_PLACES places,
+// leaving unreadable ones as they are
+func normalizeCoordinates(rec *stationRecord) (changed bool) {
+	fix := func(lat *string, lon *string) {
+		for _, p := range []*string{lat, lon} {
+			v, err := strconv.ParseFloat(strings.TrimSpace(*p), 64)
+			if nil == err {
+				setString(p, strconv.FormatFloat(v, 'f', COORDINATE_PLACES, 64), &changed)
+			}
+		}
+	}
+	fix(&rec.Coordinates.Latitude, &rec.Coordinates.Longitude)
+	for ix := range rec.Evses {
+		fix(&rec.Evses[ix].Coordinates.Latitude, &rec.Evses[ix].Coordinates.Longitude)
+	}
+	return changed
+}
+
+// normalizeAddress collapses spacing in the name, address and city,
+// title-casing the address and city if all upper or all lower case
+func normalizeAddress(rec *stationRecord) (changed bool) {
+	setString(&rec.Name, strings.Join(strings.Fields(rec.Name), " "), &changed)
+	for _, p := range []*string{&rec.Address, &rec.City} {
+		s := strings.Join(strings.Fields(*p), " ")
+		if strings.ToUpper(s) == s || strings.ToLower(s) == s {
+			s = titleCase(s)
+		}
+		setString(p, s, &changed)
+	}
+	return changed
+}
+
+// directions stay upper case when title-casing
+var directions = map[string]bool{"N": true, "S": true, "E": true, "W": true,
+	"NE": true, "NW": true, "SE": true, "SW": true}
+
+// titleCase capitalizes each word, leaving words with digits and
+// compass directions as they are. After an apostrophe, only a name
+// is capitalized, as in O'Neil, not the s of Mary's or the t of Don't.
+func titleCase(s string) string {
+	words := strings.Split(s, " ")
+	for ix, word := range words {
+		if directions[strings.ToUpper(word)] {
+			words[ix] = strings.ToUpper(word)
+			continue
+		}
+		if strings.ContainsFunc(word, unicode.IsDigit) {
+			continue
+		}
+		runes := []rune(strings.ToLower(word))
+		for jx := range runes {
+			// after a hyphen, as in Saint-Denis, or an apostrophe
+			// followed by more than one letter, as in O'Neil
+			if 0 == jx || '-' == runes[jx-1] ||
+				('\'' == runes[jx-1] && jx+1 < len(runes) && unicode.IsLetter(runes[jx+1])) {
+				runes[jx] = unicode.ToUpper(runes[jx])
+			}
+		}
+		words[ix] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// postal codes, without spaces, that have a national format
+var (
+	canadianPostalCode = regexp.MustCompile(`^[A-Z][0-9][A-Z][0-9][A-Z][0-9]$`)
+	britishPostalCode  = regexp.MustCompile(`^[A-Z][A-Z0-9]{1,3}[0-9][A-Z]{2}$`)
+	dutchPostalCode    = regexp.MustCompile(`^[0-9]{4}[A-Z]{2}$`)
+)
+
+// normalizePostalCode upper-cases and spaces postal codes, in the
+// national format where the country is known
+func normalizePostalCode(rec *stationRecord) (changed bool) {
+	pc := strings.ToUpper(strings.Join(strings.Fields(rec.PostalCode), " "))
+	compact := strings.ReplaceAll(strings.ReplaceAll(pc, " ", ""), "-", "")
+	switch countryAlpha3(rec.Country) {
+	case "USA":
+		// ZIP+4
+		if 9 == len(compact) && allDigits(compact) {
+			pc = compact[:5] + "-" + compact[5:]
+		}
+	case "CAN":
+		if canadianPostalCode.MatchString(compact) {
+			pc = compact[:3] + " " + compact[3:]
+		}
+	case "GBR", "IRL":
+		// the inward code is always three characters
+		if britishPostalCode.MatchString(compact) {
+			pc = compact[:len(compact)-3] + " " + compact[len(compact)-3:]
+		}
+	case "NLD":
+		if dutchPostalCode.MatchString(compact) {
+			pc = compact[:4] + " " + compact[4:]
+		}
+	}
+	setString(&rec.PostalCode, pc, &changed)
+	return changed
+}
+
+func allDigits(s string) bool {
+	return !strings.ContainsFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+}
+
+// countryCodes maps ISO 3166 alpha-2 codes to alpha-3 codes
+var countryCodes = map[string]string{
+	"US": "USA", "CA": "CAN", "MX": "MEX", "PR": "PRI", "GB": "GBR", "IE": "IRL",
+	"FR": "FRA", "DE": "DEU", "NL": "NLD", "BE": "BEL", "LU": "LUX", "CH": "CHE",
+	"AT": "AUT", "IT": "ITA", "ES": "ESP", "PT": "PRT", "DK": "DNK", "NO": "NOR",
+	"SE": "SWE", "FI": "FIN", "IS": "ISL", "PL": "POL", "CZ": "CZE", "SK": "SVK",
+	"HU": "HUN", "SI": "SVN", "HR": "HRV", "RO": "ROU", "BG": "BGR", "GR": "GRC",
+	"EE": "EST", "LV": "LVA", "LT": "LTU", "AU": "AUS", "NZ": "NZL", "JP": "JPN",
+	"KR": "KOR", "CN": "CHN", "IN": "IND", "SG": "SGP", "BR": "BRA", "CL": "CHL",
+}
+
+// countryAlpha3 is the alpha-3 code of a country given either way
+func countryAlpha3(country string) string {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if alpha3, ok := countryCodes[country]; ok {
+		return alpha3
+	}
+	return country
+}
+
+// countryAlpha2 is the alpha-2 code of a country given either way
+func countryAlpha2(country string) string {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	for alpha2, alpha3 := range countryCodes {
+		if alpha3 == country {
+			return alpha2
+		}
+	}
+	return country
+}
+
+// normalizeCountry makes country (OCPI: alpha-3) and country_code
+// (OCPI 2.2: alpha-2) upper case, in the right form
+func normalizeCountry(rec *stationRecord) (changed bool) {
+	if "" != rec.Country {
+		setString(&rec.Country, countryAlpha3(rec.Country), &changed)
+	}
+	if "" != rec.CountryCode {
+		setString(&rec.CountryCode, countryAlpha2(rec.CountryCode), &changed)
+	}
+	return changed
+}
+
+// normalizePower converts each max_electric_power given in kW to W
+func normalizePower(rec *stationRecord) (changed bool) {
+	for ix := range rec.Evses {
+		for jx := range rec.Evses[ix].Connectors {
+			conn := &rec.Evses[ix].Connectors[jx]
+			if conn.MaxElectricPower.IsPositive() && conn.MaxElectricPower.IntPart() < MAX_KW_POWER {
+				conn.MaxElectricPower = conn.MaxElectricPower.Shift(3)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// timeZoneNames maps legacy time zone names and common abbreviations,
+// upper case, to IANA names. An abbreviation is ambiguous; these are
+// the North American and European readings.
+var timeZoneNames = map[string]string{
+	"US/EASTERN": "America/New_York", "US/CENTRAL": "America/Chicago",
+	"US/MOUNTAIN": "America/Denver", "US/ARIZONA": "America/Phoenix",
+	"US/PACIFIC": "America/Los_Angeles", "US/ALASKA": "America/Anchorage",
+	"US/HAWAII": "Pacific/Honolulu", "CANADA/ATLANTIC": "America/Halifax",
+	"CANADA/EASTERN": "America/Toronto", "CANADA/CENTRAL": "America/Winnipeg",
+	"CANADA/MOUNTAIN": "America/Edmonton", "CANADA/PACIFIC": "America/Vancouver",
+	"CANADA/NEWFOUNDLAND": "America/St_Johns", "EST": "America/New_York",
+	"EDT": "America/New_York", "CST": "America/Chicago", "CDT": "America/Chicago",
+	"MST": "America/Denver", "MDT": "America/Denver", "PST": "America/Los_Angeles",
+	"PDT": "America/Los_Angeles", "AKST": "America/Anchorage", "HST": "Pacific/Honolulu",
+	"GMT": "Europe/London", "BST": "Europe/London", "CET": "Europe/Berlin",
+	"CEST": "Europe/Berlin", "UTC": "Etc/UTC", "Z": "Etc/UTC",
+}
+
+// normalizeTimeZone replaces legacy names and abbreviations with IANA
+// names, and fixes the casing of IANA names in the table
+func normalizeTimeZone(rec *stationRecord) (changed bool) {
+	tz := strings.TrimSpace(rec.TimeZone)
+	if "" == tz {
+		return false
+	}
+	upper := strings.ToUpper(tz)
+	if name, ok := timeZoneNames[upper]; ok {
+		tz = name
+	} else {
+		for _, name := range timeZoneNames {
+			if strings.ToUpper(name) == upper {
+				tz = name
+				break
+			}
+		}
+	}
+	setString(&rec.TimeZone, tz, &changed)
+	return changed
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+	"github.com/shopspring/decimal"
+)
+
+func TestNewNormalizer(t *testing.T) {
+	tests := []struct {
+		names   []string
+		want    string // normalizers selected, in order
+		wantErr bool
+	}{
+		{nil, "", false},
+		{[]string{"power", " Coordinates "}, "coordinates,power", false},
+		{[]string{"all"}, strings.Join(normalizerNames(), ","), false},
+		{[]string{"all", "power"}, strings.Join(normalizerNames(), ","), false},
+		{[]string{"spelling"}, "", true},
+	}
+	for _, tt := range tests {
+		norm, err := newNormalizer(tt.names)
+		if tt.wantErr != (nil != err) {
+			t.Errorf("newNormalizer(%q): error %v", tt.names, err)
+			continue
+		}
+		var got []string
+		if nil != norm {
+			for _, def := range norm.defs {
+				got = append(got, def.name)
+			}
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("newNormalizer(%q) selected %v, want %s", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeCoordinates(t *testing.T) {
+	rec := testStation("US", "CPT", "LOC1")
+	rec.Coordinates = denjson.GeoLocation{Latitude: " 49.25 ", Longitude: "-123.1000000001"}
+	rec.Evses = []denjson.Evses{{Coordinates: denjson.GeoLocation{Latitude: "north", Longitude: "1e-7"}}}
+	if !normalizeCoordinates(rec) {
+		t.Errorf("coordinates not changed")
+	}
+	if "49.250000" != rec.Coordinates.Latitude || "-123.100000" != rec.Coordinates.Longitude {
+		t.Errorf("coordinates %+v", rec.Coordinates)
+	}
+	if "north" != rec.Evses[0].Coordinates.Latitude || "0.000000" != rec.Evses[0].Coordinates.Longitude {
+		t.Errorf("EVSE coordinates %+v", rec.Evses[0].Coordinates)
+	}
+	if normalizeCoordinates(rec) {
+		t.Errorf("normalized coordinates changed again")
+	}
+}
+
+func TestTitleCase(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"123 MAIN ST NW", "123 Main St NW"},
+		{"rue saint-denis", "Rue Saint-Denis"},
+		{"o'neil road", "O'Neil Road"},
+		{"ST MARY'S ROAD", "St Mary's Road"},
+		{"MCDONALD'S", "Mcdonald's"},
+		{"DON'T WALK", "Don't Walk"},
+		{"D'ARCY ST", "D'Arcy St"},
+		{"HWY 99 n", "Hwy 99 N"},
+		{"4TH AVENUE", "4TH Avenue"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := titleCase(tt.in); got != tt.want {
+			t.Errorf("titleCase(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	rec := testStation("US", "CPT", "LOC1")
+	rec.Name, rec.Address, rec.City = "  Depot   Chargers ", "1  MAIN   ST", "Springfield"
+	if !normalizeAddress(rec) {
+		t.Errorf("address not changed")
+	}
+	if "Depot Chargers" != rec.Name || "1 Main St" != rec.Address || "Springfield" != rec.City {
+		t.Errorf("name %q, address %q, city %q", rec.Name, rec.Address, rec.City)
+	}
+	rec.Address = "1 McDonald ST"
+	if normalizeAddress(rec) || "1 McDonald ST" != rec.Address {
+		t.Errorf("mixed case address changed to %q", rec.Address)
+	}
+}
+
+func TestNormalizePostalCode(t *testing.T) {
+	tests := []struct{ country, in, want string }{
+		{"USA", "12345", "12345"},
+		{"US", "123456789", "12345-6789"},
+		{"USA", "12345 6789", "12345-6789"},
+		{"CAN", "v6b1a1", "V6B 1A1"},
+		{"CA", "V6B-1A1", "V6B 1A1"},
+		{"GBR", "sw1a1aa", "SW1A 1AA"},
+		{"GBR", "M1 1AE", "M1 1AE"},
+		{"NLD", "1012ab", "1012 AB"},
+		{"DEU", " 10115 ", "10115"},
+		{"FRA", "75 001", "75 001"},
+		{"CAN", "not a code", "NOT A CODE"},
+	}
+	for _, tt := range tests {
+		rec := testStation("", "", "LOC1")
+		rec.Country, rec.PostalCode = tt.country, tt.in
+		normalizePostalCode(rec)
+		if rec.PostalCode != tt.want {
+			t.Errorf("postal code %q in %s = %q, want %q", tt.in, tt.country, rec.PostalCode, tt.want)
+		}
+	}
+}
+
+func TestNormalizeCountry(t *testing.T) {
+	tests := []struct{ country, code, wantCountry, wantCode string }{
+		{"us", "us", "USA", "US"},
+		{"USA", "USA", "USA", "US"},
+		{"can", "ca", "CAN", "CA"},
+		{"XYZ", "xy", "XYZ", "XY"},
+		{"", "", "", ""},
+	}
+	for _, tt := range tests {
+		rec := testStation(tt.code, "CPT", "LOC1")
+		rec.Country = tt.country
+		normalizeCountry(rec)
+		if rec.Country != tt.wantCountry || rec.CountryCode != tt.wantCode {
+			t.Errorf("country %q, country_code %q = %q, %q; want %q, %q",
+				tt.country, tt.code, rec.Country, rec.CountryCode, tt.wantCountry, tt.wantCode)
+		}
+	}
+}
+
+func TestNormalizePower(t *testing.T) {
+	tests := []struct {
+		in, want string
+		changed  bool
+	}{
+		{"7.2", "7200", true},
+		{"350", "350000", true},
+		{"999.5", "999500", true},
+		{"1000", "1000", false},
+		{"150000", "150000", false},
+		{"0", "0", false},
+	}
+	for _, tt := range tests {
+		rec := testStation("US", "CPT", "LOC1")
+		rec.Evses = []denjson.Evses{{Connectors: []denjson.Connector{{MaxElectricPower: decimal.RequireFromString(tt.in)}}}}
+		changed := normalizePower(rec)
+		got := rec.Evses[0].Connectors[0].MaxElectricPower
+		if changed != tt.changed || !got.Equal(decimal.RequireFromString(tt.want)) {
+			t.Errorf("power %s = %s (changed %v), want %s (changed %v)", tt.in, got, changed, tt.want, tt.changed)
+		}
+	}
+}
+
+func TestNormalizeTimeZone(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"US/Pacific", "America/Los_Angeles"},
+		{"pst", "America/Los_Angeles"},
+		{" CET ", "Europe/Berlin"},
+		{"america/vancouver", "America/Vancouver"},
+		{"Europe/Paris", "Europe/Paris"}, // not in the table, left alone
+		{"", ""},
+	}
+	for _, tt := range tests {
+		rec := testStation("US", "CPT", "LOC1")
+		rec.TimeZone = tt.in
+		normalizeTimeZone(rec)
+		if rec.TimeZone != tt.want {
+			t.Errorf("time zone %q = %q, want %q", tt.in, rec.TimeZone, tt.want)
+		}
+	}
+}
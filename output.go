@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+// Output formats of the stations files. Each format selected is
+// written, to its own file, so json and ndjson may be written together.
+// The formats besides json and ndjson are exports, made from the
+// stations as merged, not as shaped by --transform, so they cannot be
+// written with a transform.
+const (
+	FORMAT_JSON   = "json"   // one {"data": [ ... ] } document
+	FORMAT_NDJSON = "ndjson" // one station per line (JSON Lines)
+)
+
+var outputFormats = []string{FORMAT_JSON, FORMAT_NDJSON, FORMAT_GEOJSON, FORMAT_CSV, FORMAT_KML}
+
+// formatExtensions are the file extensions of the formats
+var formatExtensions = map[string]string{
+	FORMAT_JSON:    ".json",
+	FORMAT_NDJSON:  ".ndjson",
+	FORMAT_GEOJSON: ".geojson",
+	FORMAT_CSV:     ".csv",
+	FORMAT_KML:     ".kml",
+}
+
+// exportFormats are the formats --transform cannot shape
+var exportFormats = map[string]bool{
+	FORMAT_GEOJSON: true,
+	FORMAT_CSV:     true,
+	FORMAT_KML:     true,
+}
+
+// GZIP_EXTENSION is added to the name of a compressed file
+const GZIP_EXTENSION = ".gz"
+
+// checkOutputFormats makes sure there is at least one format, and
+// every one is known
+func checkOutputFormats(formats []string) error {
+	if len(formats) <= 0 {
+		return fmt.Errorf("no output format (use %s)", strings.Join(outputFormats, ", "))
+	}
+	for _, format := range formats {
+		if _, ok := formatExtensions[format]; !ok {
+			return fmt.Errorf("unknown output format %s (use %s)", format, strings.Join(outputFormats, ", "))
+		}
+	}
+	return nil
+}
+
+// checkTransformFormats makes sure no export is written with a
+// transform: it would carry the fields the transform leaves out or
+// redacts
+func checkTransformFormats(formats []string) error {
+	for _, format := range formats {
+		if exportFormats[format] {
+			return fmt.Errorf("the %s format is not transformed, so would keep the fields the transform "+
+				"leaves out or redacts (transform json or ndjson, and write %s without --transform)", format, format)
+		}
+	}
+	return nil
+}
+
+// recordWriter streams stations to a file
+type recordWriter interface {
+	// write adds one station, given marshalled as txt too
+	write(rec *stationRecord, txt []byte)
+	// close finishes the file. The writer may not be used afterward.
+	close()
+	// written is the number of stations written
+	written() int
+}
+
+// newRecordWriters starts a writer of each output format to files
+// named base plus the format's extension, compressed with FlagGzip;
+// wg.Done() is called once each file is completely written.
+func newRecordWriters(base string, wg *sync.WaitGroup) (writers []recordWriter) {
+	for _, format := range FlagOutputFormat {
+		fn := base + formatExtensions[format]
+		if FlagGzip {
+			fn += GZIP_EXTENSION
+		}
+		out := make(chan []byte, 32)
+		wg.Add(1)
+		if FlagGzip {
+			go recordCompressed(fn, out, wg.Done)
+		} else {
+			go misc.RecordBytes(fn, out, wg.Done)
+		}
+		switch format {
+		case FORMAT_NDJSON:
+			writers = append(writers, &ndjsonWriter{out: out})
+		case FORMAT_GEOJSON:
+			writers = append(writers, startGeojsonWriter(fn, out))
+		case FORMAT_CSV:
+			writers = append(writers, startCsvWriter(fn, out))
+		case FORMAT_KML:
+			writers = append(writers, startKmlWriter(fn, out))
+		default:
+			writers = append(writers, jsonDocWriter{startStationWriter(out)})
+		}
+	}
+	return writers
+}
+
+// jsonDocWriter is the recordWriter of the json format
+type jsonDocWriter struct {
+	*stationWriter
+}
+
+func (jw jsonDocWriter) write(_ *stationRecord, txt []byte) {
+	jw.stationWriter.write(txt)
+}
+
+// ndjsonWriter streams stations a line apiece. A marshalled station
+// has no newlines, so each line is one whole station.
+type ndjsonWriter struct {
+	out   chan []byte
+	count int
+}
+
+func (nw *ndjsonWriter) write(_ *stationRecord, txt []byte) {
+	line := make([]byte, 0, len(txt)+1)
+	nw.out <- append(append(line, txt...), '\n')
+	nw.count++
+}
+
+func (nw *ndjsonWriter) close() {
+	close(nw.out)
+}
+
+func (nw *ndjsonWriter) written() int {
+	return nw.count
+}
+
+// chanWriter is an io.Writer sending copies of what is written to a channel
+type chanWriter chan<- []byte
+
+func (cw chanWriter) Write(p []byte) (int, error) {
+	cw <- bytes.Clone(p)
+	return len(p), nil
+}
+
+// recordCompressed records the bytes received to a gzip file in the
+// output directory, like misc.RecordBytes
+func recordCompressed(fn string, in <-chan []byte, allDone func()) {
+	out := make(chan []byte, 32)
+	go misc.RecordBytes(fn, out, allDone)
+	gz := gzip.NewWriter(chanWriter(out))
+	for txt := range in {
+		// writes to a chanWriter do not fail
+		_, _ = gz.Write(txt)
+	}
+	_ = gz.Close()
+	close(out)
+}
+
+// readStationsRaw reads the stations of a stations file, each left
+// undecoded: a {"data": [ ... ] } document, or with an .ndjson or
+// .jsonl extension, a station per line; either gzipped if the name
+// ends in .gz.
+func readStationsRaw(fn string) (stations []json.RawMessage, err error) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer misc.DeferError(f.Close)
+	var r io.Reader = f
+	name := fn
+	if strings.HasSuffix(name, GZIP_EXTENSION) {
+		gz, err := gzip.NewReader(f)
+		if nil != err {
+			return nil, fmt.Errorf("error reading stations file %s: %s", fn, err.Error())
+		}
+		defer misc.DeferError(gz.Close)
+		r = gz
+		name = strings.TrimSuffix(name, GZIP_EXTENSION)
+	}
+
+	switch filepath.Ext(name) {
+	case ".ndjson", ".jsonl":
+		scanner := bufio.NewScanner(r)
+		// a station with many EVSEs makes a long line
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			txt := bytes.TrimSpace(scanner.Bytes())
+			if len(txt) <= 0 {
+				continue
+			}
+			if !json.Valid(txt) {
+				return nil, fmt.Errorf("error parsing stations file %s: line %d is not JSON", fn, line)
+			}
+			stations = append(stations, bytes.Clone(txt))
+		}
+		if err = scanner.Err(); nil != err {
+			return nil, fmt.Errorf("error reading stations file %s: %s", fn, err.Error())
+		}
+		return stations, nil
+	}
+
+	var raw rawStationPage
+	err = json.NewDecoder(r).Decode(&raw)
+	if nil != err {
+		return nil, fmt.Errorf("error parsing stations file %s: %s", fn, err.Error())
+	}
+	return raw.Data, nil
+}
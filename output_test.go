@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+func TestCheckOutputFormats(t *testing.T) {
+	tests := []struct {
+		formats []string
+		wantErr bool
+	}{
+		{[]string{FORMAT_JSON}, false},
+		{[]string{FORMAT_NDJSON, FORMAT_JSON}, false},
+		{nil, true},
+		{[]string{FORMAT_JSON, "yaml"}, true},
+		{[]string{"JSON"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkOutputFormats(tt.formats); tt.wantErr != (nil != err) {
+			t.Errorf("checkOutputFormats(%q): error %v", tt.formats, err)
+		}
+	}
+}
+
+func TestCheckTransformFormats(t *testing.T) {
+	tests := []struct {
+		formats []string
+		wantErr bool
+	}{
+		{[]string{FORMAT_JSON, FORMAT_NDJSON}, false},
+		{[]string{FORMAT_JSON, FORMAT_GEOJSON}, true},
+		{[]string{FORMAT_CSV}, true},
+		{[]string{FORMAT_NDJSON, FORMAT_KML}, true},
+	}
+	for _, tt := range tests {
+		if err := checkTransformFormats(tt.formats); tt.wantErr != (nil != err) {
+			t.Errorf("checkTransformFormats(%q): error %v", tt.formats, err)
+		}
+	}
+}
+
+// TestRecordWritersRoundTrip writes stations in each format, plain and
+// gzipped, and reads them back the way inspect and validate do
+func TestRecordWritersRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	defer misc.OptionOutputDir(misc.OptionOutputDir(dir))
+	defer func() { FlagOutputFormat, FlagGzip = []string{FORMAT_JSON}, false }()
+
+	recs := []*stationRecord{testStation("US", "CPT", "LOC1"), testStation("CA", "FLO", "LOC/2"), testStation("US", "CPT", "LOC3")}
+	recs[1].Name = "Line\nbreak \"quoted\""
+	for _, gz := range []bool{false, true} {
+		FlagOutputFormat, FlagGzip = []string{FORMAT_JSON, FORMAT_NDJSON}, gz
+		var wg sync.WaitGroup
+		writers := newRecordWriters("stations", &wg)
+		for _, rec := range recs {
+			txt, err := json.Marshal(rec)
+			if nil != err {
+				t.Fatal(err)
+			}
+			for _, rw := range writers {
+				rw.write(rec, txt)
+			}
+		}
+		for _, rw := range writers {
+			if rw.written() != len(recs) {
+				t.Errorf("gzip %v: %T wrote %d stations, want %d", gz, rw, rw.written(), len(recs))
+			}
+			rw.close()
+		}
+		wg.Wait()
+
+		for _, ext := range []string{".json", ".ndjson"} {
+			fn := filepath.Join(dir, "stations"+ext)
+			if gz {
+				fn += GZIP_EXTENSION
+			}
+			raw, err := readStationsRaw(fn)
+			if nil != err {
+				t.Errorf("readStationsRaw(%s): %s", fn, err.Error())
+				continue
+			}
+			if len(raw) != len(recs) {
+				t.Errorf("%s: %d stations, want %d", fn, len(raw), len(recs))
+				continue
+			}
+			for ix := range raw {
+				var got stationRecord
+				if err = json.Unmarshal(raw[ix], &got); nil != err || got.ID != recs[ix].ID || got.Name != recs[ix].Name {
+					t.Errorf("%s: station %d is %s", fn, ix, raw[ix])
+				}
+			}
+		}
+	}
+}
+
+func TestReadStationsRawErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, body string
+		want       int // stations, or -1 for an error
+	}{
+		{"blank.jsonl", "{\"id\":\"A\"}\n\n  \n{\"id\":\"B\"}\n", 2},
+		{"bad.ndjson", "{\"id\":\"A\"}\n{\"id\":\n", -1},
+		{"bad.json", `{"data": [ {"id":"A"}, ]}`, -1},
+		{"notgzip.json.gz", `{"data": []}`, -1},
+		{"empty.json", `{"data": []}`, 0},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(fn, []byte(tt.body), 0o644); nil != err {
+			t.Fatal(err)
+		}
+		raw, err := readStationsRaw(fn)
+		if (tt.want < 0) != (nil != err) || (tt.want >= 0 && len(raw) != tt.want) {
+			t.Errorf("readStationsRaw(%s) = %d stations, error %v; want %d", tt.name, len(raw), err, tt.want)
+		}
+	}
+	if _, err := readStationsRaw(filepath.Join(dir, "missing.json")); nil == err {
+		t.Errorf("readStationsRaw of a missing file did not fail")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The quality checks look for the ways a partner's data degrades.
+// Each merged station is checked, and each feed scored by the percent
+// of its stations with no issues at all. The scorecard is written to
+// quality.json; with thresholds, a feed scoring too low, or with too
+// many stations failing one check, fails the run.
+
+// Quality checks
+const (
+	QUALITY_BAD_COORDINATES  = "bad_coordinates"  // unreadable or out of range
+	QUALITY_ZERO_COORDINATES = "zero_coordinates" // at 0,0
+	QUALITY_OUTSIDE_COUNTRY  = "outside_country"  // not in the declared country
+	QUALITY_NO_EVSES         = "no_evses"
+	QUALITY_ZERO_POWER       = "zero_power" // a connector without power
+	QUALITY_STALE            = "stale"      // last_updated missing or too old
+	QUALITY_NO_TIME_ZONE     = "no_time_zone"
+	QUALITY_EMPTY_ADDRESS    = "empty_address" // no address or city
+)
+
+// qualityCheck is a named test, true if the station has the issue
+type qualityCheck struct {
+	name  string
+	issue func(rec *stationRecord, now time.Time) bool
+}
+
+var qualityChecks = []qualityCheck{
+	{QUALITY_BAD_COORDINATES, func(rec *stationRecord, _ time.Time) bool {
+		_, _, ok := stationCoordinates(rec)
+		return !ok
+	}},
+	{QUALITY_ZERO_COORDINATES, func(rec *stationRecord, _ time.Time) bool {
+		lat, lon, ok := stationCoordinates(rec)
+		return ok && 0 == lat && 0 == lon
+	}},
+	{QUALITY_OUTSIDE_COUNTRY, func(rec *stationRecord, _ time.Time) bool {
+		lat, lon, ok := stationCoordinates(rec)
+		box, known := countryBoxes[strings.ToUpper(rec.Country)]
+		return ok && known && (lon < box[0] || lat < box[1] || lon > box[2] || lat > box[3])
+	}},
+	{QUALITY_NO_EVSES, func(rec *stationRecord, _ time.Time) bool {
+		return len(rec.Evses) <= 0
+	}},
+	{QUALITY_ZERO_POWER, func(rec *stationRecord, _ time.Time) bool {
+		for _, evse := range rec.Evses {
+			for _, conn := range evse.Connectors {
+				if !conn.MaxElectricPower.IsPositive() && !conn.MaxPower.IsPositive() &&
+					conn.Voltage*conn.Amperage <= 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}},
+	{QUALITY_STALE, func(rec *stationRecord, now time.Time) bool {
+		return rec.LastUpdated.IsZero() ||
+			now.Sub(rec.LastUpdated) > time.Duration(FlagQualityStale)*24*time.Hour
+	}},
+	{QUALITY_NO_TIME_ZONE, func(rec *stationRecord, _ time.Time) bool {
+		return "" == strings.TrimSpace(rec.TimeZone)
+	}},
+	{QUALITY_EMPTY_ADDRESS, func(rec *stationRecord, _ time.Time) bool {
+		return "" == strings.TrimSpace(rec.Address) || "" == strings.TrimSpace(rec.City)
+	}},
+}
+
+// countryBoxes are generous bounding boxes, minLon,minLat,maxLon,maxLat,
+// of the countries stations are commonly in, by ISO 3166 alpha-3 code.
+// Stations of other countries are not checked for QUALITY_OUTSIDE_COUNTRY.
+var countryBoxes = map[string][4]float64{
+	"USA": {-179.2, 18.9, -66.9, 71.4},
+	"CAN": {-141.1, 41.6, -52.6, 83.2},
+	"MEX": {-118.5, 14.5, -86.7, 32.8},
+	"PRI": {-67.3, 17.9, -65.2, 18.6},
+	"GBR": {-8.7, 49.8, 1.8, 60.9},
+	"IRL": {-10.7, 51.4, -5.9, 55.4},
+	"FRA": {-5.2, 41.3, 9.6, 51.1},
+	"DEU": {5.8, 47.2, 15.1, 55.1},
+	"NLD": {3.3, 50.7, 7.3, 53.6},
+	"BEL": {2.5, 49.5, 6.4, 51.5},
+	"LUX": {5.7, 49.4, 6.6, 50.2},
+	"CHE": {5.9, 45.8, 10.5, 47.9},
+	"AUT": {9.5, 46.3, 17.2, 49.1},
+	"ITA": {6.6, 35.4, 18.6, 47.1},
+	"ESP": {-18.2, 27.6, 4.4, 43.8},
+	"PRT": {-31.3, 32.6, -6.2, 42.2},
+	"DNK": {8.0, 54.5, 15.2, 57.8},
+	"NOR": {4.5, 57.9, 31.2, 71.2},
+	"SWE": {10.9, 55.3, 24.2, 69.1},
+	"FIN": {20.5, 59.8, 31.6, 70.1},
+	"POL": {14.1, 49.0, 24.2, 54.9},
+	"CZE": {12.0, 48.5, 18.9, 51.1},
+	"AUS": {112.9, -43.7, 153.7, -10.6},
+	"NZL": {166.4, -47.3, 178.6, -34.4},
+	"JPN": {122.9, 24.0, 145.9, 45.6},
+}
+
+// checkQuality checks the quality flags, parsing the --qualitymax limits
+func checkQuality() (limits map[string]float64, err error) {
+	if !FlagQuality {
+		if FlagQualityMin > 0 || len(FlagQualityMax) > 0 {
+			return nil, fmt.Errorf("--qualitymin and --qualitymax need --quality")
+		}
+		return nil, nil
+	}
+	if FlagQualityStale <= 0 {
+		return nil, fmt.Errorf("--qualitystale must be positive, not %d", FlagQualityStale)
+	}
+	if FlagQualityMin < 0 || FlagQualityMin > 100 {
+		return nil, fmt.Errorf("--qualitymin must be a percent, not %g", FlagQualityMin)
+	}
+	limits = make(map[string]float64, len(FlagQualityMax))
+	for _, limit := range FlagQualityMax {
+		name, value, found := strings.Cut(limit, "=")
+		name = strings.TrimSpace(name)
+		if !found || !knownQualityCheck(name) {
+			return nil, fmt.Errorf("bad limit %q (use check=percent, checks are %s)",
+				limit, strings.Join(qualityCheckNames(), ", "))
+		}
+		pct, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if nil != err || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("bad limit %q: %q is not a percent", limit, value)
+		}
+		limits[name] = pct
+	}
+	return limits, nil
+}
+
+func knownQualityCheck(name string) bool {
+	for _, check := range qualityChecks {
+		if check.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func qualityCheckNames() (names []string) {
+	for _, check := range qualityChecks {
+		names = append(names, check.name)
+	}
+	return names
+}
+
+// feedQuality is the scorecard of one feed
+type feedQuality struct {
+	Feed     string         `json:"feed"`
+	Stations int            `json:"stations"`
+	Clean    int            `json:"clean"`
+	Score    float64        `json:"score"` // percent of stations without issues
+	Issues   map[string]int `json:"issues"`
+	Failures []string       `json:"failures,omitempty"`
+}
+
+// qualitySummary is the whole scorecard
+type qualitySummary struct {
+	StaleDays int                `json:"stale_days"`
+	MinScore  float64            `json:"min_score,omitempty"`
+	MaxIssues map[string]float64 `json:"max_issues,omitempty"`
+	Passed    bool               `json:"passed"`
+	Feeds     []*feedQuality     `json:"feeds"`
+	Total     *feedQuality       `json:"total"`
+}
+
+// qualityFailed is set when a feed misses a threshold, failing the
+// run. It is set by the writer goroutine, and read once that is done.
+var qualityFailed bool
+
+// qualityScorer is the stationStage checking the quality of each
+// station, passing every station on
+type qualityScorer struct {
+	now   time.Time
+	feeds map[string]*feedQuality
+	total *feedQuality
+}
+
+func newQualityScorer() *qualityScorer {
+	return &qualityScorer{
+		now:   time.Now(),
+		feeds: make(map[string]*feedQuality, 8),
+		total: newFeedQuality("all"),
+	}
+}
+
+func newFeedQuality(feed string) *feedQuality {
+	fq := &feedQuality{Feed: feed, Issues: make(map[string]int, len(qualityChecks))}
+	for _, check := range qualityChecks {
+		fq.Issues[check.name] = 0
+	}
+	return fq
+}
+
+// process checks the station, counting its issues against its feed
+func (qs *qualityScorer) process(rec *stationRecord) []*stationRecord {
+	feed := feedLabel(rec)
+	fq, ok := qs.feeds[feed]
+	if !ok {
+		fq = newFeedQuality(feed)
+		qs.feeds[feed] = fq
+	}
+	clean := true
+	for _, check := range qualityChecks {
+		if check.issue(rec, qs.now) {
+			clean = false
+			fq.Issues[check.name]++
+			qs.total.Issues[check.name]++
+		}
+	}
+	fq.Stations++
+	qs.total.Stations++
+	if clean {
+		fq.Clean++
+		qs.total.Clean++
+	}
+	return []*stationRecord{rec}
+}
+
+// flush scores the feeds against the thresholds and writes the scorecard
+func (qs *qualityScorer) flush() []*stationRecord {
+	summary := qualitySummary{StaleDays: FlagQualityStale, MinScore: FlagQualityMin,
+		MaxIssues: qualityLimits, Passed: true, Total: qs.total}
+	for _, fq := range qs.feeds {
+		summary.Feeds = append(summary.Feeds, fq)
+	}
+	sort.Slice(summary.Feeds, func(i, j int) bool { return summary.Feeds[i].Feed < summary.Feeds[j].Feed })
+
+	for _, fq := range append(summary.Feeds, qs.total) {
+		fq.Score = 100
+		if fq.Stations > 0 {
+			fq.Score = math.Round(10000*float64(fq.Clean)/float64(fq.Stations)) / 100
+		}
+		if fq == qs.total {
+			continue
+		}
+		if fq.Score < FlagQualityMin {
+			fq.Failures = append(fq.Failures, fmt.Sprintf("score %.2f below %g", fq.Score, FlagQualityMin))
+		}
+		for _, check := range qualityChecks {
+			limit, ok := qualityLimits[check.name]
+			if !ok || fq.Stations <= 0 {
+				continue
+			}
+			pct := 100 * float64(fq.Issues[check.name]) / float64(fq.Stations)
+			if pct > limit {
+				fq.Failures = append(fq.Failures, fmt.Sprintf("%s in %.2f%% of stations, above %g%%", check.name, pct, limit))
+			}
+		}
+		for _, failure := range fq.Failures {
+			summary.Passed = false
+			xLog.Printf("quality of feed %s: %s", fq.Feed, failure)
+		}
+	}
+	qualityFailed = !summary.Passed
+
+	txt, err := json.MarshalIndent(summary, "", "  ")
+	if nil != err {
+		xLog.Printf("error marshalling quality scorecard: %s", err.Error())
+	} else {
+		writeOutputFile("quality.json", txt)
+	}
+	if FlagDebug || FlagVerbose {
+		printQualityScorecard(&summary)
+	}
+	return nil
+}
+
+// printQualityScorecard logs the scorecard as a table, a row per feed
+func printQualityScorecard(summary *qualitySummary) {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "FEED\tSTATIONS\tSCORE")
+	for _, check := range qualityChecks {
+		_, _ = fmt.Fprintf(tw, "\t%s", strings.ToUpper(check.name))
+	}
+	_, _ = fmt.Fprintln(tw)
+	for _, fq := range append(summary.Feeds, summary.Total) {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%.2f", fq.Feed, fq.Stations, fq.Score)
+		for _, check := range qualityChecks {
+			_, _ = fmt.Fprintf(tw, "\t%d", fq.Issues[check.name])
+		}
+		_, _ = fmt.Fprintln(tw)
+	}
+	_ = tw.Flush()
+	verdict := "passed"
+	if !summary.Passed {
+		verdict = "FAILED"
+	}
+	xLog.Printf("data quality (%s):\n%s", verdict, sb.String())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	denjson "github.com/nathanverrilli/denJson"
+	"github.com/shopspring/decimal"
+)
+
+// cleanStation is a station with none of the quality issues
+func cleanStation(now time.Time) *stationRecord {
+	rec := testStation("US", "CPT", "LOC1")
+	rec.Country = "USA"
+	rec.Address, rec.City, rec.TimeZone = "1 Main St", "Springfield", "America/Chicago"
+	rec.Coordinates = denjson.GeoLocation{Latitude: "39.8", Longitude: "-89.6"}
+	rec.LastUpdated = now.AddDate(0, 0, -1)
+	rec.Evses = []denjson.Evses{{UID: "1", Connectors: []denjson.Connector{{ID: "1", Voltage: 240, Amperage: 32}}}}
+	return rec
+}
+
+func TestQualityChecks(t *testing.T) {
+	FlagQualityStale = 30
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		change func(rec *stationRecord)
+		want   string // issues, comma separated
+	}{
+		{"clean", func(*stationRecord) {}, ""},
+		{"unreadable coordinates", func(rec *stationRecord) { rec.Coordinates.Latitude = "north" }, QUALITY_BAD_COORDINATES},
+		{"out of range", func(rec *stationRecord) { rec.Coordinates.Longitude = "-189.6" }, QUALITY_BAD_COORDINATES},
+		{"null island", func(rec *stationRecord) { rec.Coordinates = denjson.GeoLocation{Latitude: "0", Longitude: "0"} },
+			QUALITY_OUTSIDE_COUNTRY + "," + QUALITY_ZERO_COORDINATES},
+		{"wrong country", func(rec *stationRecord) { rec.Country = "FRA" }, QUALITY_OUTSIDE_COUNTRY},
+		{"unlisted country", func(rec *stationRecord) { rec.Country = "BRA" }, ""},
+		{"no evses", func(rec *stationRecord) { rec.Evses = nil }, QUALITY_NO_EVSES},
+		{"zero power", func(rec *stationRecord) { rec.Evses[0].Connectors[0].Amperage = 0 }, QUALITY_ZERO_POWER},
+		{"power from max_electric_power", func(rec *stationRecord) {
+			rec.Evses[0].Connectors[0] = denjson.Connector{ID: "1", MaxElectricPower: decimal.NewFromInt(7200)}
+		}, ""},
+		{"stale", func(rec *stationRecord) { rec.LastUpdated = now.AddDate(0, 0, -31) }, QUALITY_STALE},
+		{"never updated", func(rec *stationRecord) { rec.LastUpdated = time.Time{} }, QUALITY_STALE},
+		{"no time zone", func(rec *stationRecord) { rec.TimeZone = " " }, QUALITY_NO_TIME_ZONE},
+		{"no city", func(rec *stationRecord) { rec.City = "" }, QUALITY_EMPTY_ADDRESS},
+	}
+	for _, tt := range tests {
+		rec := cleanStation(now)
+		tt.change(rec)
+		var issues []string
+		for _, check := range qualityChecks {
+			if check.issue(rec, now) {
+				issues = append(issues, check.name)
+			}
+		}
+		sort.Strings(issues)
+		if got := strings.Join(issues, ","); got != tt.want {
+			t.Errorf("%s: issues %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckQuality(t *testing.T) {
+	defer func() {
+		FlagQuality, FlagQualityMin, FlagQualityMax, FlagQualityStale = false, 0, nil, 365
+	}()
+	tests := []struct {
+		quality bool
+		min     float64
+		max     []string
+		stale   int
+		wantErr string
+	}{
+		{false, 0, nil, 30, ""},
+		{false, 90, nil, 30, "need --quality"},
+		{true, 90, []string{"stale=5", " no_evses = 0.5 "}, 30, ""},
+		{true, 101, nil, 30, "must be a percent"},
+		{true, 0, nil, 0, "must be positive"},
+		{true, 0, []string{"stale"}, 30, "bad limit"},
+		{true, 0, []string{"mouldy=5"}, 30, "bad limit"},
+		{true, 0, []string{"stale=150"}, 30, "is not a percent"},
+	}
+	for _, tt := range tests {
+		FlagQuality, FlagQualityMin, FlagQualityMax, FlagQualityStale = tt.quality, tt.min, tt.max, tt.stale
+		limits, err := checkQuality()
+		if "" != tt.wantErr {
+			if nil == err || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkQuality(%v, %g, %q, %d): error %v, want %q", tt.quality, tt.min, tt.max, tt.stale, err, tt.wantErr)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("checkQuality(%v, %g, %q, %d): %s", tt.quality, tt.min, tt.max, tt.stale, err.Error())
+		}
+		if len(limits) != len(tt.max) {
+			t.Errorf("checkQuality limits %v, want %d", limits, len(tt.max))
+		}
+		if 2 == len(tt.max) && (5 != limits[QUALITY_STALE] || 0.5 != limits[QUALITY_NO_EVSES]) {
+			t.Errorf("checkQuality limits %v, want stale 5 and no_evses 0.5", limits)
+		}
+	}
+}
+
+func TestQualityScorerCounts(t *testing.T) {
+	FlagQualityStale = 30
+	qs := newQualityScorer()
+	for ix, change := range []func(rec *stationRecord){
+		func(*stationRecord) {},
+		func(rec *stationRecord) { rec.TimeZone = "" },
+		func(rec *stationRecord) { rec.TimeZone, rec.City = "", "" },
+		func(rec *stationRecord) { rec.src.feed = 1 },
+	} {
+		rec := cleanStation(qs.now)
+		rec.Region = "NA"
+		rec.src.index = ix
+		change(rec)
+		if out := qs.process(rec); 1 != len(out) || out[0] != rec {
+			t.Errorf("station %d not passed on", ix)
+		}
+	}
+	na := qs.feeds["NA/0"]
+	if nil == na || 3 != na.Stations || 1 != na.Clean || 2 != na.Issues[QUALITY_NO_TIME_ZONE] ||
+		1 != na.Issues[QUALITY_EMPTY_ADDRESS] || 0 != na.Issues[QUALITY_STALE] {
+		t.Errorf("feed NA/0 scored %+v", na)
+	}
+	if 4 != qs.total.Stations || 2 != qs.total.Clean || 1 != qs.feeds["NA/1"].Clean {
+		t.Errorf("total %+v, feed NA/1 %+v", qs.total, qs.feeds["NA/1"])
+	}
+}
@@ -47,11 +47,11 @@ func newHttpClient() (hc *http.Client) {
 
 // requestJsonObject sends an HTTP GET request to the provided URL with authorization and
 // retrieves the response as JSON. requestJsonObject utilizes backoff and retries on failures,
-// with headers defined globally. Returns the response body as a byte slice, the next link if present,
-// an X-Total-Count header value, and any error encountered.
+// with headers defined globally plus any extra headers of the endpoint. Returns the response body as a byte slice, the next link if present,
+// an X-Total-Count header value, the response headers, and any error encountered.
 // note that the http client is thread-safe, so this function is safe to call concurrently.
 // The mutex causes the HTTP requests to single-thread for debugging; not for use otherwise
-func requestJsonObject(requestUrl string, authorization string) (body []byte, next string, xCount int, err error) {
+func requestJsonObject(requestUrl string, authorization string, extraHeaders map[string]string) (body []byte, next string, xCount int, respHeader http.Header, err error) {
 	var backoffDelay int64 = 0
 	var httpAttempt = 0
 	var httpErr error = nil
@@ -63,6 +63,7 @@ func requestJsonObject(requestUrl string, authorization string) (body []byte, ne
 	body = nil
 	next = ""
 	xCount = 0
+	respHeader = nil
 
 	if FlagDebugger {
 		httpMutex.Lock()
@@ -77,7 +78,7 @@ func requestJsonObject(requestUrl string, authorization string) (body []byte, ne
 			if nil != cancelFunc {
 				cancelFunc()
 			}
-			return body, next, xCount, err
+			return body, next, xCount, respHeader, err
 		}
 		httpAttempt++
 
@@ -93,12 +94,15 @@ func requestJsonObject(requestUrl string, authorization string) (body []byte, ne
 		if nil != err {
 			cancelFunc()
 			xLog.Printf("Error creating HTTP request: %s", err.Error())
-			return body, next, xCount, err
+			return body, next, xCount, respHeader, err
 		}
 
 		for key, val := range headers {
 			hReq.Header.Set(key, val)
 		}
+		for key, val := range extraHeaders {
+			hReq.Header.Set(key, val)
+		}
 		hReq.Header.Set("Authorization", authorization)
 
 		resp, httpErr = hc.Do(hReq)
@@ -109,7 +113,7 @@ func requestJsonObject(requestUrl string, authorization string) (body []byte, ne
 			} else {
 				xLog.Printf("HTTP request [%s] failed with status code %d", requestUrl, resp.StatusCode)
 				if resp.StatusCode >= 400 {
-					return body, next, resp.StatusCode,
+					return body, next, resp.StatusCode, resp.Header,
 						fmt.Errorf("HTTP request [%s] failed with status code %d",
 							requestUrl, resp.StatusCode)
 				}
@@ -123,7 +127,7 @@ func requestJsonObject(requestUrl string, authorization string) (body []byte, ne
 	body, err = io.ReadAll(resp.Body)
 	if nil != err {
 		xLog.Printf("Error reading HTTP response body: %s", err.Error())
-		return body, next, xCount, err
+		return body, next, xCount, respHeader, err
 	}
 	defer misc.DeferError(resp.Body.Close)
 
@@ -144,5 +148,5 @@ func requestJsonObject(requestUrl string, authorization string) (body []byte, ne
 		}
 	}
 
-	return body, next, xCount, nil
+	return body, next, xCount, resp.Header, nil
 }
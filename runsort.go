@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MAX_MERGE_RUNS is the most sorted runs merged at once; more runs
+// are first merged into fewer, larger runs.
+const MAX_MERGE_RUNS = 64
+
+// SORT_ENTRY_OVERHEAD estimates the memory an entry takes beyond
+// its key and data
+const SORT_ENTRY_OVERHEAD = 64
+
+// sortEntry is one item of an external sort, ordered by key, then by
+// seq, which is unique, so the order is total.
+type sortEntry struct {
+	key  string
+	seq  uint64
+	data []byte
+}
+
+func (e *sortEntry) before(other *sortEntry) bool {
+	if e.key != other.key {
+		return e.key < other.key
+	}
+	return e.seq < other.seq
+}
+
+// runSorter is an external sort: entries are buffered in memory until
+// the buffer reaches its limit, then sorted and written to a run file
+// in dir. Reading back merges the runs. It is safe for concurrent use.
+type runSorter struct {
+	dir   string
+	limit int
+
+	lock     sync.Mutex
+	buffer   []sortEntry
+	buffered int
+	runs     []string
+	nextRun  int
+}
+
+// newRunSorter sorts in limit bytes of memory, spilling runs into dir
+func newRunSorter(dir string, limit int) *runSorter {
+	return &runSorter{dir: dir, limit: limit}
+}
+
+// add buffers an entry, spilling the buffer to a run when full
+func (rs *runSorter) add(e sortEntry) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.buffer = append(rs.buffer, e)
+	rs.buffered += len(e.key) + len(e.data) + SORT_ENTRY_OVERHEAD
+	if rs.buffered < rs.limit {
+		return nil
+	}
+	return rs.spill()
+}
+
+// spill sorts the buffer into a new run file; the lock must be held
+func (rs *runSorter) spill() error {
+	if len(rs.buffer) <= 0 {
+		return nil
+	}
+	sort.Slice(rs.buffer, func(i, j int) bool { return rs.buffer[i].before(&rs.buffer[j]) })
+	fn := rs.runFileName()
+	err := writeRun(fn, func(yield func(e *sortEntry) error) error {
+		for ix := range rs.buffer {
+			if err := yield(&rs.buffer[ix]); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return err
+	}
+	rs.runs = append(rs.runs, fn)
+	rs.buffer = nil
+	rs.buffered = 0
+	return nil
+}
+
+func (rs *runSorter) runFileName() string {
+	rs.nextRun++
+	return filepath.Join(rs.dir, fmt.Sprintf("run-%06d.bin", rs.nextRun))
+}
+
+// spilled is the number of run files written so far
+func (rs *runSorter) spilled() int {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return len(rs.runs)
+}
+
+// each calls fn with every entry, in order. It is meant for use once
+// every entry has been added. If nothing was spilled the sort is done
+// in memory; otherwise the runs are merged as they are read, so only
+// an entry of each run is held at a time.
+func (rs *runSorter) each(fn func(e *sortEntry) error) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if len(rs.runs) <= 0 {
+		sort.Slice(rs.buffer, func(i, j int) bool { return rs.buffer[i].before(&rs.buffer[j]) })
+		for ix := range rs.buffer {
+			if err := fn(&rs.buffer[ix]); nil != err {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := rs.spill()
+	if nil != err {
+		return err
+	}
+	for len(rs.runs) > MAX_MERGE_RUNS {
+		fn := rs.runFileName()
+		err = writeRun(fn, func(yield func(e *sortEntry) error) error {
+			return mergeRuns(rs.runs[:MAX_MERGE_RUNS], yield)
+		})
+		if nil != err {
+			return err
+		}
+		for _, run := range rs.runs[:MAX_MERGE_RUNS] {
+			_ = os.Remove(run)
+		}
+		rs.runs = append(rs.runs[MAX_MERGE_RUNS:], fn)
+	}
+	return mergeRuns(rs.runs, fn)
+}
+
+// groups calls fn with every group of entries sharing a key, in key
+// order, each group in seq order, as each does
+func (rs *runSorter) groups(fn func(group []sortEntry) error) error {
+	var group []sortEntry
+	err := rs.each(func(e *sortEntry) error {
+		if len(group) > 0 && group[0].key != e.key {
+			if err := fn(group); nil != err {
+				return err
+			}
+			group = nil
+		}
+		group = append(group, *e)
+		return nil
+	})
+	if nil != err {
+		return err
+	}
+	if len(group) > 0 {
+		return fn(group)
+	}
+	return nil
+}
+
+// writeRun writes the entries produced by fill to a run file:
+// for each, the key length, key, seq, data length and data.
+func writeRun(fn string, fill func(yield func(e *sortEntry) error) error) (err error) {
+	f, err := os.Create(fn)
+	if nil != err {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); nil == err {
+			err = closeErr
+		}
+	}()
+	w := bufio.NewWriterSize(f, 1<<16)
+	var num [binary.MaxVarintLen64]byte
+	err = fill(func(e *sortEntry) error {
+		_, _ = w.Write(num[:binary.PutUvarint(num[:], uint64(len(e.key)))])
+		_, _ = w.WriteString(e.key)
+		_, _ = w.Write(num[:binary.PutUvarint(num[:], e.seq)])
+		_, _ = w.Write(num[:binary.PutUvarint(num[:], uint64(len(e.data)))])
+		_, err := w.Write(e.data)
+		return err
+	})
+	if nil != err {
+		return err
+	}
+	return w.Flush()
+}
+
+// readSortEntry reads the next entry of a run file
+func readSortEntry(r *bufio.Reader) (e sortEntry, err error) {
+	n, err := binary.ReadUvarint(r)
+	if nil != err {
+		return e, err // io.EOF at the end of the run
+	}
+	key := make([]byte, n)
+	if _, err = io.ReadFull(r, key); nil != err {
+		return e, err
+	}
+	e.key = string(key)
+	if e.seq, err = binary.ReadUvarint(r); nil != err {
+		return e, err
+	}
+	if n, err = binary.ReadUvarint(r); nil != err {
+		return e, err
+	}
+	e.data = make([]byte, n)
+	_, err = io.ReadFull(r, e.data)
+	return e, err
+}
+
+// runReader is an open run file and its next entry
+type runReader struct {
+	f   *os.File
+	r   *bufio.Reader
+	cur sortEntry
+}
+
+// runHeap orders open runs by their next entry
+type runHeap []*runReader
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].cur.before(&h[j].cur) }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	rr := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return rr
+}
+
+// mergeRuns calls yield with the entries of every run, in order
+func mergeRuns(runs []string, yield func(e *sortEntry) error) error {
+	h := make(runHeap, 0, len(runs))
+	defer func() {
+		for _, rr := range h {
+			_ = rr.f.Close()
+		}
+	}()
+	for _, fn := range runs {
+		f, err := os.Open(fn)
+		if nil != err {
+			return err
+		}
+		rr := &runReader{f: f, r: bufio.NewReaderSize(f, 1<<16)}
+		rr.cur, err = readSortEntry(rr.r)
+		if errors.Is(err, io.EOF) {
+			_ = f.Close()
+			continue
+		}
+		if nil != err {
+			_ = f.Close()
+			return fmt.Errorf("reading run %s: %w", fn, err)
+		}
+		h = append(h, rr)
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		rr := h[0]
+		if err := yield(&rr.cur); nil != err {
+			return err
+		}
+		var err error
+		rr.cur, err = readSortEntry(rr.r)
+		if errors.Is(err, io.EOF) {
+			_ = rr.f.Close()
+			heap.Pop(&h)
+			continue
+		}
+		if nil != err {
+			return fmt.Errorf("reading run %s: %w", rr.f.Name(), err)
+		}
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestRunSorterGroups(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		entries   int
+		wantSpill bool
+	}{
+		{"in memory", 1 << 20, 500, false},
+		{"spilled", 4 << 10, 500, true},
+		{"more runs than merged at once", 1, 3 * MAX_MERGE_RUNS, true},
+	}
+	for _, tt := range tests {
+		rs := newRunSorter(t.TempDir(), tt.limit)
+		order := rand.New(rand.NewSource(1)).Perm(tt.entries)
+		for seq, ix := range order {
+			// three entries per key, arriving in shuffled order
+			e := sortEntry{key: fmt.Sprintf("key%04d", ix/3), seq: uint64(seq), data: []byte(fmt.Sprint(ix))}
+			if err := rs.add(e); nil != err {
+				t.Fatalf("%s: add: %s", tt.name, err.Error())
+			}
+		}
+		if spilled := rs.spilled() > 0; spilled != tt.wantSpill {
+			t.Errorf("%s: spilled %d runs", tt.name, rs.spilled())
+		}
+
+		var lastKey string
+		seen := 0
+		err := rs.groups(func(group []sortEntry) error {
+			key := group[0].key
+			if key <= lastKey {
+				return fmt.Errorf("group %s after %s", key, lastKey)
+			}
+			lastKey = key
+			for gx, e := range group {
+				if e.key != key {
+					return fmt.Errorf("entry %s in group %s", e.key, key)
+				}
+				if gx > 0 && e.seq <= group[gx-1].seq {
+					return fmt.Errorf("group %s out of seq order", key)
+				}
+			}
+			seen += len(group)
+			return nil
+		})
+		if nil != err {
+			t.Errorf("%s: %s", tt.name, err.Error())
+		}
+		if seen != tt.entries {
+			t.Errorf("%s: %d entries read back, want %d", tt.name, seen, tt.entries)
+		}
+	}
+}
+
+func TestRunRoundTrip(t *testing.T) {
+	fn := t.TempDir() + "/run.bin"
+	want := []sortEntry{
+		{key: "", seq: 0, data: nil},
+		{key: "a", seq: 1, data: []byte("x")},
+		{key: "b\x00c", seq: 1 << 40, data: []byte("{\"id\":\"LOC1\"}\n")},
+	}
+	err := writeRun(fn, func(yield func(e *sortEntry) error) error {
+		for ix := range want {
+			if err := yield(&want[ix]); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	var got []sortEntry
+	err = mergeRuns([]string{fn}, func(e *sortEntry) error {
+		got = append(got, *e)
+		return nil
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d entries, want %d", len(got), len(want))
+	}
+	for ix := range want {
+		if got[ix].key != want[ix].key || got[ix].seq != want[ix].seq || string(got[ix].data) != string(want[ix].data) {
+			t.Errorf("entry %d = %+v, want %+v", ix, got[ix], want[ix])
+		}
+	}
+}
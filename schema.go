@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// OCPI versions a location can be validated against
+const (
+	OCPI_211 = "2.1.1"
+	OCPI_221 = "2.2.1"
+)
+
+// MAX_ENUM_LISTED is the most values of an enumeration listed in a violation
+const MAX_ENUM_LISTED = 8
+
+// Kinds of value a schema field holds
+const (
+	KIND_STRING    = "string"
+	KIND_INT       = "int"
+	KIND_BOOL      = "bool"
+	KIND_DATETIME  = "datetime"
+	KIND_LATITUDE  = "latitude"
+	KIND_LONGITUDE = "longitude"
+	KIND_OBJECT    = "object"
+	KIND_LIST      = "list"
+)
+
+// schemaField is the rule for one field of an OCPI object. A list
+// holds values of the item kind: strings of an enum, or objects of
+// the item schema.
+type schemaField struct {
+	name     string
+	kind     string
+	required bool
+	maxLen   int      // strings
+	enum     []string // strings, or the strings of a list
+	item     string   // kind of a list's items
+	object   []schemaField
+	minItems int
+}
+
+var (
+	latitudePattern  = regexp.MustCompile(`^-?[0-9]{1,2}\.[0-9]{5,7}$`)
+	longitudePattern = regexp.MustCompile(`^-?[0-9]{1,3}\.[0-9]{5,7}$`)
+	countryPattern   = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// Enumerations shared by the versions; each version's schema adds its own values
+var (
+	evseStatus211 = []string{"AVAILABLE", "BLOCKED", "CHARGING", "INOPERATIVE",
+		"OUTOFORDER", "PLANNED", "REMOVED", "RESERVED", "UNKNOWN"}
+	connectorStandards211 = []string{"CHADEMO",
+		"DOMESTIC_A", "DOMESTIC_B", "DOMESTIC_C", "DOMESTIC_D", "DOMESTIC_E", "DOMESTIC_F",
+		"DOMESTIC_G", "DOMESTIC_H", "DOMESTIC_I", "DOMESTIC_J", "DOMESTIC_K", "DOMESTIC_L",
+		"IEC_60309_2_single_16", "IEC_60309_2_three_16", "IEC_60309_2_three_32", "IEC_60309_2_three_64",
+		"IEC_62196_T1", "IEC_62196_T1_COMBO", "IEC_62196_T2", "IEC_62196_T2_COMBO",
+		"IEC_62196_T3A", "IEC_62196_T3C", "TESLA_R", "TESLA_S"}
+	connectorStandards221 = append(append([]string{}, connectorStandards211...),
+		"CHAOJI", "GBT_AC", "GBT_DC", "IEC_61851_1", "MCS", "NEMA_5_20", "NEMA_6_30", "NEMA_6_50",
+		"NEMA_10_30", "NEMA_10_50", "NEMA_14_30", "NEMA_14_50", "PANTOGRAPH_BOTTOM_UP", "PANTOGRAPH_TOP_DOWN")
+	facilities211 = []string{"HOTEL", "RESTAURANT", "CAFE", "MALL", "SUPERMARKET", "SPORT",
+		"RECREATION_AREA", "NATURE", "MUSEUM", "BUS_STOP", "TAXI_STAND", "TRAIN_STATION",
+		"AIRPORT", "CARPOOL_PARKING", "FUEL_STATION", "WIFI"}
+	facilities221 = append(append([]string{}, facilities211...),
+		"PARKING_LOT", "BIKE_SHARING", "TRAM_STOP", "METRO_STATION")
+	capabilities211 = []string{"CHARGING_PROFILE_CAPABLE", "CREDIT_CARD_PAYABLE",
+		"REMOTE_START_STOP_CAPABLE", "RESERVABLE", "RFID_READER", "UNLOCK_CAPABLE"}
+	capabilities221 = append(append([]string{}, capabilities211...),
+		"CHARGING_PREFERENCES_CAPABLE", "CHIP_CARD_SUPPORT", "CONTACTLESS_CARD_SUPPORT",
+		"DEBIT_CARD_PAYABLE", "PED_TERMINAL", "START_SESSION_CONNECTOR_REQUIRED", "TOKEN_GROUP_CAPABLE")
+	geoLocation = []schemaField{
+		{name: "latitude", kind: KIND_LATITUDE, required: true},
+		{name: "longitude", kind: KIND_LONGITUDE, required: true},
+	}
+)
+
+// locationSchemas are the Location, EVSE and Connector objects of each
+// OCPI version: required fields, enumerations, string lengths and
+// coordinate formats. Fields not listed (including extensions) are not
+// checked.
+var locationSchemas = map[string][]schemaField{
+	OCPI_211: {
+		{name: "id", kind: KIND_STRING, required: true, maxLen: 39},
+		{name: "type", kind: KIND_STRING, required: true,
+			enum: []string{"ON_STREET", "PARKING_GARAGE", "UNDERGROUND_GARAGE", "PARKING_LOT", "OTHER", "UNKNOWN"}},
+		{name: "name", kind: KIND_STRING, maxLen: 255},
+		{name: "address", kind: KIND_STRING, required: true, maxLen: 45},
+		{name: "city", kind: KIND_STRING, required: true, maxLen: 45},
+		{name: "postal_code", kind: KIND_STRING, required: true, maxLen: 10},
+		{name: "country", kind: KIND_STRING, required: true, maxLen: 3},
+		{name: "coordinates", kind: KIND_OBJECT, required: true, object: geoLocation},
+		{name: "evses", kind: KIND_LIST, item: KIND_OBJECT, object: []schemaField{
+			{name: "uid", kind: KIND_STRING, required: true, maxLen: 39},
+			{name: "evse_id", kind: KIND_STRING, maxLen: 48},
+			{name: "status", kind: KIND_STRING, required: true, enum: evseStatus211},
+			{name: "capabilities", kind: KIND_LIST, item: KIND_STRING, enum: capabilities211},
+			{name: "connectors", kind: KIND_LIST, required: true, minItems: 1, item: KIND_OBJECT, object: []schemaField{
+				{name: "id", kind: KIND_STRING, required: true, maxLen: 36},
+				{name: "standard", kind: KIND_STRING, required: true, enum: connectorStandards211},
+				{name: "format", kind: KIND_STRING, required: true, enum: []string{"SOCKET", "CABLE"}},
+				{name: "power_type", kind: KIND_STRING, required: true, enum: []string{"AC_1_PHASE", "AC_3_PHASE", "DC"}},
+				{name: "voltage", kind: KIND_INT, required: true},
+				{name: "amperage", kind: KIND_INT, required: true},
+				{name: "tariff_id", kind: KIND_STRING, maxLen: 36},
+				{name: "last_updated", kind: KIND_DATETIME, required: true},
+			}},
+			{name: "floor_level", kind: KIND_STRING, maxLen: 4},
+			{name: "coordinates", kind: KIND_OBJECT, object: geoLocation},
+			{name: "physical_reference", kind: KIND_STRING, maxLen: 16},
+			{name: "last_updated", kind: KIND_DATETIME, required: true},
+		}},
+		{name: "facilities", kind: KIND_LIST, item: KIND_STRING, enum: facilities211},
+		{name: "time_zone", kind: KIND_STRING, maxLen: 255},
+		{name: "charging_when_closed", kind: KIND_BOOL},
+		{name: "last_updated", kind: KIND_DATETIME, required: true},
+	},
+	OCPI_221: {
+		{name: "country_code", kind: KIND_STRING, required: true, maxLen: 2},
+		{name: "party_id", kind: KIND_STRING, required: true, maxLen: 3},
+		{name: "id", kind: KIND_STRING, required: true, maxLen: 36},
+		{name: "publish", kind: KIND_BOOL, required: true},
+		{name: "name", kind: KIND_STRING, maxLen: 255},
+		{name: "address", kind: KIND_STRING, required: true, maxLen: 45},
+		{name: "city", kind: KIND_STRING, required: true, maxLen: 45},
+		{name: "postal_code", kind: KIND_STRING, maxLen: 10},
+		{name: "state", kind: KIND_STRING, maxLen: 20},
+		{name: "country", kind: KIND_STRING, required: true, maxLen: 3},
+		{name: "coordinates", kind: KIND_OBJECT, required: true, object: geoLocation},
+		{name: "parking_type", kind: KIND_STRING, enum: []string{"ALONG_MOTORWAY", "PARKING_GARAGE",
+			"PARKING_LOT", "ON_DRIVEWAY", "ON_STREET", "UNDERGROUND_GARAGE"}},
+		{name: "evses", kind: KIND_LIST, item: KIND_OBJECT, object: []schemaField{
+			{name: "uid", kind: KIND_STRING, required: true, maxLen: 36},
+			{name: "evse_id", kind: KIND_STRING, maxLen: 48},
+			{name: "status", kind: KIND_STRING, required: true, enum: evseStatus211},
+			{name: "capabilities", kind: KIND_LIST, item: KIND_STRING, enum: capabilities221},
+			{name: "connectors", kind: KIND_LIST, required: true, minItems: 1, item: KIND_OBJECT, object: []schemaField{
+				{name: "id", kind: KIND_STRING, required: true, maxLen: 36},
+				{name: "standard", kind: KIND_STRING, required: true, enum: connectorStandards221},
+				{name: "format", kind: KIND_STRING, required: true, enum: []string{"SOCKET", "CABLE"}},
+				{name: "power_type", kind: KIND_STRING, required: true,
+					enum: []string{"AC_1_PHASE", "AC_2_PHASE", "AC_2_PHASE_SPLIT", "AC_3_PHASE", "DC"}},
+				{name: "max_voltage", kind: KIND_INT, required: true},
+				{name: "max_amperage", kind: KIND_INT, required: true},
+				{name: "max_electric_power", kind: KIND_INT},
+				{name: "tariff_ids", kind: KIND_LIST, item: KIND_STRING},
+				{name: "last_updated", kind: KIND_DATETIME, required: true},
+			}},
+			{name: "floor_level", kind: KIND_STRING, maxLen: 4},
+			{name: "coordinates", kind: KIND_OBJECT, object: geoLocation},
+			{name: "physical_reference", kind: KIND_STRING, maxLen: 16},
+			{name: "last_updated", kind: KIND_DATETIME, required: true},
+		}},
+		{name: "facilities", kind: KIND_LIST, item: KIND_STRING, enum: facilities221},
+		{name: "time_zone", kind: KIND_STRING, required: true, maxLen: 255},
+		{name: "charging_when_closed", kind: KIND_BOOL},
+		{name: "last_updated", kind: KIND_DATETIME, required: true},
+	},
+}
+
+// checkSchemaVersion makes sure there is a schema for the version; empty is off
+func checkSchemaVersion(version string) error {
+	if "" == version {
+		return nil
+	}
+	if _, ok := locationSchemas[version]; !ok {
+		return fmt.Errorf("no schema for OCPI version %s (use %s or %s)", version, OCPI_211, OCPI_221)
+	}
+	return nil
+}
+
+// validateRawLocation checks a location as sent by a feed
+func validateRawLocation(raw json.RawMessage, version string) []string {
+	var loc map[string]any
+	err := json.Unmarshal(raw, &loc)
+	if nil != err {
+		return []string{"not a JSON object: " + err.Error()}
+	}
+	return validateLocation(loc, version)
+}
+
+// validateLocation checks a location, as generic JSON, against the
+// schema of an OCPI version, returning its violations
+func validateLocation(loc map[string]any, version string) (violations []string) {
+	validateObject(loc, locationSchemas[version], "", &violations)
+	if country, ok := loc["country"].(string); ok && !countryPattern.MatchString(country) {
+		violations = append(violations, fmt.Sprintf("country: %q is not an ISO 3166 alpha-3 code", country))
+	}
+	return violations
+}
+
+func validateObject(obj map[string]any, fields []schemaField, prefix string, violations *[]string) {
+	for ix := range fields {
+		field := &fields[ix]
+		path := prefix + field.name
+		value, ok := obj[field.name]
+		if m, isObj := value.(map[string]any); isObj && len(m) <= 0 && !field.required {
+			// an empty optional object is as good as none
+			continue
+		}
+		if !ok || nil == value {
+			if field.required {
+				*violations = append(*violations, path+": required")
+			}
+			continue
+		}
+		validateValue(value, field, field.kind, path, violations)
+	}
+}
+
+func validateValue(value any, field *schemaField, kind string, path string, violations *[]string) {
+	bad := func(format string, args ...any) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+	switch kind {
+	case KIND_STRING:
+		s, ok := value.(string)
+		if !ok {
+			bad("not a string")
+			return
+		}
+		if field.required && "" == s && len(field.enum) <= 0 {
+			bad("required, but empty")
+		}
+		if field.maxLen > 0 && utf8.RuneCountInString(s) > field.maxLen {
+			bad("%d characters, more than %d", utf8.RuneCountInString(s), field.maxLen)
+		}
+		if len(field.enum) > 0 && !containsString(field.enum, s) {
+			if len(field.enum) > MAX_ENUM_LISTED {
+				bad("%q is not a %s value of OCPI %s", s, field.name, FlagSchema)
+			} else {
+				bad("%q is not one of %s", s, strings.Join(field.enum, ", "))
+			}
+		}
+	case KIND_INT:
+		num, ok := numericValue(value)
+		if !ok || num != math.Trunc(num) {
+			bad("%v is not an integer", value)
+		}
+	case KIND_BOOL:
+		if _, ok := value.(bool); !ok {
+			bad("%v is not true or false", value)
+		}
+	case KIND_DATETIME:
+		s, ok := value.(string)
+		if !ok || !validDateTime(s) {
+			bad("%v is not an RFC 3339 date and time", value)
+		}
+	case KIND_LATITUDE, KIND_LONGITUDE:
+		s, ok := value.(string)
+		pattern, limit := latitudePattern, 90.0
+		if KIND_LONGITUDE == kind {
+			pattern, limit = longitudePattern, 180.0
+		}
+		num, isNum := numericValue(value)
+		switch {
+		case !ok:
+			bad("not a string")
+		case !pattern.MatchString(s):
+			bad("%q is not a decimal %s with 5 to 7 places", s, kind)
+		case !isNum || math.Abs(num) > limit:
+			bad("%q is out of range", s)
+		}
+	case KIND_OBJECT:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			bad("not an object")
+			return
+		}
+		validateObject(obj, field.object, path+".", violations)
+	case KIND_LIST:
+		list, ok := value.([]any)
+		if !ok {
+			bad("not a list")
+			return
+		}
+		if len(list) < field.minItems {
+			bad("%d items, fewer than %d", len(list), field.minItems)
+		}
+		for ix, item := range list {
+			validateValue(item, field, field.item, fmt.Sprintf("%s[%d]", path, ix), violations)
+		}
+	}
+}
+
+// validDateTime accepts RFC 3339, and the zone-less UTC form OCPI 2.1.1 allows
+func validDateTime(s string) bool {
+	if _, err := time.Parse(time.RFC3339Nano, s); nil == err {
+		return true
+	}
+	_, err := time.Parse("2006-01-02T15:04:05.999999999", s)
+	return nil == err
+}
+
+// quarantinedStation is an invalid station, where it was found and why it is invalid
+type quarantinedStation struct {
+	Feed       string          `json:"feed"`
+	Page       int             `json:"page"`
+	Index      int             `json:"index"`
+	Url        string          `json:"url,omitempty"`
+	Violations []string        `json:"violations"`
+	Location   json.RawMessage `json:"location"`
+}
+
+// quarantine writes invalid stations to quarantine.json, for any
+// number of workers, and counts them by feed
+type quarantine struct {
+	lock   sync.Mutex
+	wg     sync.WaitGroup
+	out    *stationWriter
+	counts map[string]int
+}
+
+func newQuarantine() (q *quarantine) {
+	q = &quarantine{counts: make(map[string]int, 4)}
+	q.out = newStationWriter("quarantine.json", &q.wg)
+	return q
+}
+
+// add quarantines a station
+func (q *quarantine) add(qs *quarantinedStation) {
+	txt, err := json.Marshal(qs)
+	if nil != err {
+		xLog.Printf("error marshalling quarantined station: %s", err.Error())
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.out.write(txt)
+	q.counts[qs.Feed]++
+}
+
+// close finishes quarantine.json, logging the counts
+func (q *quarantine) close() {
+	q.out.close()
+	q.wg.Wait()
+	if FlagDebug || FlagVerbose {
+		feeds := make([]string, 0, len(q.counts))
+		for feed := range q.counts {
+			feeds = append(feeds, feed)
+		}
+		sort.Strings(feeds)
+		for _, feed := range feeds {
+			xLog.Printf("stations quarantined from feed %s: %d", feed, q.counts[feed])
+		}
+		xLog.Printf("total stations quarantined (OCPI %s schema): %d", FlagSchema, q.out.count)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const validLocation221 = `{
+	"country_code": "US", "party_id": "CPT", "id": "LOC1", "publish": true,
+	"address": "1 Main St", "city": "Springfield", "country": "USA",
+	"coordinates": {"latitude": "49.250000", "longitude": "-123.100000"},
+	"time_zone": "America/Vancouver",
+	"evses": [{"uid": "1", "status": "AVAILABLE", "last_updated": "2024-06-01T00:00:00Z",
+		"connectors": [{"id": "1", "standard": "IEC_62196_T1", "format": "SOCKET",
+			"power_type": "AC_1_PHASE", "max_voltage": 240, "max_amperage": 32,
+			"last_updated": "2024-06-01T00:00:00Z"}]}],
+	"facilities": ["PARKING_LOT"],
+	"last_updated": "2024-06-01T00:00:00Z"}`
+
+func TestValidateLocation(t *testing.T) {
+	FlagSchema = OCPI_221
+	tests := []struct {
+		name   string
+		change func(loc map[string]any)
+		want   string // a violation, or "" for none
+	}{
+		{"valid", func(map[string]any) {}, ""},
+		{"missing", func(loc map[string]any) { delete(loc, "party_id") }, "party_id: required"},
+		{"null", func(loc map[string]any) { loc["city"] = nil }, "city: required"},
+		{"empty", func(loc map[string]any) { loc["address"] = "" }, "address: required, but empty"},
+		{"too long", func(loc map[string]any) { loc["country_code"] = "USA" }, "country_code: 3 characters, more than 2"},
+		{"country", func(loc map[string]any) { loc["country"] = "US" }, `country: "US" is not an ISO 3166 alpha-3 code`},
+		{"enum", func(loc map[string]any) { loc["parking_type"] = "ROOF" }, `parking_type: "ROOF" is not one of`},
+		{"list enum", func(loc map[string]any) { loc["facilities"] = []any{"PARKING_LOT", "SPA"} },
+			`facilities[1]: "SPA" is not a facilities value of OCPI 2.2.1`},
+		{"bool", func(loc map[string]any) { loc["publish"] = "yes" }, "publish: yes is not true or false"},
+		{"latitude places", func(loc map[string]any) {
+			loc["coordinates"] = map[string]any{"latitude": "49.25", "longitude": "-123.100000"}
+		}, `coordinates.latitude: "49.25" is not a decimal latitude with 5 to 7 places`},
+		{"latitude range", func(loc map[string]any) {
+			loc["coordinates"] = map[string]any{"latitude": "95.000000", "longitude": "-123.100000"}
+		}, `coordinates.latitude: "95.000000" is out of range`},
+		{"nested", func(loc map[string]any) {
+			loc["evses"].([]any)[0].(map[string]any)["connectors"].([]any)[0].(map[string]any)["max_voltage"] = 240.5
+		}, "evses[0].connectors[0].max_voltage: 240.5 is not an integer"},
+		{"min items", func(loc map[string]any) {
+			loc["evses"].([]any)[0].(map[string]any)["connectors"] = []any{}
+		}, "evses[0].connectors: 0 items, fewer than 1"},
+		{"datetime", func(loc map[string]any) { loc["last_updated"] = "yesterday" },
+			"last_updated: yesterday is not an RFC 3339 date and time"},
+		{"empty optional object", func(loc map[string]any) { loc["operator"] = map[string]any{} }, ""},
+		{"not an object", func(loc map[string]any) { loc["coordinates"] = "49,-123" }, "coordinates: not an object"},
+	}
+	for _, tt := range tests {
+		var loc map[string]any
+		if err := json.Unmarshal([]byte(validLocation221), &loc); nil != err {
+			t.Fatal(err)
+		}
+		tt.change(loc)
+		violations := validateLocation(loc, OCPI_221)
+		if "" == tt.want {
+			if len(violations) > 0 {
+				t.Errorf("%s: violations %q, want none", tt.name, violations)
+			}
+			continue
+		}
+		found := false
+		for _, v := range violations {
+			found = found || strings.HasPrefix(v, tt.want)
+		}
+		if !found {
+			t.Errorf("%s: violations %q, want %q", tt.name, violations, tt.want)
+		}
+	}
+}
+
+func TestValidateVersions(t *testing.T) {
+	FlagSchema = OCPI_211
+	raw := []byte(`{"id": "LOC1", "type": "ON_STREET", "address": "1 Main St", "city": "Springfield",
+		"postal_code": "12345", "country": "USA",
+		"coordinates": {"latitude": "49.250000", "longitude": "-123.100000"},
+		"facilities": ["PARKING_LOT"],
+		"last_updated": "2024-06-01T00:00:00"}`)
+	violations := validateRawLocation(raw, OCPI_211)
+	if 1 != len(violations) || !strings.HasPrefix(violations[0], `facilities[0]: "PARKING_LOT"`) {
+		t.Errorf("2.1.1 violations %q, want only PARKING_LOT, which is new in 2.2.1", violations)
+	}
+	if violations = validateRawLocation([]byte(`[1, 2]`), OCPI_211); 1 != len(violations) ||
+		!strings.HasPrefix(violations[0], "not a JSON object") {
+		t.Errorf("violations of a list %q", violations)
+	}
+	if nil == checkSchemaVersion("2.0") || nil != checkSchemaVersion("") || nil != checkSchemaVersion(OCPI_221) {
+		t.Errorf("checkSchemaVersion accepts the wrong versions")
+	}
+}
+
+func TestValidDateTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"2024-06-01T00:00:00Z", true},
+		{"2024-06-01T00:00:00.123+02:00", true},
+		{"2024-06-01T00:00:00", true}, // OCPI 2.1.1 UTC without a zone
+		{"2024-06-01T00:00:00.5", true},
+		{"2024-06-01", false},
+		{"2024-13-01T00:00:00Z", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validDateTime(tt.s); got != tt.want {
+			t.Errorf("validDateTime(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
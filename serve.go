@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// serveCommand serves a stations file over HTTP:
+//
+//	GET /locations            the whole file (?region=NA for one region)
+//	GET /locations/{key}      a single station by its dedupe key, the
+//	                          key's fields as path segments, e.g.
+//	                          /locations/CA/CPC/LOC0020 (a '/' within
+//	                          a field sent as %2F)
+//	GET /healthz              liveness
+//
+// The file is loaded once at startup.
+func serveCommand(args []string) int {
+	fn := stationsFileArg(args)
+	stations, err := loadStationsFile(fn)
+	if nil != err {
+		xLog.Printf("%s", err.Error())
+		return -1
+	}
+
+	xLog.Printf("serving %d stations from %s on http://%s/locations", len(stations), fn, FlagServeAddr)
+	err = http.ListenAndServe(FlagServeAddr, stationsMux(stations))
+	xLog.Printf("server stopped: %s", err.Error())
+	return -1
+}
+
+// stationsMux routes the requests for the stations
+func stationsMux(stations []stationRecord) *http.ServeMux {
+	// keyed as for dedupe: a bare ID is only unique within its party
+	byKey := make(map[string]*stationRecord, len(stations))
+	for ix := range stations {
+		key := dedupeKey(&stations[ix])
+		if _, ok := byKey[key]; ok {
+			xLog.Printf("warning: more than one station with key %s; serving the first", key)
+			continue
+		}
+		byKey[key] = &stations[ix]
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /locations", func(w http.ResponseWriter, r *http.Request) {
+		region := r.URL.Query().Get("region")
+		sp := stationPage{Data: stations}
+		if "" != region {
+			sp.Data = make([]stationRecord, 0, len(stations))
+			for ix := range stations {
+				if strings.EqualFold(region, stations[ix].Region) {
+					sp.Data = append(sp.Data, stations[ix])
+				}
+			}
+		}
+		writeJson(w, sp)
+	})
+	mux.HandleFunc("GET /locations/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		station, ok := byKey[requestKey(r)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, station)
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// requestKey is the dedupe key a station is requested by: the path
+// segments after /locations/, each unescaped then escaped as a key field
+func requestKey(r *http.Request) string {
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/locations/"), "/")
+	for ix := range segments {
+		field, err := url.PathUnescape(segments[ix])
+		if nil == err {
+			segments[ix] = keyField(field)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// writeJson writes v as the JSON body of a response
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if nil != err {
+		xLog.Printf("error writing response: %s", err.Error())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStationsMux(t *testing.T) {
+	FlagDedupeKey = []string{"country_code", "party_id", "id"}
+	stations := []stationRecord{
+		*testStation("CA", "CPC", "LOC1"),
+		*testStation("US", "CPT", "LOC1"), // same ID, another party
+		*testStation("US", "CPT", "a/b"),
+	}
+	stations[0].Name, stations[1].Name, stations[2].Name = "Canada", "States", "Slash"
+	stations[0].Region, stations[1].Region, stations[2].Region = "CA", "NA", "NA"
+	server := httptest.NewServer(stationsMux(stations))
+	defer server.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		name   string
+		count  int
+	}{
+		{"/locations/CA/CPC/LOC1", http.StatusOK, "Canada", 0},
+		{"/locations/US/CPT/LOC1", http.StatusOK, "States", 0},
+		{"/locations/US/CPT/a%2Fb", http.StatusOK, "Slash", 0},
+		{"/locations/US/CPT/a/b", http.StatusNotFound, "", 0},
+		{"/locations/LOC1", http.StatusNotFound, "", 0},
+		{"/locations", http.StatusOK, "", 3},
+		{"/locations?region=na", http.StatusOK, "", 2},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(server.URL + tt.path)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if http.StatusOK == resp.StatusCode {
+			var body struct {
+				Name string            `json:"name"`
+				Data []json.RawMessage `json:"data"`
+			}
+			if err = json.NewDecoder(resp.Body).Decode(&body); nil != err {
+				t.Errorf("%s: %s", tt.path, err)
+			}
+			if body.Name != tt.name || len(body.Data) != tt.count {
+				t.Errorf("%s: name %q, %d stations, want %q, %d", tt.path, body.Name, len(body.Data), tt.name, tt.count)
+			}
+		}
+		_ = resp.Body.Close()
+	}
+}
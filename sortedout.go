@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	misc "github.com/nathanverrilli/nlvMisc"
+)
+
+// Stations are written in the order they come out of the stages,
+// which depends on when each feed's pages arrive. With --sort they
+// are instead written sorted by the --sortkey fields, ties broken by
+// the station's JSON (then by its source, for identical copies), with
+// the fields of every object in a canonical (sorted) order: the same
+// stations make the same file, byte for byte. Stations are sorted with a runSorter, so a merge too large
+// for memory spills sorted runs to disk; they are held as spilled by
+// the disk index, and marshalled for output once sorted.
+
+// SORT_FIELD_SEPARATOR separates the fields of a sort key; it sorts
+// before any other character, so shorter fields sort first
+const SORT_FIELD_SEPARATOR = "\x00"
+
+// checkSortKey makes sure every sort key field is known
+func checkSortKey(fields []string) error {
+	if len(fields) <= 0 {
+		return fmt.Errorf("sort key has no fields")
+	}
+	for _, field := range fields {
+		if _, ok := stationFields[field]; !ok {
+			return fmt.Errorf("unknown sort key field %s", field)
+		}
+	}
+	return nil
+}
+
+// sortKey is the --sortkey fields of a station
+func sortKey(rec *stationRecord) string {
+	var sb strings.Builder
+	for ix, field := range FlagSortKey {
+		if ix > 0 {
+			sb.WriteString(SORT_FIELD_SEPARATOR)
+		}
+		sb.WriteString(stationFields[field](rec))
+	}
+	return sb.String()
+}
+
+// canonicalJson re-marshals JSON with the fields of every object
+// sorted, keeping numbers exactly as they are
+func canonicalJson(txt []byte) ([]byte, error) {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(txt))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if nil != err {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// sortedOutput holds the marshalled stations for sorting, spilling
+// runs into a new directory removed when the program ends
+type sortedOutput struct {
+	sorter *runSorter
+	seq    uint64
+}
+
+// newSortedOutput makes a sort under parent (the system temporary
+// directory, if empty), buffering up to limit bytes
+func newSortedOutput(parent string, limit int) (*sortedOutput, error) {
+	dir, err := os.MkdirTemp(parent, "mergeFeeds-sort-")
+	if nil != err {
+		return nil, err
+	}
+	misc.AtClose(func() { _ = os.RemoveAll(dir) })
+	return &sortedOutput{sorter: newRunSorter(dir, limit)}, nil
+}
+
+// add holds a station for sorting
+func (sorted *sortedOutput) add(rec *stationRecord) error {
+	txt, err := json.Marshal(rec)
+	if nil != err {
+		return err
+	}
+	sorted.seq++
+	return sorted.sorter.add(sortEntry{key: sortKey(rec), seq: sorted.seq, data: encodeSpilled(rec.src, txt)})
+}
+
+// each calls emit with every station, in order
+func (sorted *sortedOutput) each(emit func(rec *stationRecord)) error {
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("sorting %d stations by %s (%d runs spilled to disk)",
+			sorted.seq, strings.Join(FlagSortKey, ","), sorted.sorter.spilled())
+	}
+	return sorted.sorter.groups(func(group []sortEntry) error {
+		// arrival order is not deterministic, the station is
+		sort.Slice(group, func(i, j int) bool { return spilledBefore(group[i].data, group[j].data) })
+		for _, e := range group {
+			rec, err := decodeSpilled(e.data)
+			if nil != err {
+				return err
+			}
+			emit(rec)
+		}
+		return nil
+	})
+}
+
+// spilledBefore orders spilled stations by their JSON, then by source
+func spilledBefore(a []byte, b []byte) bool {
+	_, aTxt, _ := splitSpilled(a)
+	_, bTxt, _ := splitSpilled(b)
+	if cmp := bytes.Compare(aTxt, bTxt); 0 != cmp {
+		return cmp < 0
+	}
+	return bytes.Compare(a, b) < 0
+}
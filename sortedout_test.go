@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSortKey(t *testing.T) {
+	FlagSortKey = []string{"country_code", "party_id", "id"}
+	if err := checkSortKey(FlagSortKey); nil != err {
+		t.Errorf("checkSortKey(%q): %s", FlagSortKey, err.Error())
+	}
+	if nil == checkSortKey([]string{"id", "colour"}) || nil == checkSortKey(nil) {
+		t.Errorf("checkSortKey accepted an unknown or empty key")
+	}
+
+	// a shorter field sorts before a longer one it starts, whatever follows
+	recs := []*stationRecord{
+		testStation("US", "CPTX", "A"),
+		testStation("US", "CPT", "Z"),
+		testStation("CA", "FLO", "LOC1"),
+		testStation("US", "CPT", "LOC1"),
+		testStation("", "", "LOC0"),
+	}
+	sort.Slice(recs, func(i, j int) bool { return sortKey(recs[i]) < sortKey(recs[j]) })
+	var got []string
+	for _, rec := range recs {
+		got = append(got, dedupeKey(rec))
+	}
+	want := "[//LOC0 CA/FLO/LOC1 US/CPT/LOC1 US/CPT/Z US/CPTX/A]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("sorted %v, want %s", got, want)
+	}
+}
+
+func TestCanonicalJson(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`{"b": 1, "a": {"d": [3, {"f": 1, "e": 2}], "c": null}}`, `{"a":{"c":null,"d":[3,{"e":2,"f":1}]},"b":1}`},
+		{`{"power": 1.50, "big": 12345678901234567890}`, `{"big":12345678901234567890,"power":1.50}`},
+		{`["x", true]`, `["x",true]`},
+	}
+	for _, tt := range tests {
+		got, err := canonicalJson([]byte(tt.in))
+		if nil != err {
+			t.Errorf("canonicalJson(%s): %s", tt.in, err.Error())
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("canonicalJson(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	if _, err := canonicalJson([]byte(`{"a":`)); nil == err {
+		t.Errorf("canonicalJson of broken JSON did not fail")
+	}
+}
+
+// TestSortedOutputOrder checks that the order stations are added in
+// does not change the order they come out in, spilled or not
+func TestSortedOutputOrder(t *testing.T) {
+	FlagSortKey = []string{"country_code", "party_id", "id"}
+	var first []string
+	for run, limit := range []int{1 << 20, 1 << 20, 1 << 10, 1 << 10} {
+		list := indexStations(50, 2) // two copies of each key, from different feeds
+		rand.New(rand.NewSource(int64(run))).Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+
+		sorted, err := newSortedOutput(t.TempDir(), limit)
+		if nil != err {
+			t.Fatal(err)
+		}
+		for _, rec := range list {
+			if err = sorted.add(rec); nil != err {
+				t.Fatal(err)
+			}
+		}
+		var got []string
+		err = sorted.each(func(rec *stationRecord) {
+			got = append(got, fmt.Sprintf("%s %s %d", sortKey(rec), rec.Name, rec.src.feed))
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		if (sorted.sorter.spilled() > 0) != (limit < 1<<20) {
+			t.Errorf("run %d: spilled %d runs with a limit of %d", run, sorted.sorter.spilled(), limit)
+		}
+		if len(got) != len(list) {
+			t.Fatalf("run %d: %d stations out, %d in", run, len(got), len(list))
+		}
+		if nil == first {
+			first = got
+			continue
+		}
+		for ix := range got {
+			if got[ix] != first[ix] {
+				t.Fatalf("run %d: station %d is %q, first run had %q", run, ix, got[ix], first[ix])
+			}
+		}
+	}
+}
+
+func TestSortedOutputTies(t *testing.T) {
+	FlagSortKey = []string{"country_code", "party_id", "id"}
+	sorted, err := newSortedOutput(t.TempDir(), 1<<20)
+	if nil != err {
+		t.Fatal(err)
+	}
+	// same key: the JSON decides, then, for identical copies, the source
+	for ix, name := range []string{"Zed", "Abe", "Abe"} {
+		rec := testStation("US", "CPT", "LOC1")
+		rec.Name = name
+		rec.src = recordSource{feed: ix}
+		if err = sorted.add(rec); nil != err {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	err = sorted.each(func(rec *stationRecord) { got = append(got, fmt.Sprintf("%s/%d", rec.Name, rec.src.feed)) })
+	if nil != err || "[Abe/1 Abe/2 Zed/0]" != fmt.Sprint(got) {
+		t.Errorf("ties came out %v, error %v; want [Abe/1 Abe/2 Zed/0]", got, err)
+	}
+}
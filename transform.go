@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DEFAULT_REDACTION replaces redacted values, unless the transform
+// file gives "redactWith"
+const DEFAULT_REDACTION = "REDACTED"
+
+const transformExample string = "\n{ \"include\":   [ \"id\", \"name\", \"coordinates\", \"evses.evse_id\", \"operator\" ]," +
+	"\n  \"exclude\":   [ \"operator.website\" ]," +
+	"\n  \"redact\":    [ \"hotline.phone_number\" ]," +
+	"\n  \"redactWith\": \"REDACTED\"," +
+	"\n  \"rename\":    { \"coordinates.latitude\": \"lat\", \"coordinates.longitude\": \"lon\" }," +
+	"\n  \"constants\": { \"source\": \"mergeFeeds\", \"license.name\": \"ODbL\" }\n}\n"
+
+// transform reshapes each station written to stations.json (and the
+// region files). Fields are named by JSON paths, dots for nested
+// fields; a path through a list applies to every element. The steps
+// run in this order: include keeps only the paths listed (all, if
+// none are), exclude removes paths, redact replaces the value at each
+// path that has one, rename renames the last field of a path in place,
+// and constants sets values, creating objects along the path as needed.
+type transform struct {
+	Include    []string          `json:"include,omitempty"`
+	Exclude    []string          `json:"exclude,omitempty"`
+	Redact     []string          `json:"redact,omitempty"`
+	RedactWith *string           `json:"redactWith,omitempty"`
+	Rename     map[string]string `json:"rename,omitempty"`
+	Constants  map[string]any    `json:"constants,omitempty"`
+
+	include [][]string // parsed paths
+	exclude [][]string
+	redact  [][]string
+}
+
+// loadTransform reads and checks a transform file
+func loadTransform(fn string) (tf *transform, err error) {
+	txt, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	tf = &transform{}
+	decoder := json.NewDecoder(bytes.NewReader(txt))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(tf)
+	if nil != err {
+		return nil, fmt.Errorf("parsing %s: %w", fn, err)
+	}
+	for _, list := range []struct {
+		paths  []string
+		parsed *[][]string
+	}{{tf.Include, &tf.include}, {tf.Exclude, &tf.exclude}, {tf.Redact, &tf.redact}} {
+		for _, path := range list.paths {
+			parts, err := splitPath(path)
+			if nil != err {
+				return nil, err
+			}
+			*list.parsed = append(*list.parsed, parts)
+		}
+	}
+	for path, name := range tf.Rename {
+		if _, err = splitPath(path); nil != err {
+			return nil, err
+		}
+		if "" == name || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("rename of %s: new name %q must be a single field name", path, name)
+		}
+	}
+	for path := range tf.Constants {
+		if _, err = splitPath(path); nil != err {
+			return nil, err
+		}
+	}
+	if nil == tf.RedactWith {
+		redaction := DEFAULT_REDACTION
+		tf.RedactWith = &redaction
+	}
+	return tf, nil
+}
+
+// splitPath splits a JSON path at its dots
+func splitPath(path string) ([]string, error) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		if "" == part {
+			return nil, fmt.Errorf("bad field path %q", path)
+		}
+	}
+	return parts, nil
+}
+
+// apply transforms a station, returning the JSON to write
+func (tf *transform) apply(rec *stationRecord) ([]byte, error) {
+	generic, err := genericValue(rec)
+	if nil != err {
+		return nil, err
+	}
+	var value any = generic
+	if len(tf.include) > 0 {
+		value = includePaths(value, tf.include)
+	}
+	for _, path := range tf.exclude {
+		excludePath(value, path)
+	}
+	for _, path := range tf.redact {
+		redactPath(value, path, *tf.RedactWith)
+	}
+	// longest paths first, so renaming a parent does not hide a child
+	renames := make([]string, 0, len(tf.Rename))
+	for path := range tf.Rename {
+		renames = append(renames, path)
+	}
+	sort.Slice(renames, func(i, j int) bool {
+		if len(renames[i]) != len(renames[j]) {
+			return len(renames[i]) > len(renames[j])
+		}
+		return renames[i] < renames[j]
+	})
+	for _, path := range renames {
+		parts, _ := splitPath(path)
+		renamePath(value, parts, tf.Rename[path])
+	}
+	constants := make([]string, 0, len(tf.Constants))
+	for path := range tf.Constants {
+		constants = append(constants, path)
+	}
+	sort.Strings(constants)
+	for _, path := range constants {
+		parts, _ := splitPath(path)
+		if m, ok := value.(map[string]any); ok {
+			setPath(m, parts, tf.Constants[path])
+		}
+	}
+	return json.Marshal(value)
+}
+
+// includePaths copies only the values at the paths
+func includePaths(value any, paths [][]string) any {
+	switch v := value.(type) {
+	case []any:
+		list := make([]any, 0, len(v))
+		for _, item := range v {
+			list = append(list, includePaths(item, paths))
+		}
+		return list
+	case map[string]any:
+		children := make(map[string][][]string, len(paths))
+		whole := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			if 1 == len(path) {
+				whole[path[0]] = true
+			} else {
+				children[path[0]] = append(children[path[0]], path[1:])
+			}
+		}
+		m := make(map[string]any, len(whole)+len(children))
+		for key, item := range v {
+			switch {
+			case whole[key]:
+				m[key] = item
+			case nil != children[key]:
+				sub := includePaths(item, children[key])
+				if !emptyValue(sub) {
+					m[key] = sub
+				}
+			}
+		}
+		return m
+	}
+	// a scalar where the path continues has nothing to include
+	return nil
+}
+
+// emptyValue is true for nil and empty objects
+func emptyValue(value any) bool {
+	if nil == value {
+		return true
+	}
+	m, ok := value.(map[string]any)
+	return ok && len(m) <= 0
+}
+
+// visitParents calls fn with every object holding the last field of a path
+func visitParents(value any, path []string, fn func(parent map[string]any, key string)) {
+	switch v := value.(type) {
+	case []any:
+		for _, item := range v {
+			visitParents(item, path, fn)
+		}
+	case map[string]any:
+		if 1 == len(path) {
+			fn(v, path[0])
+			return
+		}
+		if next, ok := v[path[0]]; ok {
+			visitParents(next, path[1:], fn)
+		}
+	}
+}
+
+func excludePath(value any, path []string) {
+	visitParents(value, path, func(parent map[string]any, key string) { delete(parent, key) })
+}
+
+func redactPath(value any, path []string, redaction string) {
+	visitParents(value, path, func(parent map[string]any, key string) {
+		if item, ok := parent[key]; ok && !emptyValue(item) {
+			parent[key] = redaction
+		}
+	})
+}
+
+func renamePath(value any, path []string, name string) {
+	visitParents(value, path, func(parent map[string]any, key string) {
+		if item, ok := parent[key]; ok {
+			delete(parent, key)
+			parent[name] = item
+		}
+	})
+}
+
+// setPath sets the value at a path, creating objects as needed; a
+// path through a list sets the value in every element
+func setPath(m map[string]any, path []string, value any) {
+	if 1 == len(path) {
+		m[path[0]] = value
+		return
+	}
+	switch next := m[path[0]].(type) {
+	case map[string]any:
+		setPath(next, path[1:], value)
+	case []any:
+		for _, item := range next {
+			if child, ok := item.(map[string]any); ok {
+				setPath(child, path[1:], value)
+			}
+		}
+	default:
+		child := make(map[string]any, 1)
+		m[path[0]] = child
+		setPath(child, path[1:], value)
+	}
+}
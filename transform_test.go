@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	denjson "github.com/nathanverrilli/denJson"
+)
+
+// writeTransform writes a transform file and loads it
+func writeTransform(t *testing.T, body string) (*transform, error) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "transform.json")
+	if err := os.WriteFile(fn, []byte(body), 0o644); nil != err {
+		t.Fatal(err)
+	}
+	return loadTransform(fn)
+}
+
+func TestTransformApply(t *testing.T) {
+	rec := testStation("US", "CPT", "LOC1")
+	rec.Name = "Depot"
+	rec.Coordinates = denjson.GeoLocation{Latitude: "49.25", Longitude: "-123.1"}
+	rec.Operator.Name = "ChargePoint"
+	rec.Operator.Website = "https://example.com"
+	rec.Evses = []denjson.Evses{{UID: "1", EvseID: "US*CPT*E1", Status: "AVAILABLE"}, {UID: "2", Status: "CHARGING"}}
+
+	tests := []struct {
+		name      string
+		transform string
+		want      string
+	}{
+		{"include",
+			`{"include": ["id", "coordinates.latitude", "evses.evse_id"]}`,
+			`{"id":"LOC1","coordinates":{"latitude":"49.25"},"evses":[{"evse_id":"US*CPT*E1"},{}]}`},
+		{"include a missing path",
+			`{"include": ["id", "hotline.phone_number"]}`,
+			`{"id":"LOC1"}`},
+		{"include then exclude",
+			`{"include": ["id", "operator.name", "operator.website"], "exclude": ["operator.website"]}`,
+			`{"id":"LOC1","operator":{"name":"ChargePoint"}}`},
+		{"exclude through a list",
+			`{"include": ["id", "evses.uid", "evses.evse_id", "evses.status"], "exclude": ["evses.status", "evses.uid"]}`,
+			`{"id":"LOC1","evses":[{"evse_id":"US*CPT*E1"},{}]}`},
+		{"redact present values only",
+			`{"include": ["id", "evses.uid", "evses.evse_id", "evses.status"], "redact": ["evses.evse_id"], "redactWith": "***"}`,
+			`{"id":"LOC1","evses":[{"uid":"1","evse_id":"***","status":"AVAILABLE"},{"uid":"2","status":"CHARGING"}]}`},
+		{"default redaction",
+			`{"include": ["id", "name"], "redact": ["name"]}`,
+			`{"id":"LOC1","name":"REDACTED"}`},
+		{"rename child and parent",
+			`{"include": ["id", "coordinates"], "rename": {"coordinates": "position", "coordinates.latitude": "lat"}}`,
+			`{"id":"LOC1","position":{"lat":"49.25","longitude":"-123.1"}}`},
+		{"constants",
+			`{"include": ["id", "evses.uid"], "constants": {"source": "mergeFeeds", "license.name": "ODbL", "evses.open": true}}`,
+			`{"id":"LOC1","source":"mergeFeeds","license":{"name":"ODbL"},"evses":[{"uid":"1","open":true},{"uid":"2","open":true}]}`},
+	}
+	for _, tt := range tests {
+		tf, err := writeTransform(t, tt.transform)
+		if nil != err {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		txt, err := tf.apply(rec)
+		if nil != err {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		var got, want any
+		_ = json.Unmarshal(txt, &got)
+		_ = json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s\nwant %s", tt.name, txt, tt.want)
+		}
+	}
+	if "Depot" != rec.Name || "https://example.com" != rec.Operator.Website {
+		t.Errorf("applying transforms changed the station")
+	}
+}
+
+func TestLoadTransformErrors(t *testing.T) {
+	tests := []struct {
+		transform string
+		wantErr   string
+	}{
+		{`{"includes": ["id"]}`, "unknown field"},
+		{`{"include": ["evses..uid"]}`, "bad field path"},
+		{`{"exclude": [".id"]}`, "bad field path"},
+		{`{"rename": {"id": "a.b"}}`, "single field name"},
+		{`{"rename": {"id": ""}}`, "single field name"},
+		{`{"constants": {"a.": 1}}`, "bad field path"},
+		{`{"include": "id"}`, "parsing"},
+	}
+	for _, tt := range tests {
+		_, err := writeTransform(t, tt.transform)
+		if nil == err || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("loadTransform(%s): error %v, want %q", tt.transform, err, tt.wantErr)
+		}
+	}
+}
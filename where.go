@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+// A --where expression selects the stations written. Its grammar:
+//
+//	expr       = and { "or" and }
+//	and        = not { "and" not }
+//	not        = "not" not | "(" expr ")" | comparison
+//	comparison = path op value | path [ "not" ] "in" "(" value { "," value } ")"
+//	op         = "=" | "==" | "!=" | "<" | "<=" | ">" | ">="
+//	value      = "string" | 'string' | number | true | false
+//
+// A path names a field by its JSON name, with dots for nested fields,
+// e.g. evses.connectors.max_electric_power. A path through a list
+// reaches every element, and a comparison holds if it holds for any
+// value reached; != and "not in" hold if values are reached and none
+// is equal. A number compares numerically with numbers and numeric
+// strings (OCPI powers are strings), anything else compares as text.
+// Keywords are not case sensitive.
+//
+// A missing (or null) field has no value: no value is equal to
+// anything, so != and "not in" hold for it, and every other comparison
+// is false. parking_type != "ON_DRIVEWAY" keeps stations without a
+// parking_type; to keep only stations that have one, add a clause, as
+// in parking_type != "ON_DRIVEWAY" and parking_type > "". The one
+// exception is a comparison with true or false, where a missing field
+// is false, since false is left out of the JSON stations are written in.
+
+// whereNode is a node of a parsed --where expression
+type whereNode interface {
+	eval(rec map[string]any) bool
+	String() string
+}
+
+type whereAnd struct{ left, right whereNode }
+type whereOr struct{ left, right whereNode }
+type whereNot struct{ expr whereNode }
+
+// whereCompare compares the values at a path with one or more literals
+type whereCompare struct {
+	path   []string
+	op     string // "in" for a list of values
+	values []any  // string, float64 or bool
+	text   string // as written, for --explain
+}
+
+func (n *whereAnd) eval(rec map[string]any) bool { return n.left.eval(rec) && n.right.eval(rec) }
+func (n *whereOr) eval(rec map[string]any) bool  { return n.left.eval(rec) || n.right.eval(rec) }
+func (n *whereNot) eval(rec map[string]any) bool { return !n.expr.eval(rec) }
+
+func (n *whereAnd) String() string     { return grouped(n.left, false) + " and " + grouped(n.right, false) }
+func (n *whereOr) String() string      { return n.left.String() + " or " + n.right.String() }
+func (n *whereNot) String() string     { return "not " + grouped(n.expr, true) }
+func (n *whereCompare) String() string { return n.text }
+
+// grouped puts an or (or, under a not, an and) in parentheses
+func grouped(node whereNode, underNot bool) string {
+	switch node.(type) {
+	case *whereOr:
+		return "(" + node.String() + ")"
+	case *whereAnd:
+		if underNot {
+			return "(" + node.String() + ")"
+		}
+	}
+	return node.String()
+}
+
+func (n *whereCompare) eval(rec map[string]any) bool {
+	var missing any
+	for _, value := range n.values {
+		if _, ok := value.(bool); ok {
+			missing = false
+		}
+	}
+	found := pathValues(rec, n.path, missing)
+	switch n.op {
+	case "!=":
+		return !anyValue(found, n.values, "==")
+	case "not in":
+		return !anyValue(found, n.values, "==")
+	case "in":
+		return anyValue(found, n.values, "==")
+	}
+	return anyValue(found, n.values, n.op)
+}
+
+// anyValue is true if any value found compares true with any literal
+func anyValue(found []any, literals []any, op string) bool {
+	for _, value := range found {
+		for _, literal := range literals {
+			if compareValue(value, literal, op) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareValue compares a value from a station with a literal
+func compareValue(value any, literal any, op string) bool {
+	var cmp int
+	switch lit := literal.(type) {
+	case float64:
+		num, ok := numericValue(value)
+		if !ok {
+			return false
+		}
+		switch {
+		case num < lit:
+			cmp = -1
+		case num > lit:
+			cmp = 1
+		}
+	case bool:
+		b, ok := value.(bool)
+		if !ok || ("==" != op) {
+			return false
+		}
+		return b == lit
+	case string:
+		cmp = strings.Compare(fmt.Sprint(value), lit)
+	}
+	switch op {
+	case "==":
+		return 0 == cmp
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// numericValue reads a number, or a string holding a number
+func numericValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		num, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return num, nil == err && !math.IsNaN(num)
+	}
+	return 0, false
+}
+
+// pathValues collects every value at a path, descending into lists.
+// Where the path is missing or null, missing is found instead, unless
+// it is nil.
+func pathValues(value any, path []string, missing any) (found []any) {
+	if nil == value {
+		if nil == missing {
+			return nil
+		}
+		return []any{missing}
+	}
+	if len(path) <= 0 {
+		if list, ok := value.([]any); ok {
+			return list
+		}
+		return []any{value}
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		return pathValues(v[path[0]], path[1:], missing)
+	case []any:
+		for _, item := range v {
+			found = append(found, pathValues(item, path, missing)...)
+		}
+	}
+	return found
+}
+
+// whereToken is a token of a --where expression
+type whereToken struct {
+	kind  string // "word", "string", "number", "op", "(", ")", ",", "end"
+	text  string
+	value any
+	pos   int
+}
+
+// whereParser is a recursive descent parser of --where expressions
+type whereParser struct {
+	src    string
+	tokens []whereToken
+	next   int
+}
+
+// whereError is a parse error, pointing at the place in the expression
+func whereError(src string, pos int, format string, args ...any) error {
+	return fmt.Errorf("%s at column %d\n  %s\n  %s^",
+		fmt.Sprintf(format, args...), pos+1, src, strings.Repeat(" ", pos))
+}
+
+// lexWhere splits an expression into tokens
+func lexWhere(src string) (tokens []whereToken, err error) {
+	runes := []rune(src)
+	for ix := 0; ix < len(runes); {
+		r := runes[ix]
+		start := ix
+		switch {
+		case unicode.IsSpace(r):
+			ix++
+			continue
+		case '(' == r || ')' == r || ',' == r:
+			tokens = append(tokens, whereToken{kind: string(r), text: string(r), pos: start})
+			ix++
+		case strings.ContainsRune("=!<>", r):
+			ix++
+			if ix < len(runes) && '=' == runes[ix] {
+				ix++
+			}
+			op := string(runes[start:ix])
+			switch op {
+			case "=":
+				op = "=="
+			case "!":
+				return nil, whereError(src, start, "expected != ")
+			}
+			tokens = append(tokens, whereToken{kind: "op", text: op, pos: start})
+		case '"' == r || '\'' == r:
+			var sb strings.Builder
+			ix++
+			for ; ix < len(runes) && r != runes[ix]; ix++ {
+				if '\\' == runes[ix] && ix+1 < len(runes) {
+					ix++
+				}
+				sb.WriteRune(runes[ix])
+			}
+			if ix >= len(runes) {
+				return nil, whereError(src, start, "unterminated string")
+			}
+			ix++
+			tokens = append(tokens, whereToken{kind: "string", text: string(runes[start:ix]), value: sb.String(), pos: start})
+		case unicode.IsDigit(r) || '-' == r || '.' == r:
+			for ix++; ix < len(runes) && (unicode.IsDigit(runes[ix]) || strings.ContainsRune(".eE+-", runes[ix])); ix++ {
+			}
+			text := string(runes[start:ix])
+			num, err := strconv.ParseFloat(text, 64)
+			if nil != err {
+				return nil, whereError(src, start, "bad number %s", text)
+			}
+			tokens = append(tokens, whereToken{kind: "number", text: text, value: num, pos: start})
+		case unicode.IsLetter(r) || '_' == r:
+			for ix++; ix < len(runes) && (unicode.IsLetter(runes[ix]) || unicode.IsDigit(runes[ix]) ||
+				'_' == runes[ix] || '.' == runes[ix]); ix++ {
+			}
+			tokens = append(tokens, whereToken{kind: "word", text: string(runes[start:ix]), pos: start})
+		default:
+			return nil, whereError(src, start, "unexpected character %q", r)
+		}
+	}
+	return append(tokens, whereToken{kind: "end", pos: len(runes)}), nil
+}
+
+// parseWhere parses a --where expression
+func parseWhere(src string) (node whereNode, err error) {
+	tokens, err := lexWhere(src)
+	if nil != err {
+		return nil, err
+	}
+	p := &whereParser{src: src, tokens: tokens}
+	node, err = p.parseOr()
+	if nil != err {
+		return nil, err
+	}
+	if tok := p.peek(); "end" != tok.kind {
+		return nil, whereError(src, tok.pos, "expected and, or or the end, not %s", tok.text)
+	}
+	return node, nil
+}
+
+func (p *whereParser) peek() whereToken { return p.tokens[p.next] }
+
+func (p *whereParser) take() whereToken {
+	tok := p.tokens[p.next]
+	if "end" != tok.kind {
+		p.next++
+	}
+	return tok
+}
+
+// isKeyword is true if the token is the (case insensitive) keyword
+func (tok whereToken) isKeyword(word string) bool {
+	return "word" == tok.kind && strings.EqualFold(word, tok.text)
+}
+
+func (p *whereParser) parseOr() (whereNode, error) {
+	left, err := p.parseAnd()
+	for nil == err && p.peek().isKeyword("or") {
+		p.take()
+		var right whereNode
+		right, err = p.parseAnd()
+		left = &whereOr{left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whereParser) parseAnd() (whereNode, error) {
+	left, err := p.parseNot()
+	for nil == err && p.peek().isKeyword("and") {
+		p.take()
+		var right whereNode
+		right, err = p.parseNot()
+		left = &whereAnd{left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whereParser) parseNot() (whereNode, error) {
+	tok := p.peek()
+	switch {
+	case tok.isKeyword("not"):
+		p.take()
+		expr, err := p.parseNot()
+		return &whereNot{expr: expr}, err
+	case "(" == tok.kind:
+		p.take()
+		expr, err := p.parseOr()
+		if nil != err {
+			return nil, err
+		}
+		if closing := p.take(); ")" != closing.kind {
+			return nil, whereError(p.src, closing.pos, "expected )")
+		}
+		return expr, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *whereParser) parseCompare() (whereNode, error) {
+	tok := p.take()
+	if "word" != tok.kind || tok.isKeyword("and") || tok.isKeyword("or") || tok.isKeyword("in") {
+		return nil, whereError(p.src, tok.pos, "expected a field name")
+	}
+	n := &whereCompare{path: strings.Split(tok.text, ".")}
+	for _, part := range n.path {
+		if "" == part {
+			return nil, whereError(p.src, tok.pos, "bad field name %s", tok.text)
+		}
+	}
+
+	opTok := p.take()
+	switch {
+	case "op" == opTok.kind:
+		n.op = opTok.text
+		value, err := p.parseValue()
+		if nil != err {
+			return nil, err
+		}
+		if _, ok := value.(bool); ok && "==" != n.op && "!=" != n.op {
+			return nil, whereError(p.src, opTok.pos, "%s does not compare true or false", n.op)
+		}
+		n.values = []any{value}
+	case opTok.isKeyword("in"):
+		n.op = "in"
+	case opTok.isKeyword("not") && p.peek().isKeyword("in"):
+		p.take()
+		n.op = "not in"
+	default:
+		return nil, whereError(p.src, opTok.pos, "expected a comparison (= != < <= > >= in) after %s", tok.text)
+	}
+
+	if "in" == n.op || "not in" == n.op {
+		if open := p.take(); "(" != open.kind {
+			return nil, whereError(p.src, open.pos, "expected ( to start the list of values")
+		}
+		for {
+			value, err := p.parseValue()
+			if nil != err {
+				return nil, err
+			}
+			n.values = append(n.values, value)
+			sep := p.take()
+			if ")" == sep.kind {
+				break
+			}
+			if "," != sep.kind {
+				return nil, whereError(p.src, sep.pos, "expected , or ) in the list of values")
+			}
+		}
+	}
+	last := p.tokens[p.next-1]
+	n.text = p.src[byteOffset(p.src, tok.pos):byteOffset(p.src, last.pos+len([]rune(last.text)))]
+	return n, nil
+}
+
+func (p *whereParser) parseValue() (any, error) {
+	tok := p.take()
+	switch {
+	case "string" == tok.kind || "number" == tok.kind:
+		return tok.value, nil
+	case tok.isKeyword("true"):
+		return true, nil
+	case tok.isKeyword("false"):
+		return false, nil
+	}
+	return nil, whereError(p.src, tok.pos, "expected a value (\"text\", number, true or false)")
+}
+
+// byteOffset converts a position in runes to a position in bytes
+func byteOffset(s string, runePos int) int {
+	ix := 0
+	for offset := range s {
+		if ix == runePos {
+			return offset
+		}
+		ix++
+	}
+	return len(s)
+}
+
+// whereClauses splits an expression into the clauses joined by its
+// top-level ands, for --explain
+func whereClauses(node whereNode) []whereNode {
+	if and, ok := node.(*whereAnd); ok {
+		return append(whereClauses(and.left), whereClauses(and.right)...)
+	}
+	return []whereNode{node}
+}
+
+// whereFilter is the stationStage keeping the stations matching a
+// --where expression. With FlagExplain it evaluates each top-level
+// clause on its own, counting the stations each fails and the stations
+// each removed (the first failing clause, in order).
+type whereFilter struct {
+	clauses []whereNode
+	failed  []int
+	removed []int
+	seen    int
+	kept    int
+}
+
+func newWhereFilter(node whereNode) *whereFilter {
+	clauses := whereClauses(node)
+	return &whereFilter{clauses: clauses, failed: make([]int, len(clauses)), removed: make([]int, len(clauses))}
+}
+
+// process passes on the station if every clause holds
+func (wf *whereFilter) process(rec *stationRecord) []*stationRecord {
+	wf.seen++
+	generic, err := genericValue(rec)
+	if nil != err {
+		xLog.Printf("error preparing station %s for --where: %s", rec.ID, err.Error())
+		return nil
+	}
+	keep := true
+	for ix, clause := range wf.clauses {
+		if !FlagExplain && !keep {
+			break
+		}
+		if clause.eval(generic) {
+			continue
+		}
+		wf.failed[ix]++
+		if keep {
+			wf.removed[ix]++
+			keep = false
+		}
+	}
+	if !keep {
+		return nil
+	}
+	wf.kept++
+	return []*stationRecord{rec}
+}
+
+// flush logs the counts; nothing is held
+func (wf *whereFilter) flush() []*stationRecord {
+	if FlagExplain {
+		var sb strings.Builder
+		tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintf(tw, "CLAUSE\tFAILED\tREMOVED\n")
+		for ix, clause := range wf.clauses {
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\n", clause.String(), wf.failed[ix], wf.removed[ix])
+		}
+		_ = tw.Flush()
+		xLog.Printf("--where explained: %d stations in, %d kept\n%s", wf.seen, wf.kept, sb.String())
+	} else if FlagDebug || FlagVerbose {
+		xLog.Printf("--where kept %d of %d stations", wf.kept, wf.seen)
+	}
+	return nil
+}
+
+// genericValue is a station as generic JSON: maps, lists, strings,
+// float64 and bool
+func genericValue(rec *stationRecord) (generic map[string]any, err error) {
+	txt, err := json.Marshal(rec)
+	if nil != err {
+		return nil, err
+	}
+	err = json.Unmarshal(txt, &generic)
+	return generic, err
+}
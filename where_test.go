@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseWhere(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    string // the parsed expression printed back
+		wantErr string
+	}{
+		{src: `country = "USA"`, want: `country = "USA"`},
+		{src: `a = 1 and b = 2 or c = 3`, want: `a = 1 and b = 2 or c = 3`},
+		{src: `a = 1 and (b = 2 or c = 3)`, want: `a = 1 and (b = 2 or c = 3)`},
+		{src: `NOT (a = 1 AND b = 2)`, want: `not (a = 1 and b = 2)`},
+		{src: `x not in ('a', "b")`, want: `x not in ('a', "b")`},
+		{src: `évse.nom = "Café"`, want: `évse.nom = "Café"`},
+		{src: `a =`, wantErr: "expected a value"},
+		{src: `= 1`, wantErr: "expected a field name"},
+		{src: `a ! 1`, wantErr: "expected !="},
+		{src: `a = "open`, wantErr: "unterminated string"},
+		{src: `a < true`, wantErr: "does not compare true or false"},
+		{src: `a in ("x" "y")`, wantErr: "expected , or )"},
+		{src: `(a = 1`, wantErr: "expected )"},
+		{src: `a = 1 b = 2`, wantErr: "expected and, or or the end"},
+		{src: `a..b = 1`, wantErr: "bad field name"},
+		{src: `a = 1.2.3`, wantErr: "bad number"},
+	}
+	for _, tt := range tests {
+		node, err := parseWhere(tt.src)
+		if "" != tt.wantErr {
+			if nil == err || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseWhere(%s): error %v, want %q", tt.src, err, tt.wantErr)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("parseWhere(%s): %s", tt.src, err.Error())
+			continue
+		}
+		if got := node.String(); got != tt.want {
+			t.Errorf("parseWhere(%s) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestWhereEval(t *testing.T) {
+	station := `{
+		"country": "USA", "name": "Depot", "parking_type": "ON_STREET",
+		"charging_when_closed": true,
+		"coordinates": {"latitude": "49.25", "longitude": "-123.1"},
+		"opening_times": {"regular_hours": [{"weekday": 1}]},
+		"evses": [
+			{"uid": "1", "status": "AVAILABLE", "connectors": [{"id": "1", "max_electric_power": 7200}]},
+			{"uid": "2", "status": "CHARGING", "connectors": [{"id": "1", "max_electric_power": 150000}]}
+		]}`
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(station), &rec); nil != err {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`country = "USA"`, true},
+		{`country != "USA"`, false},
+		{`country in ("CAN", "USA")`, true},
+		{`country not in ("CAN", "MEX")`, true},
+		{`coordinates.latitude > 49`, true},                    // numeric string
+		{`coordinates.latitude < "5"`, true},                   // text
+		{`evses.connectors.max_electric_power >= 50000`, true}, // any EVSE
+		{`evses.status = "OUTOFORDER"`, false},
+		{`evses.status != "AVAILABLE"`, false}, // one is AVAILABLE
+		{`not evses.status = "OUTOFORDER" and name = 'Depot'`, true},
+
+		// missing fields equal nothing: only != and not in hold
+		{`operator.name = "X"`, false},
+		{`operator.name != "X"`, true},
+		{`operator.name not in ("X")`, true},
+		{`operator.name in ("X")`, false},
+		{`operator.name < "X"`, false},
+		{`not operator.name = "X"`, true},
+		{`time_zone != "UTC"`, true},
+		{`time_zone != "UTC" and time_zone > ""`, false},
+		{`evses.connectors.format != "CABLE"`, true}, // missing in every connector
+		{`directions.text = "X" or name = "Depot"`, true},
+
+		// false is left out of the JSON, so missing reads as false
+		{`charging_when_closed = true`, true},
+		{`charging_when_closed = false`, false},
+		{`opening_times.twentyfourseven = false`, true},
+		{`opening_times.twentyfourseven = true`, false},
+		{`opening_times.twentyfourseven != true`, true},
+		{`evses.parking = false`, true},
+	}
+	for _, tt := range tests {
+		node, err := parseWhere(tt.src)
+		if nil != err {
+			t.Errorf("parseWhere(%s): %s", tt.src, err.Error())
+			continue
+		}
+		if got := node.eval(rec); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestWhereClauses(t *testing.T) {
+	node, err := parseWhere(`a = 1 and (b = 2 or c = 3) and not d = 4`)
+	if nil != err {
+		t.Fatal(err)
+	}
+	clauses := whereClauses(node)
+	want := []string{`a = 1`, `(b = 2 or c = 3)`, `not d = 4`}
+	if len(clauses) != len(want) {
+		t.Fatalf("%d clauses, want %d", len(clauses), len(want))
+	}
+	for ix, clause := range clauses {
+		if got := grouped(clause, false); got != want[ix] {
+			t.Errorf("clause %d = %s, want %s", ix, got, want[ix])
+		}
+	}
+}